@@ -0,0 +1,278 @@
+package bitcask
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// errDatafilesChanged is the error returned by a merge of the open database
+// whose datafiles were replaced (e.g: by ReplaceWith) while it was merging
+var errDatafilesChanged = errors.New("error: datafiles changed during merge")
+
+// Merge merges the datafiles of the open database, like the package level
+// Merge does for a closed one, while it keeps serving reads and writes. The
+// active datafile is rotated first so that all of the data written so far
+// is merged and writes made during the merge go to the new active datafile.
+// The write lock is only held to rotate the active datafile and to swap in
+// the merged datafiles, at which point the index is updated for the keys
+// that weren't written again in the meantime, so no writes are lost.
+func (b *Bitcask) Merge() error {
+	return b.MergeContext(context.Background())
+}
+
+// MergeContext is like Merge but stops, returning ctx.Err(), once the
+// context `ctx` is done, which is checked between the entries being merged.
+// A merge that is stopped is discarded, leaving the datafiles as they were
+// before the merge.
+func (b *Bitcask) MergeContext(ctx context.Context) error {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+
+	start := time.Now()
+	if err := b.mergeOpen(ctx); err != nil {
+		return err
+	}
+	b.config.metrics.ObserveMergeDuration(time.Since(start))
+	b.observeDiskBytes()
+	return nil
+}
+
+func (b *Bitcask) mergeOpen(ctx context.Context) (err error) {
+	b.merging.Lock()
+	defer b.merging.Unlock()
+
+	b.mu.Lock()
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	if b.curr.Size() > 0 {
+		if err := b.rotate(); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	datafiles := make(map[int]*internal.Datafile, len(b.datafiles))
+	ids := make([]int, 0, len(b.datafiles))
+	for id, df := range b.datafiles {
+		datafiles[id] = df
+		ids = append(ids, id)
+	}
+	b.mu.Unlock()
+
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Ints(ids)
+
+	temp, err := beginMerge(b.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			discardMerge(b.path)
+		}
+	}()
+
+	later := make(map[string]int)
+	for i := len(ids) - 1; i >= 0; i-- {
+		if err := mergeDatafile(ctx, b.path, temp, ids[i], i > 0, later, b.config); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.config.fault(FaultMergeCommit); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, df := range datafiles {
+		if b.datafiles[id] != df {
+			return errDatafilesChanged
+		}
+	}
+
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return err
+		}
+	}
+
+	// The merged datafiles are kept open until the merge is committed
+	// and moved into place, so they can still be read should it fail.
+	if err = commitMerge(b.path, ids); err != nil {
+		return err
+	}
+
+	return b.swapMerged(ids)
+}
+
+// swapMerged opens the merged datafiles with the given ids and points the
+// keys whose entries were merged to their new location; the caller must
+// hold the write lock.
+func (b *Bitcask) swapMerged(ids []int) error {
+	merged := make(map[int]bool, len(ids))
+	moved := make(map[string]bool)
+	versions := make(map[string][]internal.Item)
+
+	for _, id := range ids {
+		merged[id] = true
+
+		df, err := internal.NewDatafile(b.path, id, true)
+		if err != nil {
+			return err
+		}
+		if old, ok := b.datafiles[id]; ok {
+			old.Close()
+		}
+		b.addDatafile(df)
+
+		hint, err := internal.LoadHint(hintPath(b.path, id))
+		if err != nil {
+			return err
+		}
+
+		if b.config.maxVersions > 1 {
+			for _, key := range hint.Deleted {
+				delete(versions, key)
+			}
+			for key, item := range hint.Items {
+				versions[key] = append(append(versions[key], hint.Versions[key]...), item)
+			}
+		}
+
+		// Keys written again during the merge keep their newer entry
+		for key, item := range hint.Items {
+			curr, ok := b.keydir.Get(key)
+			if ok && curr.FileID == id && curr.Sequence == item.Sequence && curr.Checksum == item.Checksum {
+				b.keydir.Add(key, item)
+				moved[key] = true
+			}
+		}
+	}
+
+	// The keys that were left behind expired and were dropped by the merge
+	for key, item := range b.keydir.Snapshot() {
+		if merged[item.FileID] && !moved[key] {
+			b.keydir.Delete(key)
+			b.trie.Remove(key)
+			b.recent.Remove(key)
+		}
+	}
+
+	for key, kept := range versions {
+		if moved[key] {
+			b.keydir.SetVersions(key, kept[:len(kept)-1])
+			continue
+		}
+		if _, ok := b.keydir.Get(key); !ok {
+			continue
+		}
+
+		// A key written again during the merge keeps the versions written
+		// since, following those that were merged unless it was deleted in
+		// between.
+		var continued bool
+		for _, item := range b.keydir.Versions(key) {
+			if merged[item.FileID] {
+				continued = true
+			} else {
+				kept = append(kept, item)
+			}
+		}
+		if continued {
+			b.keydir.SetVersions(key, kept)
+		}
+	}
+
+	return nil
+}
+
+// merger merges the database in the background, periodically (see
+// WithAutoMerge) and after deletes (see WithDeleteReclaim)
+type merger struct {
+	quit    chan struct{}
+	done    chan struct{}
+	deleted chan struct{}
+}
+
+func (b *Bitcask) startAutoMerge() {
+	m := &merger{
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		deleted: make(chan struct{}, 1),
+	}
+	b.merger = m
+
+	go func() {
+		defer close(m.done)
+
+		var tick <-chan time.Time
+		if b.config.autoMergeRatio > 0 {
+			ticker := time.NewTicker(b.config.autoMergeInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-tick:
+				// A failed merge is retried at the next check
+				b.maybeMerge(b.config.autoMergeRatio)
+			case <-m.deleted:
+				b.maybeMerge(b.config.deleteReclaimRatio)
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+}
+
+// maybeMerge merges the database if the ratio of reclaimable bytes to the
+// total size of the datafiles exceeds `ratio`
+func (b *Bitcask) maybeMerge(ratio float64) {
+	stats, err := b.Stats()
+	if err != nil || stats.Size == 0 {
+		return
+	}
+	if float64(stats.Reclaimable)/float64(stats.Size) > ratio {
+		b.Merge()
+	}
+}
+
+// deleted has the merger check whether to merge the database after keys
+// were deleted (see WithDeleteReclaim) without waiting for it.
+func (b *Bitcask) deleted() {
+	if b.config.deleteReclaimRatio == 0 || b.merger == nil {
+		return
+	}
+	select {
+	case b.merger.deleted <- struct{}{}:
+	default:
+		// The merger is yet to check after earlier deletes
+	}
+}
+
+// stopAutoMerge stops the auto merges once the merge in progress, if any,
+// has finished.
+func (b *Bitcask) stopAutoMerge() {
+	if b.merger == nil {
+		return
+	}
+	close(b.merger.quit)
+	<-b.merger.done
+	b.merger = nil
+}
@@ -1,19 +1,26 @@
 package bitcask
 
 import (
-	"errors"
+	"context"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gofrs/flock"
-	"github.com/prologic/trie"
-
+	"github.com/pkg/errors"
 	"github.com/prologic/bitcask/internal"
+	pb "github.com/prologic/bitcask/internal/proto"
+	"github.com/prologic/bitcask/internal/streampb"
 )
 
 var (
@@ -35,12 +42,63 @@ var (
 	// ErrDatabaseLocked is the error returned if the database is locked
 	// (typically opened by another process)
 	ErrDatabaseLocked = errors.New("error: database locked")
+
+	// ErrReadOnly is the error returned when writing to a database opened
+	// with WithReadOnly
+	ErrReadOnly = errors.New("error: database is read only")
+
+	// ErrReservedFlags is the error returned by PutWithFlags for flags that
+	// use any of the bits reserved by the library (see ReservedFlags)
+	ErrReservedFlags = errors.New("error: flags use reserved bits")
+
+	// ErrHintMismatch is the error returned by Open when opened with
+	// WithStrictHints and a hint file does not match its datafile, and by
+	// Verify for a hint file that only seemingly matches its datafile
+	ErrHintMismatch = errors.New("error: hint file does not match datafile")
+
+	// ErrInvalidTTL is the error returned by PutWithTTL for a TTL that is
+	// not positive
+	ErrInvalidTTL = errors.New("error: invalid ttl")
+
+	// ErrBufferTooSmall is the error returned by GetInto for a buffer that
+	// is too small for the value
+	ErrBufferTooSmall = errors.New("error: buffer too small")
+
+	// ErrInvalidKey is the error returned for a key that is not valid UTF-8
+	// which the datafiles can't store
+	ErrInvalidKey = errors.New("error: key is not valid utf-8")
+
+	// ErrEntryTooLarge is the error returned when the entry of a key and
+	// value would be larger than the maximum datafile size even though the
+	// key and value are within their maximum sizes; the error returned is
+	// wrapped with the sizes (see errors.Cause)
+	ErrEntryTooLarge = errors.New("error: entry too large")
+)
+
+const (
+	// FlagTombstone is the flag the library sets on the entries written by
+	// Delete.
+	FlagTombstone uint8 = 1 << 7
+
+	// FlagCompressed is the flag reserved by the library for entries whose
+	// values are compressed.
+	FlagCompressed uint8 = 1 << 6
+
+	// ReservedFlags are the flag bits reserved for use by the library; the
+	// remaining bits are available to PutWithFlags.
+	ReservedFlags = FlagTombstone | FlagCompressed
 )
 
 // Bitcask is a struct that represents a on-disk LSM and WAL data structure
 // and in-memory hash of key/value pairs as per the Bitcask paper and seen
 // in the Riak database.
 type Bitcask struct {
+	// collisions is the number of reads of the entries of other keys (see
+	// read) not yet reported to the metrics, which must not be called while
+	// holding the lock (see observeCollisions); it is first so that it is
+	// aligned for atomic operations.
+	collisions uint64
+
 	mu sync.RWMutex
 
 	*flock.Flock
@@ -49,382 +107,1950 @@ type Bitcask struct {
 	path      string
 	curr      *internal.Datafile
 	keydir    *internal.Keydir
-	datafiles []*internal.Datafile
-	trie      *trie.Trie
+	datafiles map[int]*internal.Datafile
+	trie      *internal.Trie
+	keystats  *internal.KeyStats
+	recent    *internal.RecentKeys
+	groups    map[string]*group
+	pending   map[string]string
+
+	tombstones  []tombstone
+	subscribers subscribers
+	committer   *committer
+	counters    *counters
+	merger      *merger
+
+	// merging serialises merges of the open database and the other uses
+	// of the merge directory (SplitDatafile, CompactDatafile and
+	// ReplaceWith); it is taken before the lock.
+	merging sync.Mutex
+
+	// tail is the offset up to which the active datafile has been indexed
+	// and refreshed is the time the index was last brought up to date; both
+	// are only used by read-only databases (see Refresh).
+	tail      int64
+	refreshed time.Time
+
+	// readLock is the shared lock held by a read-only database (see
+	// WithReadOnly)
+	readLock *flock.Flock
+
+	// recovered is the corrupt tail of the active datafile truncated by
+	// Open, if any
+	recovered *RecoveryError
+
+	// handles are the open handles of the immutable datafiles (see
+	// WithMaxOpenFiles)
+	handles *handleCache
 }
 
 // Close closes the database and removes the lock. It is important to call
 // Close() as this is the only wat to cleanup the lock held by the open
 // database.
-func (b *Bitcask) Close() error {
+func (b *Bitcask) Close() (err error) {
+	b.stopCommitter()
 	defer func() {
-		b.Flock.Unlock()
-		os.Remove(b.Flock.Path())
+		b.closeCommitter(err)
 	}()
+	b.stopAutoMerge()
 
-	for _, df := range b.datafiles {
-		df.Close()
+	defer func() {
+		if b.Flock != nil {
+			unregisterOpen(b.path)
+			b.Flock.Unlock()
+			os.Remove(b.Flock.Path())
+		}
+		if b.readLock != nil {
+			// Other read-only databases may hold the lock too
+			b.readLock.Unlock()
+		}
+	}()
+
+	if b.handles != nil {
+		defer b.handles.close()
 	}
-	return b.curr.Close()
-}
 
-// Sync flushes all buffers to disk ensuring all data is written
-func (b *Bitcask) Sync() error {
-	return b.curr.Sync()
-}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-// Get retrieves the value of the given key. If the key is not found or an/I/O
-// error occurs a null byte slice is returend along with the error.
-func (b *Bitcask) Get(key string) ([]byte, error) {
-	var df *internal.Datafile
+	b.unsubscribeAll()
 
-	item, ok := b.keydir.Get(key)
-	if !ok {
-		return nil, ErrKeyNotFound
+	if err := b.flushGroups(); err != nil {
+		return err
 	}
 
-	if item.FileID == b.curr.FileID() {
-		df = b.curr
-	} else {
-		df = b.datafiles[item.FileID]
+	if b.counters != nil {
+		if err := b.counters.close(); err != nil {
+			return err
+		}
 	}
 
-	e, err := df.ReadAt(item.Offset, item.Size)
-	if err != nil {
-		return nil, err
+	if b.config.tombstoneHistory > 0 && !b.config.readOnly {
+		if err := saveTombstones(b.path, b.tombstones); err != nil {
+			return err
+		}
 	}
 
-	checksum := crc32.ChecksumIEEE(e.Value)
-	if checksum != e.Checksum {
-		return nil, ErrChecksumFailed
+	if b.config.persistentIndex && !b.config.readOnly {
+		if err := b.saveIndex(); err != nil {
+			return err
+		}
 	}
 
-	return e.Value, nil
-}
-
-// Has returns true if the key exists in the database, false otherwise.
-func (b *Bitcask) Has(key string) bool {
-	_, ok := b.keydir.Get(key)
-	return ok
+	return b.closeDatafiles()
 }
 
-// Put stores the key and value in the database.
-func (b *Bitcask) Put(key string, value []byte) error {
-	if len(key) > b.config.maxKeySize {
-		return ErrKeyTooLarge
-	}
-	if len(value) > b.config.maxValueSize {
-		return ErrValueTooLarge
+// Sync flushes all buffers to disk ensuring all data is written (including
+// a checkpoint of the counter region, see WithCounterRegion, and the index,
+// see WithPersistentIndex)
+func (b *Bitcask) Sync() error {
+	if b.config.readOnly {
+		return ErrReadOnly
 	}
 
-	offset, n, err := b.put(key, value)
-	if err != nil {
+	if err := b.sync(); err != nil {
 		return err
 	}
+	b.observeDiskBytes()
+	return nil
+}
 
-	item := b.keydir.Add(key, b.curr.FileID(), offset, n)
-	b.trie.Add(key, item)
+func (b *Bitcask) sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
+	if err := b.flushGroups(); err != nil {
+		return err
+	}
+	if err := b.counters.checkpoint(); err != nil {
+		return err
+	}
+	if err := b.curr.Sync(); err != nil {
+		return err
+	}
+	if b.config.persistentIndexOnSync {
+		return b.saveIndex()
+	}
 	return nil
 }
 
-// Delete deletes the named key. If the key doesn't exist or an I/O error
-// occurs the error is returned.
-func (b *Bitcask) Delete(key string) error {
-	_, _, err := b.put(key, []byte{})
+// Get retrieves the value of the given key. If the key is not found or an/I/O
+// error occurs a null byte slice is returend along with the error. The value
+// is always a copy owned by the caller which may be modified freely (see
+// GetInto and GetView to avoid the allocation).
+func (b *Bitcask) Get(key string) (value []byte, err error) {
+	defer func() { b.observeGet(err) }()
+
+	if err := b.maybeRefresh(); err != nil {
+		return nil, err
+	}
+
+	if n, ok := b.counters.get(key); ok {
+		return []byte(strconv.FormatInt(n, 10)), nil
+	}
+
+	e, item, err := b.get(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	b.keydir.Delete(key)
-	b.trie.Remove(key)
+	if b.config.compactOnRead > 0 && int(item.Overwrites) >= b.config.compactOnRead {
+		// Compacting is best-effort; the value has been read regardless.
+		b.compact(key, item, e)
+	}
 
-	return nil
+	return b.config.value(e)
 }
 
-// Scan performa a prefix scan of keys matching the given prefix and calling
-// the function `f` with the keys found. If the function returns an error
-// no further keys are processed and the first error returned.
-func (b *Bitcask) Scan(prefix string, f func(key string) error) error {
-	keys := b.trie.PrefixSearch(prefix)
-	for _, key := range keys {
-		if err := f(key); err != nil {
-			return err
-		}
+// GetView retrieves the value of the given key like Get but, where possible,
+// without copying it: the value is a slice of the memory mapped datafile it
+// is stored in. GetView is meant for read-mostly workloads over large values
+// and its result comes with strict rules:
+//
+//   - the returned release function must be called exactly once when the
+//     value is no longer needed and the value must not be used afterwards;
+//   - the value must never be modified (it is mapped read-only and writing
+//     to it crashes the program).
+//
+// A datafile removed by a merge (or ReplaceWith) stays mapped until all of
+// its views are released so outstanding views remain valid, though they
+// keep the old datafile's memory (and on some platforms disk space) in use
+// until then. Values of the active datafile (and on platforms without mmap
+// all values) are copied as by Get.
+func (b *Bitcask) GetView(key string) (value []byte, release func(), err error) {
+	defer func() { b.observeGet(err) }()
+
+	if err := b.maybeRefresh(); err != nil {
+		return nil, nil, err
 	}
-	return nil
-}
 
-// Len returns the total number of keys in the database
-func (b *Bitcask) Len() int {
-	return b.keydir.Len()
-}
+	if n, ok := b.counters.get(key); ok {
+		return []byte(strconv.FormatInt(n, 10)), func() {}, nil
+	}
 
-// Keys returns all keys in the database as a channel of string(s)
-func (b *Bitcask) Keys() chan string {
-	return b.keydir.Keys()
-}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-// Fold iterates over all keys in the database calling the function `f` for
-// each key. If the function returns an error, no further keys are processed
-// and the error returned.
-func (b *Bitcask) Fold(f func(key string) error) error {
-	for key := range b.keydir.Keys() {
-		if err := f(key); err != nil {
-			return err
-		}
+	if _, ok := b.pending[key]; ok {
+		return b.copyView(key)
 	}
-	return nil
-}
 
-func (b *Bitcask) put(key string, value []byte) (int64, int64, error) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+	item, ok := b.keydir.Get(key)
+	if !ok || item.Expired(time.Now()) {
+		return nil, nil, ErrKeyNotFound
+	}
 
-	size := b.curr.Size()
-	if size >= int64(b.config.maxDatafileSize) {
-		err := b.curr.Close()
-		if err != nil {
-			return -1, 0, err
-		}
+	df, ok := b.datafile(item.FileID)
+	if !ok || df == b.curr && !b.config.readOnly || item.Flags&FlagCompressed != 0 {
+		return b.copyView(key)
+	}
 
-		df, err := internal.NewDatafile(b.path, b.curr.FileID(), true)
+	if b.config.eagerCloseDatafiles && df != b.curr {
+		// The view keeps the mapping until it is released
+		var err error
+		df, err = internal.NewDatafile(b.path, df.FileID(), true)
 		if err != nil {
-			return -1, 0, err
+			return nil, nil, err
 		}
+		defer df.Close()
+	}
+
+	k, value, checksum, release, err := df.View(item.Offset, item.Size)
+	if err == internal.ErrNoView {
+		return b.copyView(key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if k != key {
+		// The entry of another key, see read
+		release()
+		return b.copyView(key)
+	}
 
-		b.datafiles = append(b.datafiles, df)
+	if !b.config.noChecksum && crc32.ChecksumIEEE(value) != checksum {
+		release()
+		return nil, nil, ErrChecksumFailed
+	}
 
-		id := b.curr.FileID() + 1
-		curr, err := internal.NewDatafile(b.path, id, false)
-		if err != nil {
-			return -1, 0, err
-		}
-		b.curr = curr
+	if b.keystats != nil {
+		b.keystats.Touch(key)
 	}
 
-	e := internal.NewEntry(key, value)
-	return b.curr.Write(e)
+	return value, release, nil
 }
 
-// Merge merges all datafiles in the database creating hint files for faster
-// startup. Old keys are squashed and deleted keys removes. Call this function
-// periodically to reclaim disk space.
-func Merge(path string, force bool) error {
-	fns, err := internal.GetDatafiles(path)
+// GetInto retrieves the value of the given key like Get but copies it into
+// `dst` and returns its size rather than allocating it. If `dst` is too
+// small for the value ErrBufferTooSmall is returned along with the size of
+// the value so that a large enough buffer can be allocated.
+func (b *Bitcask) GetInto(key string, dst []byte) (int, error) {
+	value, release, err := b.GetView(key)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer release()
 
-	ids, err := internal.ParseIds(fns)
-	if err != nil {
-		return err
+	if len(value) > len(dst) {
+		return len(value), ErrBufferTooSmall
 	}
+	return copy(dst, value), nil
+}
 
-	// Do not merge if we only have 1 Datafile
-	if len(ids) <= 1 {
-		return nil
+// copyView is GetView for values that can't be viewed in place; the caller
+// must hold the read lock.
+func (b *Bitcask) copyView(key string) ([]byte, func(), error) {
+	e, _, err := b.read(key)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	// Don't merge the Active Datafile (the last one)
-	fns = fns[:len(fns)-1]
-	ids = ids[:len(ids)-1]
-
-	temp, err := ioutil.TempDir("", "bitcask")
+	value, err := b.config.value(e)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return value, func() {}, nil
+}
 
-	for i, fn := range fns {
-		// Don't merge Datafiles whose .hint files we've already generated
-		// (they are already merged); unless we set the force flag to true
-		// (forcing a re-merge).
-		if filepath.Ext(fn) == ".hint" && !force {
-			// Already merged
-			continue
-		}
+// get reads the entry of the given key along with its keydir item (which is
+// empty for pending grouped writes).
+func (b *Bitcask) get(key string) (pb.Entry, internal.Item, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-		id := ids[i]
+	return b.read(key)
+}
 
-		keydir := internal.NewKeydir()
+// read is get for callers already holding the read or write lock
+func (b *Bitcask) read(key string) (pb.Entry, internal.Item, error) {
+	if value, ok := b.getPending(key); ok {
+		// The pending value must not be modified by the caller
+		value = append([]byte(nil), value...)
+		return pb.Entry{Key: key, Value: value}, internal.Item{}, nil
+	}
 
-		df, err := internal.NewDatafile(path, id, true)
-		if err != nil {
-			return err
-		}
-		defer df.Close()
+	item, ok := b.keydir.Get(key)
+	if !ok || item.Expired(time.Now()) {
+		return pb.Entry{}, item, ErrKeyNotFound
+	}
 
-		for {
-			e, n, err := df.Read()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
+	if b.keystats != nil {
+		b.keystats.Touch(key)
+	}
 
-			// Tombstone value  (deleted key)
-			if len(e.Value) == 0 {
-				keydir.Delete(e.Key)
-				continue
-			}
+	df, ok := b.datafile(item.FileID)
+	if !ok {
+		return pb.Entry{}, item, ErrKeyNotFound
+	}
 
-			keydir.Add(e.Key, ids[i], e.Offset, n)
-		}
+	e, err := b.readAt(df, item.Offset, item.Size)
+	if err != nil {
+		return pb.Entry{}, item, err
+	}
 
-		tempdf, err := internal.NewDatafile(temp, id, false)
-		if err != nil {
-			return err
+	// Never return the value of another key: should the entry belong to
+	// another key (a collision, which the index should never allow) the
+	// key's older versions are read instead, if any
+	if e.Key != key {
+		b.collided()
+		if e, item, err = b.readOlder(key); err != nil {
+			return pb.Entry{}, item, err
 		}
-		defer tempdf.Close()
+	}
 
-		for key := range keydir.Keys() {
-			item, _ := keydir.Get(key)
-			e, err := df.ReadAt(item.Offset, item.Size)
-			if err != nil {
-				return err
-			}
+	if !b.config.noChecksum && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+		return pb.Entry{}, item, ErrChecksumFailed
+	}
 
-			_, _, err = tempdf.Write(e)
-			if err != nil {
-				return err
-			}
-		}
+	return e, item, nil
+}
 
-		err = tempdf.Close()
-		if err != nil {
-			return err
+// readOlder reads the entry of the newest older version of the key (see
+// WithMaxVersions) that is the key's own, or fails with ErrKeyNotFound;
+// the caller must hold the read or write lock.
+func (b *Bitcask) readOlder(key string) (pb.Entry, internal.Item, error) {
+	versions := b.keydir.Versions(key)
+	now := time.Now()
+	for i := len(versions) - 1; i >= 0; i-- {
+		item := versions[i]
+		if item.Expired(now) {
+			continue
 		}
-
-		err = df.Close()
-		if err != nil {
-			return err
+		df, ok := b.datafile(item.FileID)
+		if !ok {
+			continue
 		}
 
-		err = os.Rename(tempdf.Name(), df.Name())
+		e, err := b.readAt(df, item.Offset, item.Size)
 		if err != nil {
-			return err
+			return pb.Entry{}, item, err
 		}
-
-		hint := strings.TrimSuffix(df.Name(), ".data") + ".hint"
-		err = keydir.Save(hint)
-		if err != nil {
-			return err
+		if e.Key == key {
+			return e, item, nil
 		}
+		b.collided()
 	}
+	return pb.Entry{}, internal.Item{}, ErrKeyNotFound
+}
 
-	return nil
+// collided counts a read of the entry of another key (see read), which is
+// reported to the metrics by observeCollisions.
+func (b *Bitcask) collided() {
+	atomic.AddUint64(&b.collisions, 1)
 }
 
-// Open opens the database at the given path with optional options.
-// Options can be provided with the `WithXXX` functions that provide
-// configuration options as functions.
-func Open(path string, options ...Option) (*Bitcask, error) {
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return nil, err
-	}
+// compact rewrites the entry `e` of the key read from `item` to the active
+// datafile (see WithCompactOnRead) unless the key has since been changed.
+func (b *Bitcask) compact(key string, item internal.Item, e pb.Entry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	err := Merge(path, false)
-	if err != nil {
-		return nil, err
+	if curr, ok := b.keydir.Get(key); !ok || curr != item {
+		return nil
 	}
 
-	fns, err := internal.GetDatafiles(path)
-	if err != nil {
-		return nil, err
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return err
+		}
 	}
 
-	ids, err := internal.ParseIds(fns)
+	item, err := b.write(e)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var datafiles []*internal.Datafile
+	b.keydir.Add(key, item)
 
-	keydir := internal.NewKeydir()
-	trie := trie.New()
+	return nil
+}
 
-	for i, fn := range fns {
-		df, err := internal.NewDatafile(path, ids[i], true)
-		if err != nil {
-			return nil, err
-		}
-		datafiles = append(datafiles, df)
+// GetFlags returns the flags stored with the given key by PutWithFlags; keys
+// stored with Put have no flags set. If the key is not found ErrKeyNotFound
+// is returned.
+func (b *Bitcask) GetFlags(key string) (uint8, error) {
+	if err := b.maybeRefresh(); err != nil {
+		return 0, err
+	}
 
-		if filepath.Ext(fn) == ".hint" {
-			f, err := os.Open(filepath.Join(path, fn))
-			if err != nil {
-				return nil, err
-			}
-			defer f.Close()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-			hint, err := internal.NewKeydirFromBytes(f)
-			if err != nil {
-				return nil, err
-			}
+	if _, ok := b.pending[key]; ok {
+		return 0, nil
+	}
 
-			for key := range hint.Keys() {
-				item, _ := hint.Get(key)
-				_ = keydir.Add(key, item.FileID, item.Offset, item.Size)
-				trie.Add(key, item)
-			}
-		} else {
-			for {
-				e, n, err := df.Read()
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					return nil, err
-				}
+	item, ok := b.keydir.Get(key)
+	if !ok || item.Expired(time.Now()) {
+		return 0, ErrKeyNotFound
+	}
 
-				// Tombstone value  (deleted key)
-				if len(e.Value) == 0 {
-					keydir.Delete(e.Key)
-					continue
-				}
+	return item.Flags &^ ReservedFlags, nil
+}
 
-				item := keydir.Add(e.Key, ids[i], e.Offset, n)
-				trie.Add(e.Key, item)
-			}
-		}
-	}
+// Has returns true if the key exists in the database, false otherwise.
+func (b *Bitcask) Has(key string) bool {
+	b.maybeRefresh()
 
-	var id int
-	if len(ids) > 0 {
-		id = ids[(len(ids) - 1)]
+	if b.counters.has(key) {
+		return true
 	}
 
-	curr, err := internal.NewDatafile(path, id, false)
-	if err != nil {
-		return nil, err
-	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	bitcask := &Bitcask{
-		Flock:     flock.New(filepath.Join(path, "lock")),
-		config:    newDefaultConfig(),
-		path:      path,
-		curr:      curr,
-		keydir:    keydir,
-		datafiles: datafiles,
-		trie:      trie,
+	if _, ok := b.pending[key]; ok {
+		return true
 	}
 
-	for _, opt := range options {
-		err = opt(bitcask.config)
-		if err != nil {
-			return nil, err
-		}
+	item, ok := b.keydir.Get(key)
+	return ok && !item.Expired(time.Now())
+}
+
+// Put stores the key and value in the database.
+func (b *Bitcask) Put(key string, value []byte) error {
+	return b.PutWithFlags(key, value, 0)
+}
+
+// PutWithFlags stores the key and value in the database along with the
+// given flags which can be used to store a small amount of state about the
+// key (such as whether it is "dirty" or "pinned") and are returned by
+// GetFlags. The flags are kept through merges and reopening the database.
+// Flags using any of the ReservedFlags bits are rejected with
+// ErrReservedFlags.
+func (b *Bitcask) PutWithFlags(key string, value []byte, flags uint8) error {
+	if flags&ReservedFlags != 0 {
+		return ErrReservedFlags
+	}
+	if err := b.checkPut(key, value); err != nil {
+		return err
 	}
 
-	locked, err := bitcask.Flock.TryLock()
-	if err != nil {
-		return nil, err
+	if err := b.putWithFlags(key, value, flags, 0); err != nil {
+		return err
 	}
+	if err := b.commit(); err != nil {
+		return err
+	}
+	b.config.metrics.IncPut()
+	return nil
+}
 
-	if !locked {
-		return nil, ErrDatabaseLocked
+// PutWithTTL stores the key and value in the database expiring the key
+// after `ttl` (overriding the expiry set with WithExpiry, if any), as with
+// Redis' EXPIRE. Expired keys are treated as if they were deleted: Get and
+// Has return ErrKeyNotFound and false for them and Keys, Fold and Scan skip
+// them. They are only removed from disk (and counted by Len) until the next
+// merge. Expiry times are stored in seconds with the entry, so they are
+// kept through merges and reopening the database, and keys expire within a
+// second of their expiry.
+func (b *Bitcask) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	if err := b.checkPut(key, value); err != nil {
+		return err
 	}
 
+	if err := b.putWithFlags(key, value, 0, ttl); err != nil {
+		return err
+	}
+	if err := b.commit(); err != nil {
+		return err
+	}
+	b.config.metrics.IncPut()
+	return nil
+}
+
+// checkPut checks that the key and value may be put
+func (b *Bitcask) checkPut(key string, value []byte) error {
+	if len(key) > b.config.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if !utf8.ValidString(key) {
+		return ErrInvalidKey
+	}
+	if len(value) > b.config.maxValueSize {
+		return ErrValueTooLarge
+	}
+	if b.counters.has(key) {
+		return ErrCounterKey
+	}
+	return nil
+}
+
+func (b *Bitcask) putWithFlags(key string, value []byte, flags uint8, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.update(key, value, flags, ttl)
+}
+
+// update puts the key and value and updates the index; the caller must hold
+// the write lock.
+func (b *Bitcask) update(key string, value []byte, flags uint8, ttl time.Duration) error {
+	if err := b.flushPending(key); err != nil {
+		return err
+	}
+
+	item, err := b.put(key, value, flags, ttl)
+	if err != nil {
+		return err
+	}
+
+	b.keydir.Overwrite(key, item)
+	b.trie.Add(key)
+	b.recent.Add(key)
+
+	if b.keystats != nil {
+		b.keystats.Touch(key)
+	}
+
+	b.notify(EventPut, key, value)
+
+	return nil
+}
+
+// Delete deletes the named key. If the key doesn't exist or an I/O error
+// occurs the error is returned.
+func (b *Bitcask) Delete(key string) error {
+	if b.counters.has(key) {
+		return ErrCounterKey
+	}
+	if err := b.remove(key); err != nil {
+		return err
+	}
+	if err := b.commit(); err != nil {
+		return err
+	}
+	b.deleted()
+	return nil
+}
+
+func (b *Bitcask) remove(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.flushPending(key); err != nil {
+		return err
+	}
+
+	tombstone, err := b.put(key, []byte{}, FlagTombstone, 0)
+	if err != nil {
+		return err
+	}
+
+	if b.config.tombstoneHistory > 0 {
+		if item, ok := b.keydir.Get(key); ok {
+			b.addTombstone(key, item)
+		}
+	}
+
+	b.keydir.Remove(key, tombstone.Sequence)
+	b.trie.Remove(key)
+	b.recent.Remove(key)
+
+	b.notify(EventDelete, key, nil)
+
+	return nil
+}
+
+// Scan performa a prefix scan of keys matching the given prefix and calling
+// the function `f` with the keys found in lexicographic order. If the
+// function returns an error no further keys are processed and the first
+// error returned.
+func (b *Bitcask) Scan(prefix string, f func(key string) error) error {
+	return b.ScanContext(context.Background(), prefix, f)
+}
+
+// ScanContext is like Scan but stops, returning ctx.Err(), as soon as the
+// context `ctx` is done; `f` isn't called again once it is.
+func (b *Bitcask) ScanContext(ctx context.Context, prefix string, f func(key string) error) error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	keys := b.unexpired(b.trie.PrefixSearch(prefix))
+	b.mu.RUnlock()
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range calls the function `f` with the keys between `lower` and `upper`
+// (inclusive) in lexicographic order, e.g: Range("2020-01", "2020-06", f)
+// for the keys of the first half of 2020 (not including "2020-06-01" which
+// sorts after "2020-06"). An empty `lower` starts at the first key and an
+// empty `upper` ends at the last key; no keys are visited if `lower` sorts
+// after `upper`. If the function returns an error no further keys are
+// processed and the error returned.
+func (b *Bitcask) Range(lower, upper string, f func(key string) error) error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+	if upper != "" && lower > upper {
+		return nil
+	}
+
+	b.mu.RLock()
+	keys := b.unexpired(b.trie.RangeSearch(lower, upper))
+	b.mu.RUnlock()
+
+	for _, key := range keys {
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanParallel is like Scan but calls the function `f` with the keys
+// matching the given prefix from `workers` goroutines, for scans of many
+// keys where processing each key is expensive. Keys are processed in no
+// particular order and `f` must be safe to call concurrently. Each key is
+// processed exactly once unless a call returns an error, in which case the
+// scan is cancelled (keys already handed out to workers may still be
+// processed), the calls in progress are waited for and the first error
+// returned.
+func (b *Bitcask) ScanParallel(prefix string, workers int, f func(key string) error) error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	b.mu.RLock()
+	keys := b.unexpired(b.trie.PrefixSearch(prefix))
+	b.mu.RUnlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	work := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				if err := f(key); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, key := range keys {
+		select {
+		case work <- key:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	return firstErr
+}
+
+// Match calls the function `f` with the keys matching the glob pattern in
+// lexicographic order. As with Redis' KEYS `*` matches any sequence of
+// characters, `?` any single character, `[abc]` or `[a-z]` any character in
+// the set or range (`[^abc]` any character not in it) and `\` escapes the
+// following character. Only the keys starting with the literal prefix of the
+// pattern (the part before the first wildcard) are considered, so a pattern
+// without a literal prefix (e.g: "*foo") tests every key in the database.
+// If the function returns an error no further keys are processed and the
+// error returned.
+func (b *Bitcask) Match(pattern string, f func(key string) error) error {
+	return b.Scan(internal.GlobPrefix(pattern), func(key string) error {
+		if !internal.Glob(pattern, key) {
+			return nil
+		}
+		return f(key)
+	})
+}
+
+// RegexMatch is like Match but for keys matching the regular expression
+// `expr` (see the regexp package) anywhere in the key; use `^` and `$` to
+// match whole keys. Only expressions anchored at the start with `^` and
+// followed by a literal prefix (e.g: "^user:[0-9]+$") avoid testing every
+// key in the database.
+func (b *Bitcask) RegexMatch(expr string, f func(key string) error) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+
+	var prefix string
+	if anchored(expr) {
+		prefix, _ = re.LiteralPrefix()
+	}
+
+	return b.Scan(prefix, func(key string) error {
+		if !re.MatchString(key) {
+			return nil
+		}
+		return f(key)
+	})
+}
+
+// anchored returns true if the (valid) regular expression only matches at
+// the start of the text.
+func anchored(expr string) bool {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	re = re.Simplify()
+	if re.Op == syntax.OpConcat && len(re.Sub) > 0 {
+		re = re.Sub[0]
+	}
+	return re.Op == syntax.OpBeginText
+}
+
+// HotKeys returns up to n of the most frequently accessed (read or written)
+// keys, most accessed first. Access counts are only tracked when the
+// database is opened with WithKeyStats, otherwise no keys are returned.
+// Counts are approximate and may include keys that have since been deleted.
+func (b *Bitcask) HotKeys(n int) []string {
+	if b.keystats == nil {
+		return nil
+	}
+	return b.keystats.Top(n)
+}
+
+// RecentKeys returns up to n of the most recently written keys, most
+// recently written first; overwriting a key makes it the most recent key and
+// deleting it removes it. Only writes are taken into account, reading a key
+// doesn't affect its position. At most 1024 keys are tracked. The order of
+// keys restored from merged datafiles on Open is only approximate as merges
+// don't preserve the order keys were written in.
+func (b *Bitcask) RecentKeys(n int) []string {
+	b.maybeRefresh()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.recent.Top(n)
+}
+
+// Len returns the total number of keys in the database, not counting the
+// keys that have expired (as Keys doesn't yield them)
+func (b *Bitcask) Len() int {
+	b.maybeRefresh()
+	return b.keydir.LiveLen(time.Now())
+}
+
+// Keys returns all keys in the database as a channel of string(s)
+func (b *Bitcask) Keys() chan string {
+	b.maybeRefresh()
+	return b.keydir.LiveKeys(time.Now())
+}
+
+// Fold iterates over all keys in the database calling the function `f` for
+// each key. If the function returns an error, no further keys are processed
+// and the error returned.
+func (b *Bitcask) Fold(f func(key string) error) error {
+	return b.FoldContext(context.Background(), f)
+}
+
+// FoldContext is like Fold but stops, returning ctx.Err(), as soon as the
+// context `ctx` is done; `f` isn't called again once it is. The keys are
+// collected up front so that stopping early doesn't leave the index locked.
+func (b *Bitcask) FoldContext(ctx context.Context, f func(key string) error) error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var keys []string
+	for key, item := range b.keydir.Snapshot() {
+		if !item.Expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unexpired returns the keys that haven't expired (see PutWithTTL) out of
+// `keys` reusing its storage; the caller must hold the read lock.
+func (b *Bitcask) unexpired(keys []string) []string {
+	now := time.Now()
+	live := keys[:0]
+	for _, key := range keys {
+		if item, ok := b.keydir.Get(key); ok && item.Expired(now) {
+			continue
+		}
+		live = append(live, key)
+	}
+	return live
+}
+
+// KeyInfo is the location of the latest value of a key as reported by
+// FoldWithLocation
+type KeyInfo struct {
+	// FileID is the id of the datafile the value is stored in (see
+	// DatafileStats)
+	FileID int
+
+	// Offset is the offset of the value's entry in the datafile
+	Offset int64
+
+	// Size is the encoded size of the value's entry in the datafile
+	Size int64
+}
+
+// FoldWithLocation iterates over all keys in the database calling the
+// function `f` with each key and the location of its value, as recorded in
+// the index, without reading any values. This is meant for tooling that
+// plans merges or rebalancing, e.g: to compute the live data of each
+// datafile. Only the latest location of each key (as of the call) is
+// reported, not those of overwritten values that are still on disk, and
+// grouped writes (see PutGrouped) that are still pending are not included.
+// If the function returns an error, no further keys are processed and the
+// error returned.
+func (b *Bitcask) FoldWithLocation(f func(key string, info KeyInfo) error) error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+
+	for key, item := range b.keydir.Snapshot() {
+		info := KeyInfo{
+			FileID: item.FileID,
+			Offset: item.Offset,
+			Size:   item.Size,
+		}
+		if err := f(key, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// datafile returns the datafile with the given id; the caller must hold the
+// read lock.
+func (b *Bitcask) datafile(id int) (*internal.Datafile, bool) {
+	if id == b.curr.FileID() {
+		return b.curr, true
+	}
+	df, ok := b.datafiles[id]
+	return df, ok
+}
+
+// readAt reads the entry at the given offset of the datafile; the caller
+// must hold the read lock. With WithEagerCloseDatafiles the datafiles other
+// than the active datafile are closed and so reopened for every read, or
+// with WithMaxOpenFiles read through the cache of open handles.
+func (b *Bitcask) readAt(df *internal.Datafile, offset, size int64) (pb.Entry, error) {
+	if !b.config.eagerCloseDatafiles || df == b.curr {
+		return df.ReadAt(offset, size)
+	}
+
+	if b.handles != nil {
+		df, release, err := b.handles.get(df, func() (*internal.Datafile, error) {
+			return internal.NewDatafile(b.path, df.FileID(), true)
+		})
+		if err != nil {
+			return pb.Entry{}, err
+		}
+		defer release()
+
+		return df.ReadAt(offset, size)
+	}
+
+	df, err := internal.NewDatafile(b.path, df.FileID(), true)
+	if err != nil {
+		return pb.Entry{}, err
+	}
+	defer df.Close()
+
+	return df.ReadAt(offset, size)
+}
+
+// addDatafile adds the (immutable) datafile to the datafiles of the
+// database, closing it right away with WithEagerCloseDatafiles; the caller
+// must hold the write lock.
+func (b *Bitcask) addDatafile(df *internal.Datafile) {
+	if b.config.eagerCloseDatafiles {
+		df.Close()
+	}
+	b.datafiles[df.FileID()] = df
+}
+
+// put writes the key, value and flags to the active datafile; the caller
+// must hold the write lock.
+func (b *Bitcask) put(key string, value []byte, flags uint8, ttl time.Duration) (internal.Item, error) {
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return internal.Item{}, err
+		}
+	}
+
+	e := b.entry(key, value)
+	e.Flags |= uint32(flags)
+	if ttl > 0 {
+		e.Expiry = expiry(ttl)
+	}
+
+	return b.write(e)
+}
+
+// entry returns a new entry for the key and value, compressed with the
+// codec set by WithCompression, if any, recording the size of the value
+// before it was compressed, with the next sequence number
+// expiring after the expiry set with WithExpiry, if any, unless it is a
+// tombstone; the caller must hold the write lock.
+func (b *Bitcask) entry(key string, value []byte) pb.Entry {
+	data, compressed := b.config.compress(value)
+	e := internal.NewEntry(key, data)
+	if compressed {
+		e.Flags = uint32(FlagCompressed)
+		e.ValueSize = int64(len(value))
+	}
+	e.Sequence = b.keydir.NextSequence()
+	if b.config.expiry > 0 && len(value) > 0 {
+		e.Expiry = expiry(b.config.expiry)
+	}
+	return e
+}
+
+// expiry returns the expiry time of an entry written now expiring after
+// `ttl`, rounded up to the second.
+func expiry(ttl time.Duration) int64 {
+	t := time.Now().Add(ttl)
+	if t.Nanosecond() > 0 {
+		return t.Unix() + 1
+	}
+	return t.Unix()
+}
+
+// write writes the entry to the active datafile rotating it first if the
+// entry would not fit; the caller must hold the write lock.
+func (b *Bitcask) write(e pb.Entry) (internal.Item, error) {
+	if b.config.readOnly {
+		return internal.Item{}, ErrReadOnly
+	}
+	if err := b.checkEntrySize(e); err != nil {
+		return internal.Item{}, err
+	}
+
+	if err := b.maybeRotate(b.curr.EncodedSize(e)); err != nil {
+		return internal.Item{}, err
+	}
+
+	offset, n, err := b.curr.Write(e)
+	if err != nil {
+		return internal.Item{}, err
+	}
+	e.Offset = offset
+
+	return internal.NewItem(b.curr.FileID(), e, n), nil
+}
+
+// checkEntrySize checks that the entry fits into a datafile of the maximum
+// datafile size, that is when written to the start of a new datafile.
+func (b *Bitcask) checkEntrySize(e pb.Entry) error {
+	e.Offset = 0
+	if size := streampb.Size(&e); size > int64(b.config.maxDatafileSize) {
+		return errors.Wrapf(ErrEntryTooLarge, "entry of %d bytes exceeds the maximum datafile size of %d bytes", size, b.config.maxDatafileSize)
+	}
+	return nil
+}
+
+// maybeRotate rotates the active datafile if writing `n` more bytes to it
+// would exceed the maximum datafile size; the caller must hold the write
+// lock.
+func (b *Bitcask) maybeRotate(n int64) error {
+	size := b.curr.Size()
+	if size == 0 || size+n <= int64(b.config.maxDatafileSize) {
+		return nil
+	}
+	return b.rotate()
+}
+
+// rotate closes the active datafile, adding it to the immutable datafiles,
+// and opens the next datafile as the active datafile; the caller must hold
+// the write lock.
+func (b *Bitcask) rotate() error {
+	err := b.curr.Close()
+	if err != nil {
+		return err
+	}
+
+	df, err := internal.NewDatafile(b.path, b.curr.FileID(), true)
+	if err != nil {
+		return err
+	}
+
+	b.addDatafile(df)
+
+	if err := b.config.fault(FaultRotate); err != nil {
+		return err
+	}
+
+	id := b.curr.FileID() + 1
+	curr, err := b.config.openDatafile(b.path, id)
+	if err != nil {
+		return err
+	}
+	b.config.injectWrites(curr, FaultWrite)
+	b.curr = curr
+
+	return nil
+}
+
+// BulkLoad efficiently imports many keys into the database by calling the
+// function `f` with a `put` function that puts key/value pairs like Put but
+// without taking the write lock (and, with WithSyncWrites or
+// WithGroupCommit, syncing) for each of them; the keys loaded are synced
+// once when `f` returns. The database is locked for the duration of
+// BulkLoad so all other reads and writes block until it returns. If `f` or
+// `put` return an error no further keys are loaded and the error returned,
+// the keys already loaded remain in the database.
+func (b *Bitcask) BulkLoad(f func(put func(key string, value []byte) error) error) error {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+
+	n, err := b.bulkLoad(f)
+	if n > 0 {
+		if cerr := b.commit(); err == nil {
+			err = cerr
+		}
+	}
+	for i := 0; i < n; i++ {
+		b.config.metrics.IncPut()
+	}
+	return err
+}
+
+// bulkLoad calls `f` with the `put` function of BulkLoad and returns the
+// number of keys put.
+func (b *Bitcask) bulkLoad(f func(put func(key string, value []byte) error) error) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int
+	put := func(key string, value []byte) error {
+		if err := b.checkPut(key, value); err != nil {
+			return err
+		}
+		if err := b.update(key, value, 0, 0); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}
+
+	err := f(put)
+	return n, err
+}
+
+// Merge merges all datafiles in the database creating hint files for faster
+// startup. Old keys are squashed and deleted keys removes. Call this function
+// periodically to reclaim disk space.
+//
+// Merge accepts the same options as Open with those affecting merges (such
+// as WithMergeSortKeys) being applied.
+func Merge(path string, force bool, options ...Option) error {
+	if force {
+		options = append([]Option{WithMergeForce()}, options...)
+	}
+	return MergeWithOptions(path, options...)
+}
+
+// MergeWithOptions merges the datafiles of the database at the given path
+// like Merge with all of the merge's behaviour configured by options such as
+// WithMergeForce and WithMergeLockTimeout. The database must not be open:
+// the merge holds the database's lock for its duration and fails with
+// ErrDatabaseOpen if the database is open in this process (see
+// Bitcask.Merge) or with ErrDatabaseLocked if another process holds the lock
+// (for longer than the lock timeout).
+func MergeWithOptions(path string, options ...Option) error {
+	cfg := newDefaultConfig()
+	for _, opt := range options {
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+	path = cfg.dir(path)
+
+	unlock, err := lockMerge(path, cfg.mergeLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := recoverMerge(path); err != nil {
+		return err
+	}
+
+	return merge(path, cfg.mergeForce, cfg)
+}
+
+func merge(path string, force bool, cfg *config) (err error) {
+	fns, err := internal.GetDatafiles(path)
+	if err != nil {
+		return err
+	}
+
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+
+	// Do not merge if we only have 1 Datafile
+	if len(ids) <= 1 {
+		return nil
+	}
+
+	// Don't merge the Active Datafile (the last one) nor Datafiles whose
+	// .hint files we've already generated (they are already merged); unless
+	// we set the force flag to true (forcing a re-merge).
+	var merged []int
+	for _, id := range ids[:len(ids)-1] {
+		if _, err := os.Stat(hintPath(path, id)); err == nil && !force {
+			// Already merged
+			continue
+		}
+		merged = append(merged, id)
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	temp, err := beginMerge(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			discardMerge(path)
+		}
+	}()
+
+	// Entries of keys that are written or deleted again in a newer datafile
+	// are superseded and dropped (unless older versions are kept, see
+	// WithMaxVersions), so datafiles are merged newest first collecting the
+	// keys of each datafile along the way.
+	later := make(map[string]int)
+	next := len(merged) - 1
+	for i := len(ids) - 1; i >= 0 && ids[i] >= merged[0]; i-- {
+		if ids[i] != merged[next] {
+			if err := datafileKeys(path, ids[i], later, cfg); err != nil {
+				return err
+			}
+			continue
+		}
+		next--
+
+		if err := mergeDatafile(context.Background(), path, temp, ids[i], i > 0, later, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := cfg.fault(FaultMergeCommit); err != nil {
+		return err
+	}
+
+	return commitMerge(path, merged)
+}
+
+// mergeDatafile writes the live entries of the datafile with the given id
+// (those not superseded by the keys in `later`) along with a hint file to
+// the merge directory `temp` and then adds the keys of the datafile to
+// `later`. Tombstones must be kept as they may delete keys in older
+// datafiles, unless there are no older datafiles.
+//
+// `later` counts the versions of each key in the newer datafiles already
+// merged, a deleted key counting as the maximum number of versions (see
+// WithMaxVersions) as none of its older versions are kept. The merge of the
+// datafile stops with ctx.Err() once the context `ctx` is done.
+func mergeDatafile(ctx context.Context, path, temp string, id int, older bool, later map[string]int, cfg *config) error {
+	df, err := internal.NewDatafile(path, id, true)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	var seq uint64
+	keydir := internal.NewKeydir()
+	versions := make(map[string][]internal.Item)
+	tombstones := make(map[string]pb.Entry)
+	seen := make(map[string]int)
+	now := time.Now()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e, n, err := df.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if e.Sequence > seq {
+			seq = e.Sequence
+		}
+		expired := len(e.Value) > 0 && internal.NewItem(id, e, n).Expired(now)
+		countVersion(seen, e.Key, len(e.Value) == 0 || expired, cfg)
+		if later[e.Key] >= cfg.maxVersions {
+			continue
+		}
+
+		// Tombstone value  (deleted key)
+		if len(e.Value) == 0 {
+			keydir.Delete(e.Key)
+			delete(versions, e.Key)
+			if older {
+				tombstones[e.Key] = e
+			}
+			continue
+		}
+
+		// Expired keys are deleted, tombstones hiding any older values
+		if expired {
+			keydir.Delete(e.Key)
+			delete(versions, e.Key)
+			if older {
+				t := internal.NewEntry(e.Key, []byte{})
+				t.Flags = uint32(FlagTombstone)
+				t.Sequence = e.Sequence
+				tombstones[e.Key] = t
+			}
+			continue
+		}
+
+		if prev, ok := keydir.Get(e.Key); ok && cfg.maxVersions > 1 {
+			versions[e.Key] = append(versions[e.Key], prev)
+		}
+		keydir.Add(e.Key, internal.NewItem(id, e, n))
+		delete(tombstones, e.Key)
+	}
+
+	tempdf, err := cfg.openDatafile(temp, id)
+	if err != nil {
+		return err
+	}
+	defer tempdf.Close()
+	cfg.injectWrites(tempdf, FaultMergeWrite)
+
+	hint := &internal.Hint{
+		Items:    make(map[string]internal.Item),
+		Versions: make(map[string][]internal.Item),
+		Sequence: seq,
+	}
+
+	write := func(item internal.Item) (internal.Item, error) {
+		e, err := df.ReadAt(item.Offset, item.Size)
+		if err != nil {
+			return internal.Item{}, err
+		}
+
+		offset, n, err := tempdf.Write(copied(e))
+		if err != nil {
+			return internal.Item{}, err
+		}
+		e.Offset = offset
+
+		return internal.NewItem(id, e, n), nil
+	}
+
+	for _, key := range mergeOrder(keydir, cfg.mergeSortKeys) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The older versions in this datafile that are kept, oldest first
+		kept := versions[key]
+		if n := len(kept) - (cfg.maxVersions - 1 - later[key]); n > 0 {
+			kept = kept[n:]
+		}
+		for _, item := range kept {
+			item, err := write(item)
+			if err != nil {
+				return err
+			}
+			hint.Versions[key] = append(hint.Versions[key], item)
+		}
+
+		item, _ := keydir.Get(key)
+		item, err := write(item)
+		if err != nil {
+			return err
+		}
+		hint.Items[key] = item
+	}
+
+	for key, e := range tombstones {
+		if _, _, err := tempdf.Write(copied(e)); err != nil {
+			return err
+		}
+		hint.Deleted = append(hint.Deleted, key)
+	}
+
+	err = tempdf.Close()
+	if err != nil {
+		return err
+	}
+
+	err = hint.Save(hintPath(temp, id), datafilePath(temp, id), cfg.compressHints)
+	if err != nil {
+		return err
+	}
+	if err := cfg.chmod(hintPath(temp, id)); err != nil {
+		return err
+	}
+
+	addVersions(later, seen, cfg)
+
+	return nil
+}
+
+// countVersion counts a version of the key, or its deletion, in `seen`
+func countVersion(seen map[string]int, key string, deleted bool, cfg *config) {
+	if deleted {
+		seen[key] = cfg.maxVersions
+	} else if seen[key] < cfg.maxVersions {
+		seen[key]++
+	}
+}
+
+// addVersions adds the versions of the keys of a datafile counted in `seen`
+// to the versions of the keys in the newer datafiles in `later`
+func addVersions(later, seen map[string]int, cfg *config) {
+	for key, n := range seen {
+		if later[key]+n > cfg.maxVersions {
+			later[key] = cfg.maxVersions
+		} else {
+			later[key] += n
+		}
+	}
+}
+
+// datafileKeys adds the versions of the keys written or deleted in the
+// datafile with the given id to `later` (see mergeDatafile), reading them
+// from its hint file if it matches.
+func datafileKeys(path string, id int, later map[string]int, cfg *config) error {
+	seen := make(map[string]int)
+
+	if hint, err := internal.LoadHint(hintPath(path, id)); err == nil {
+		ok, err := hint.Matches(datafilePath(path, id))
+		if err != nil {
+			return err
+		}
+		if ok {
+			for key := range hint.Items {
+				seen[key] = 1 + len(hint.Versions[key])
+			}
+			for _, key := range hint.Deleted {
+				seen[key] = cfg.maxVersions
+			}
+			addVersions(later, seen, cfg)
+			return nil
+		}
+	}
+
+	df, err := internal.NewDatafile(path, id, true)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	now := time.Now()
+	for {
+		e, n, err := df.Read()
+		if err != nil {
+			if err == io.EOF {
+				addVersions(later, seen, cfg)
+				return nil
+			}
+			return err
+		}
+		expired := len(e.Value) > 0 && internal.NewItem(id, e, n).Expired(now)
+		countVersion(seen, e.Key, len(e.Value) == 0 || expired, cfg)
+	}
+}
+
+// mergeOrder returns the keys of the keydir in the order they are written
+// by a merge; sorted if requested, otherwise in no particular order.
+func mergeOrder(keydir *internal.Keydir, sorted bool) []string {
+	keys := make([]string, 0, keydir.Len())
+	for key := range keydir.Keys() {
+		keys = append(keys, key)
+	}
+	if sorted {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+// resize rewrites all datafiles of the database, once loaded by Open, into
+// new datafiles no larger than the configured maximum datafile size,
+// dropping deleted, expired and overwritten keys (but for the versions kept
+// with WithMaxVersions) in the process, and reloads them. As the database
+// is loaded first a torn tail of the active datafile is recovered and the
+// entries of unfinished transactions are dropped (see index). Nothing is
+// rewritten if all datafiles are already within the limit. An entry that on
+// its own exceeds the limit is written to a datafile of its own.
+func (b *Bitcask) resize() (err error) {
+	ids := []int{b.curr.FileID()}
+	oversized := b.curr.Size() > int64(b.config.maxDatafileSize)
+	for id, df := range b.datafiles {
+		ids = append(ids, id)
+		if df.Size() > int64(b.config.maxDatafileSize) {
+			oversized = true
+		}
+	}
+	if !oversized {
+		return nil
+	}
+	sort.Ints(ids)
+
+	temp, err := beginMerge(b.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			discardMerge(b.path)
+		}
+	}()
+
+	var id int
+	curr, err := b.config.openDatafile(temp, id)
+	if err != nil {
+		return err
+	}
+
+	write := func(item internal.Item) error {
+		df, _ := b.datafile(item.FileID)
+		e, err := b.readAt(df, item.Offset, item.Size)
+		if err != nil {
+			return err
+		}
+
+		size := curr.Size()
+		if size > 0 && size+curr.EncodedSize(e) > int64(b.config.maxDatafileSize) {
+			if err := curr.Close(); err != nil {
+				return err
+			}
+			id++
+			curr, err = b.config.openDatafile(temp, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, _, err = curr.Write(copied(e))
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range mergeOrder(b.keydir, b.config.mergeSortKeys) {
+		item, _ := b.keydir.Get(key)
+		if item.Expired(now) {
+			continue
+		}
+		for _, version := range b.keydir.Versions(key) {
+			if err := write(version); err != nil {
+				curr.Close()
+				return err
+			}
+		}
+		if err := write(item); err != nil {
+			curr.Close()
+			return err
+		}
+	}
+
+	if err := curr.Close(); err != nil {
+		return err
+	}
+
+	if err := commitMerge(b.path, ids); err != nil {
+		return err
+	}
+
+	// The datafiles have been replaced
+	b.closeDatafiles()
+
+	recovered := b.recovered
+	if err := b.load(); err != nil {
+		return err
+	}
+	b.recovered = recovered
+	return nil
+}
+
+// load loads the datafiles of the database and builds the index
+func (b *Bitcask) load() error {
+	fns, err := internal.GetDatafiles(b.path)
+	if err != nil {
+		return err
+	}
+
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+
+	var id int
+	if len(ids) > 0 {
+		id = ids[(len(ids) - 1)]
+	}
+
+	datafiles := make(map[int]*internal.Datafile)
+
+	keydir := internal.NewKeydir()
+	if b.config.maxVersions > 1 {
+		keydir.SetMaxVersions(b.config.maxVersions)
+	}
+	trie := internal.NewTrie()
+	recent := internal.NewRecentKeys()
+
+	var (
+		tail      int64
+		indexed   bool
+		recovered *RecoveryError
+	)
+
+	if b.config.persistentIndex {
+		indexed, err = loadIndex(b.path, ids, keydir, trie, recent)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range fns {
+		df, err := internal.NewDatafile(b.path, ids[i], true)
+		if err != nil {
+			return err
+		}
+
+		if ids[i] == id {
+			defer df.Close()
+		} else {
+			datafiles[ids[i]] = df
+		}
+
+		if indexed {
+			if ids[i] == id {
+				tail = df.Size()
+			}
+			continue
+		}
+
+		hinted, err := loadHint(b.path, ids[i], keydir, trie, recent, b.config.strictHints)
+		if err != nil {
+			return err
+		}
+		if hinted {
+			if ids[i] == id {
+				tail = df.Size()
+			}
+			continue
+		}
+
+		// The entries of the active datafile are verified as its tail
+		// may be corrupt after a crash
+		verify := ids[i] == id && !b.config.readOnly
+
+		n, err := index(df, keydir, trie, recent, verify)
+		if err != nil {
+			switch {
+			case b.config.readOnly && ids[i] == id && truncated(err):
+				// A read-only database may see an entry of the
+				// active datafile that is still being written.
+			case verify && !b.config.strictRecovery && recoverable(err):
+				recovered, err = truncateTail(b.path, id, n, err)
+				if err != nil {
+					return err
+				}
+			default:
+				return err
+			}
+		}
+		if ids[i] == id {
+			tail = n
+		}
+	}
+
+	var curr *internal.Datafile
+	if b.config.readOnly {
+		curr, err = internal.NewDatafile(b.path, id, true)
+	} else {
+		curr, err = b.config.openDatafile(b.path, id)
+	}
+	if err != nil {
+		return err
+	}
+	if !b.config.readOnly {
+		b.config.injectWrites(curr, FaultWrite)
+	}
+
+	if b.config.eagerCloseDatafiles {
+		// Only the ids and sizes of the datafiles are kept (see readAt)
+		for _, df := range datafiles {
+			df.Close()
+		}
+	}
+
+	b.curr = curr
+	b.keydir = keydir
+	b.datafiles = datafiles
+	b.trie = trie
+	b.recent = recent
+	b.tail = tail
+	b.refreshed = time.Now()
+	b.recovered = recovered
+
+	return nil
+}
+
+// index adds the entries read from the datafile, from its current position
+// to its end, to the keydir, trie and recent keys and returns the number of
+// bytes read. The entries of a transaction (see Transaction.Commit) are
+// only added once its last entry is read. If `verify` is set the entries
+// are verified (see verifyEntry) and, as a torn write may leave an entry
+// whose value is corrupt at the end of the datafile, the last entry is only
+// added if its checksum matches; a transaction left unfinished at the end
+// of the datafile fails with errIncompleteTransaction, otherwise it is
+// skipped. On error, or skipping a transaction, the number of bytes
+// returned is that of the entries added.
+func index(df *internal.Datafile, keydir *internal.Keydir, trie *internal.Trie, recent *internal.RecentKeys, verify bool) (int64, error) {
+	add := func(e pb.Entry, n int64) {
+		keydir.UpdateSequence(e.Sequence)
+
+		// Tombstone value  (deleted key)
+		if len(e.Value) == 0 {
+			if _, ok := keydir.Get(e.Key); ok {
+				trie.Remove(e.Key)
+				recent.Remove(e.Key)
+			}
+			keydir.Remove(e.Key, e.Sequence)
+			return
+		}
+
+		keydir.Overwrite(e.Key, internal.NewItem(df.FileID(), e, n))
+		trie.Add(e.Key)
+		recent.Add(e.Key)
+	}
+
+	var (
+		size int64
+
+		// The entries of the transaction read so far
+		run     []pb.Entry
+		runNs   []int64
+		runSize int64
+	)
+	accept := func(e pb.Entry, n int64) {
+		if e.Flags&flagTransaction != 0 {
+			run = append(run, e)
+			runNs = append(runNs, n)
+			runSize += n
+			return
+		}
+
+		for i := range run {
+			add(run[i], runNs[i])
+		}
+		add(e, n)
+		size += runSize + n
+		run, runNs, runSize = nil, nil, 0
+	}
+
+	// The entry read last whose checksum doesn't match, only accepted
+	// once another entry follows it
+	var (
+		suspect  *pb.Entry
+		suspectN int64
+	)
+	for {
+		e, n, err := df.Read()
+		if err != nil {
+			if err != io.EOF {
+				return size, err
+			}
+			if suspect != nil {
+				return size, ErrChecksumFailed
+			}
+			if len(run) > 0 && verify {
+				return size, errIncompleteTransaction
+			}
+			return size, nil
+		}
+		if verify {
+			if err := verifyEntry(e); err != nil {
+				return size, err
+			}
+		}
+		if suspect != nil {
+			accept(*suspect, suspectN)
+			suspect = nil
+		}
+		if verify && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+			suspect, suspectN = &e, n
+			continue
+		}
+		accept(e, n)
+	}
+}
+
+// Open opens the database at the given path with optional options.
+// Options can be provided with the `WithXXX` functions that provide
+// configuration options as functions.
+func Open(path string, options ...Option) (*Bitcask, error) {
+	cfg := newDefaultConfig()
+	for _, opt := range options {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	path = cfg.dir(path)
+
+	if cfg.readOnly {
+		readLock, err := lockShared(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := loadMeta(path, cfg); err != nil {
+			unlock(readLock)
+			return nil, err
+		}
+		bitcask, err := open(path, cfg)
+		if err != nil {
+			unlock(readLock)
+			return nil, err
+		}
+		bitcask.readLock = readLock
+		if err := bitcask.loadCounters(); err != nil {
+			bitcask.Close()
+			return nil, err
+		}
+		return bitcask, nil
+	}
+
+	if err := cfg.mkdirAll(path); err != nil {
+		return nil, err
+	}
+
+	lock := flock.New(filepath.Join(path, "lock"))
+
+	locked, err := lock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+
+	if !locked {
+		return nil, ErrDatabaseLocked
+	}
+
+	// A stale writer must not touch the database, including recovering
+	// or merging it while it is opened
+	if cfg.fencing {
+		if err := fence(path, cfg.fencingToken); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+	}
+
+	if err := cfg.chmod(lock.Path()); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	stored, err := loadMeta(path, cfg)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	bitcask, err := open(path, cfg)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	bitcask.Flock = lock
+	registerOpen(path)
+
+	if err := bitcask.loadCounters(); err != nil {
+		bitcask.Close()
+		return nil, err
+	}
+
+	if err := saveMeta(path, stored, cfg); err != nil {
+		bitcask.Close()
+		return nil, err
+	}
+
+	if cfg.groupCommit {
+		bitcask.startCommitter()
+	}
+
+	if cfg.counterCheckpoint > 0 {
+		bitcask.counters.start(cfg.counterCheckpoint)
+	}
+
+	if cfg.autoMergeRatio > 0 || cfg.deleteReclaimRatio > 0 {
+		bitcask.startAutoMerge()
+	}
+
+	return bitcask, nil
+}
+
+// readLockFilename is the lock file read-only databases hold a shared lock
+// on (see WithReadOnly)
+const readLockFilename = "readers.lock"
+
+// lockShared takes a shared lock of the database at `path` for a read-only
+// database; other read-only databases and the database open for writing
+// may hold it too but Move and ReplaceWith, which remove the datafiles from
+// under a read-only database (see lockReaders), may not. A database the
+// lock can't be created for (e.g: on a read-only filesystem) isn't locked.
+func lockShared(path string) (*flock.Flock, error) {
+	lock := flock.New(filepath.Join(path, readLockFilename))
+	locked, err := lock.TryRLock()
+	if err != nil {
+		if pe, ok := err.(*os.PathError); os.IsPermission(err) || ok && pe.Err == syscall.EROFS {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrDatabaseLocked
+	}
+	return lock, nil
+}
+
+// lockReaders takes the exclusive lock of the database at `path`, the lock
+// shared by read-only databases (see lockShared), failing with
+// ErrDatabaseLocked if it is open read-only.
+func lockReaders(path string) (*flock.Flock, error) {
+	lock := flock.New(filepath.Join(path, readLockFilename))
+	locked, err := lock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrDatabaseLocked
+	}
+	return lock, nil
+}
+
+// unlock releases the lock, if any
+func unlock(lock *flock.Flock) {
+	if lock != nil {
+		lock.Unlock()
+	}
+}
+
+func open(path string, cfg *config) (*Bitcask, error) {
+	var err error
+
+	if !cfg.readOnly {
+		if err := recoverMerge(path); err != nil {
+			return nil, err
+		}
+
+		if err := removeSnapshots(path); err != nil {
+			return nil, err
+		}
+
+		if err := merge(path, false, cfg); err != nil {
+			return nil, err
+		}
+
+	}
+
+	bitcask := &Bitcask{
+		config:  cfg,
+		path:    path,
+		groups:  make(map[string]*group),
+		pending: make(map[string]string),
+	}
+	if cfg.maxOpenFiles > 0 {
+		bitcask.handles = newHandleCache(cfg.maxOpenFiles)
+	}
+
+	if err := bitcask.load(); err != nil {
+		return nil, err
+	}
+
+	if cfg.enforceDatafileSizeOnOpen && !cfg.readOnly {
+		if err := bitcask.resize(); err != nil {
+			bitcask.closeDatafiles()
+			return nil, err
+		}
+	}
+
+	if cfg.tombstoneHistory > 0 {
+		bitcask.tombstones, err = loadTombstones(path)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(bitcask.tombstones) - cfg.tombstoneHistory; n > 0 {
+			bitcask.tombstones = bitcask.tombstones[n:]
+		}
+	}
+
+	if cfg.keyStats {
+		bitcask.keystats = internal.NewKeyStats(cfg.keyStatsDecay)
+	}
+
+	bitcask.observeDiskBytes()
+
 	return bitcask, nil
 }
@@ -1,15 +1,31 @@
 package bitcask
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask/internal"
+	pb "github.com/prologic/bitcask/internal/proto"
+	"github.com/prologic/bitcask/internal/streampb"
 )
 
 func TestAll(t *testing.T) {
@@ -223,22 +239,22 @@ func TestOpenMerge(t *testing.T) {
 		)
 
 		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir, WithMaxDatafileSize(32))
+			db, err = Open(testdir, WithMaxDatafileSize(2048))
 			assert.NoError(err)
 		})
 
 		t.Run("Put", func(t *testing.T) {
 			for i := 0; i < 1024; i++ {
-				err = db.Put(string(i), []byte(strings.Repeat(" ", 1024)))
+				err = db.Put(string(rune(i)), []byte(strings.Repeat(" ", 1024)))
 				assert.NoError(err)
 			}
 		})
 
 		t.Run("Get", func(t *testing.T) {
 			for i := 0; i < 32; i++ {
-				err = db.Put(string(i), []byte(strings.Repeat(" ", 1024)))
+				err = db.Put(string(rune(i)), []byte(strings.Repeat(" ", 1024)))
 				assert.NoError(err)
-				val, err := db.Get(string(i))
+				val, err := db.Get(string(rune(i)))
 				assert.NoError(err)
 				assert.Equal([]byte(strings.Repeat(" ", 1024)), val)
 			}
@@ -268,7 +284,7 @@ func TestOpenMerge(t *testing.T) {
 
 		t.Run("Get", func(t *testing.T) {
 			for i := 0; i < 32; i++ {
-				val, err := db.Get(string(i))
+				val, err := db.Get(string(rune(i)))
 				assert.NoError(err)
 				assert.Equal([]byte(strings.Repeat(" ", 1024)), val)
 			}
@@ -294,22 +310,22 @@ func TestMergeOpen(t *testing.T) {
 
 	t.Run("Setup", func(t *testing.T) {
 		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir, WithMaxDatafileSize(32))
+			db, err = Open(testdir, WithMaxDatafileSize(2048))
 			assert.NoError(err)
 		})
 
 		t.Run("Put", func(t *testing.T) {
 			for i := 0; i < 1024; i++ {
-				err = db.Put(string(i), []byte(strings.Repeat(" ", 1024)))
+				err = db.Put(string(rune(i)), []byte(strings.Repeat(" ", 1024)))
 				assert.NoError(err)
 			}
 		})
 
 		t.Run("Get", func(t *testing.T) {
 			for i := 0; i < 32; i++ {
-				err = db.Put(string(i), []byte(strings.Repeat(" ", 1024)))
+				err = db.Put(string(rune(i)), []byte(strings.Repeat(" ", 1024)))
 				assert.NoError(err)
-				val, err := db.Get(string(i))
+				val, err := db.Get(string(rune(i)))
 				assert.NoError(err)
 				assert.Equal([]byte(strings.Repeat(" ", 1024)), val)
 			}
@@ -339,7 +355,7 @@ func TestMergeOpen(t *testing.T) {
 
 		t.Run("Get", func(t *testing.T) {
 			for i := 0; i < 32; i++ {
-				val, err := db.Get(string(i))
+				val, err := db.Get(string(rune(i)))
 				assert.NoError(err)
 				assert.Equal([]byte(strings.Repeat(" ", 1024)), val)
 			}
@@ -497,138 +513,5372 @@ func TestLocking(t *testing.T) {
 	assert.Equal(ErrDatabaseLocked, err)
 }
 
-type benchmarkTestCase struct {
-	name string
-	size int
-}
+func TestOptionsFromFile(t *testing.T) {
+	assert := assert.New(t)
 
-func BenchmarkGet(b *testing.B) {
 	testdir, err := ioutil.TempDir("", "bitcask")
-	if err != nil {
-		b.Fatal(err)
-	}
+	assert.NoError(err)
 
-	db, err := Open(testdir)
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer db.Close()
+	fn := filepath.Join(testdir, "bitcask.json")
 
-	tests := []benchmarkTestCase{
-		{"128B", 128},
-		{"256B", 256},
-		{"512B", 512},
-		{"1K", 1024},
-		{"2K", 2048},
-		{"4K", 4096},
-		{"8K", 8192},
-		{"16K", 16384},
-		{"32K", 32768},
-	}
+	t.Run("Valid", func(t *testing.T) {
+		data := []byte(`{"max_datafile_size": 1024, "max_key_size": 16, "max_value_size": 32}`)
+		err := ioutil.WriteFile(fn, data, 0644)
+		assert.NoError(err)
 
-	for _, tt := range tests {
-		b.Run(tt.name, func(b *testing.B) {
-			key := "foo"
-			value := []byte(strings.Repeat(" ", tt.size))
+		options, err := OptionsFromFile(fn)
+		assert.NoError(err)
+		assert.Len(options, 3)
 
-			err = db.Put(key, value)
-			if err != nil {
-				b.Fatal(err)
-			}
+		db, err := Open(filepath.Join(testdir, "db"), options...)
+		assert.NoError(err)
+		defer db.Close()
 
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				val, err := db.Get(key)
-				if err != nil {
-					b.Fatal(err)
-				}
-				if string(val) != string(value) {
-					b.Errorf("unexpected value")
-				}
-			}
-		})
-	}
+		err = db.Put("foo", []byte("bar"))
+		assert.NoError(err)
+
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+
+		err = db.Put(strings.Repeat(" ", 17), []byte("bar"))
+		assert.Equal(ErrKeyTooLarge, err)
+
+		err = db.Put("foo", []byte(strings.Repeat(" ", 33)))
+		assert.Equal(ErrValueTooLarge, err)
+	})
+
+	t.Run("UnknownField", func(t *testing.T) {
+		_, err := OptionsFromJSON(strings.NewReader(`{"max_key_sise": 16}`))
+		assert.Error(err)
+		assert.Contains(err.Error(), "max_key_sise")
+	})
+
+	t.Run("InvalidValue", func(t *testing.T) {
+		_, err := OptionsFromJSON(strings.NewReader(`{"max_value_size": 0}`))
+		assert.Error(err)
+		assert.Contains(err.Error(), "max_value_size")
+
+		_, err = OptionsFromJSON(strings.NewReader(`{"compression": "zip"}`))
+		assert.Error(err)
+		assert.Contains(err.Error(), "zip")
+	})
+
+	t.Run("SyncAndCompression", func(t *testing.T) {
+		options, err := OptionsFromJSON(strings.NewReader(`{"sync": true, "compression": "gzip"}`))
+		assert.NoError(err)
+		cfg := newDefaultConfig()
+		for _, opt := range options {
+			assert.NoError(opt(cfg))
+		}
+		assert.True(cfg.syncWrites)
+		assert.Equal(Gzip{}, cfg.compression)
+
+		options, err = OptionsFromJSON(strings.NewReader(`{"sync": false, "compression": "none"}`))
+		assert.NoError(err)
+		cfg = newDefaultConfig()
+		for _, opt := range options {
+			assert.NoError(opt(cfg))
+		}
+		assert.False(cfg.syncWrites)
+		assert.Nil(cfg.compression)
+	})
+
+	t.Run("TrailingData", func(t *testing.T) {
+		for _, data := range []string{
+			`{"max_key_size": 16} {"max_key_size": 8}`,
+			`{"max_key_size": 16}}`,
+			`{"max_key_size": 16} x`,
+		} {
+			_, err := OptionsFromJSON(strings.NewReader(data))
+			assert.Error(err, data)
+		}
+
+		_, err := OptionsFromJSON(strings.NewReader("{\"max_key_size\": 16}\n"))
+		assert.NoError(err)
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		_, err := OptionsFromFile(filepath.Join(testdir, "missing.json"))
+		assert.Error(err)
+	})
 }
 
-func BenchmarkPut(b *testing.B) {
+func TestHotKeys(t *testing.T) {
+	assert := assert.New(t)
+
 	testdir, err := ioutil.TempDir("", "bitcask")
-	if err != nil {
-		b.Fatal(err)
-	}
+	assert.NoError(err)
 
-	db, err := Open(testdir)
-	if err != nil {
-		b.Fatal(err)
-	}
+	db, err := Open(testdir, WithKeyStats(0))
+	assert.NoError(err)
 	defer db.Close()
 
-	tests := []benchmarkTestCase{
-		{"128B", 128},
-		{"256B", 256},
-		{"512B", 512},
-		{"1K", 1024},
-		{"2K", 2048},
-		{"4K", 4096},
-		{"8K", 8192},
-		{"16K", 16384},
-		{"32K", 32768},
+	for i := 0; i < 100; i++ {
+		err = db.Put(fmt.Sprintf("k%d", i), []byte("bar"))
+		assert.NoError(err)
 	}
 
-	for _, tt := range tests {
-		b.Run(tt.name, func(b *testing.B) {
-			key := "foo"
-			value := []byte(strings.Repeat(" ", tt.size))
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				err := db.Put(key, value)
-				if err != nil {
-					b.Fatal(err)
-				}
-			}
-		})
+	for i := 0; i < 1000; i++ {
+		_, err = db.Get("k42")
+		assert.NoError(err)
 	}
+	for i := 0; i < 500; i++ {
+		_, err = db.Get("k7")
+		assert.NoError(err)
+	}
+
+	hot := db.HotKeys(2)
+	assert.Equal([]string{"k42", "k7"}, hot)
+	assert.NotContains(hot, "k1")
+	assert.Empty(db.HotKeys(-1))
+
+	t.Run("Disabled", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		err = db.Put("foo", []byte("bar"))
+		assert.NoError(err)
+		assert.Empty(db.HotKeys(1))
+	})
+
+	t.Run("Transaction", func(t *testing.T) {
+		// Puts in transactions are counted as by Put
+		for i := 0; i < 2000; i++ {
+			tx := db.Transaction()
+			assert.NoError(tx.Put("tx", []byte("bar")))
+			assert.NoError(tx.Commit())
+		}
+		assert.Equal([]string{"tx"}, db.HotKeys(1))
+	})
+
+	t.Run("Decay", func(t *testing.T) {
+		stats := internal.NewKeyStats(50 * time.Millisecond)
+		for i := 0; i < 100; i++ {
+			stats.Touch("old")
+		}
+		time.Sleep(200 * time.Millisecond)
+		for i := 0; i < 50; i++ {
+			stats.Touch("new")
+		}
+		assert.Equal([]string{"new", "old"}, stats.Top(2))
+	})
 }
 
-func BenchmarkScan(b *testing.B) {
+func TestEnforceDatafileSizeOnOpen(t *testing.T) {
+	assert := assert.New(t)
+
 	testdir, err := ioutil.TempDir("", "bitcask")
-	if err != nil {
-		b.Fatal(err)
-	}
+	assert.NoError(err)
 
-	db, err := Open(testdir)
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer db.Close()
+	value := []byte(strings.Repeat(" ", 128))
 
-	var items = map[string][]byte{
-		"1":     []byte("1"),
-		"2":     []byte("2"),
-		"3":     []byte("3"),
-		"food":  []byte("pizza"),
-		"foo":   []byte("foo"),
-		"fooz":  []byte("fooz ball"),
-		"hello": []byte("world"),
-	}
-	for k, v := range items {
-		err := db.Put(k, v)
-		if err != nil {
-			b.Fatal(err)
+	t.Run("Setup", func(t *testing.T) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		for i := 0; i < 64; i++ {
+			err = db.Put(fmt.Sprintf("k%d", i), value)
+			assert.NoError(err)
 		}
-	}
+		err = db.Delete("k0")
+		assert.NoError(err)
 
-	var expected = []string{"foo", "food", "fooz"}
+		err = db.Close()
+		assert.NoError(err)
+	})
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		var keys []string
-		err = db.Scan("fo", func(key string) error {
-			keys = append(keys, key)
-			return nil
-		})
-		sort.Strings(keys)
-		if !reflect.DeepEqual(expected, keys) {
-			b.Fatal(fmt.Errorf("expected keys=#%v got=%#v", expected, keys))
+	t.Run("Lenient", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(1024))
+		assert.NoError(err)
+
+		fns, err := internal.GetDatafiles(testdir)
+		assert.NoError(err)
+		assert.Len(fns, 1)
+
+		for i := 1; i < 64; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+
+		err = db.Close()
+		assert.NoError(err)
+	})
+
+	t.Run("Enforced", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(1024), WithEnforceDatafileSizeOnOpen())
+		assert.NoError(err)
+
+		fns, err := internal.GetDatafiles(testdir)
+		assert.NoError(err)
+		assert.True(len(fns) > 1)
+		for _, fn := range fns {
+			stat, err := os.Stat(fn)
+			assert.NoError(err)
+			assert.True(stat.Size() <= 1024)
+		}
+
+		assert.Equal(63, db.Len())
+		assert.False(db.Has("k0"))
+		for i := 1; i < 64; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+
+		err = db.Put("foo", []byte("bar"))
+		assert.NoError(err)
+
+		err = db.Close()
+		assert.NoError(err)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(64, db.Len())
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+		for i := 1; i < 64; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+	})
+
+	t.Run("Recovered", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxVersions(3))
+		assert.NoError(err)
+		for i := 0; i < 16; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), value))
+		}
+		for i := 1; i <= 3; i++ {
+			assert.NoError(db.Put("versioned", []byte(fmt.Sprintf("v%d", i))))
 		}
+		assert.NoError(db.PutWithTTL("expired", value, time.Second))
+
+		tx := db.Transaction()
+		assert.NoError(tx.Put("k0", []byte("torn")))
+		assert.NoError(tx.Put("k1", []byte("torn")))
+		assert.NoError(tx.Commit())
+		last, _ := db.keydir.Get("k1")
+		assert.NoError(db.Close())
+
+		// Simulate a crash before the last entry of the transaction and
+		// then garbage were written
+		fn := datafilePath(testdir, last.FileID)
+		assert.NoError(os.Truncate(fn, last.Offset))
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+		assert.NoError(err)
+		_, err = f.Write([]byte("garbage"))
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		time.Sleep(2 * time.Second)
+
+		db, err = Open(testdir, WithMaxDatafileSize(1024), WithEnforceDatafileSizeOnOpen(), WithMaxVersions(3))
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.NotNil(db.Recovered())
+		fns, err := internal.GetDatafiles(testdir)
+		assert.NoError(err)
+		assert.True(len(fns) > 1)
+		for _, fn := range fns {
+			stat, err := os.Stat(fn)
+			assert.NoError(err)
+			assert.True(stat.Size() <= 1024)
+		}
+
+		for i := 0; i < 16; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+		assert.False(db.Has("expired"))
+		assert.Equal(17, db.Len())
+		versions, err := db.GetVersions("versioned")
+		assert.NoError(err)
+		assert.Len(versions, 3)
+		assert.Equal([]byte("v1"), versions[len(versions)-1])
+	})
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+
+	open := func(options ...Option) *Bitcask {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		db, err := Open(testdir, options...)
+		assert.NoError(err)
+		return db
+	}
+
+	a := open()
+	defer a.Close()
+	b := open(WithCompression(Gzip{}))
+	defer b.Close()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		assert.NoError(a.Put(key, []byte(key)))
+		assert.NoError(b.Put(key, []byte(key)))
+	}
+
+	assert.NoError(a.Put("a", []byte("only in a")))
+	assert.NoError(b.Put("b", []byte("only in b")))
+	assert.NoError(b.Put("k3", []byte("changed")))
+	assert.NoError(a.Delete("k5"))
+	assert.NoError(b.Put("k7", []byte("k7")))
+
+	// Values stored compressed in only one of the databases
+	doc := []byte(strings.Repeat("compressible ", 20))
+	assert.NoError(a.Put("doc", doc))
+	assert.NoError(b.Put("doc", doc))
+	assert.NoError(a.Put("changed-doc", doc))
+	assert.NoError(b.Put("changed-doc", append([]byte("x"), doc...)))
+	item, _ := b.keydir.Get("doc")
+	assert.Equal(FlagCompressed, item.Flags)
+
+	// Pending grouped writes and expired keys
+	assert.NoError(a.PutGrouped("g", "k8", []byte("pending")))
+	assert.NoError(a.PutWithTTL("k9", []byte("k9"), time.Hour))
+	item, _ = a.keydir.Get("k9")
+	item.Expiry = time.Now().Unix()
+	a.keydir.Add("k9", item)
+
+	var diffs []string
+	err := Diff(a, b, func(key string, onlyInA, onlyInB, valuesDiffer bool) {
+		diffs = append(diffs, fmt.Sprintf("%s:%t:%t:%t", key, onlyInA, onlyInB, valuesDiffer))
+	})
+	assert.NoError(err)
+
+	assert.Equal([]string{
+		"a:true:false:false",
+		"b:false:true:false",
+		"changed-doc:false:false:true",
+		"k3:false:false:true",
+		"k5:false:true:false",
+		"k8:false:false:true",
+		"k9:false:true:false",
+	}, diffs)
+}
+
+func TestFencing(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithFencingToken(1), WithCounterRegion(time.Hour, "hits"))
+	assert.NoError(err)
+
+	epoch, err := Epoch(testdir)
+	assert.NoError(err)
+	assert.Equal(uint64(1), epoch)
+
+	err = db.Put("foo", []byte("bar"))
+	assert.NoError(err)
+	_, err = db.Incr("hits", 1)
+	assert.NoError(err)
+
+	epoch, err = AdvanceEpoch(testdir)
+	assert.NoError(err)
+	assert.Equal(uint64(2), epoch)
+
+	err = db.Put("foo", []byte("baz"))
+	assert.Equal(ErrFenced, err)
+	err = db.Delete("foo")
+	assert.Equal(ErrFenced, err)
+	_, err = db.Incr("hits", 1)
+	assert.Equal(ErrFenced, err)
+	assert.Equal(ErrFenced, db.Merge())
+
+	val, err := db.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+
+	err = db.Close()
+	assert.NoError(err)
+
+	t.Run("StaleToken", func(t *testing.T) {
+		// A stale writer doesn't even recover the database
+		temp := filepath.Join(testdir, mergeDirname)
+		assert.NoError(os.Mkdir(temp, 0755))
+
+		_, err := Open(testdir, WithFencingToken(1))
+		assert.Equal(ErrFenced, err)
+
+		_, err = os.Stat(temp)
+		assert.NoError(err)
+	})
+
+	t.Run("NewWriter", func(t *testing.T) {
+		db, err := Open(testdir, WithFencingToken(2))
+		assert.NoError(err)
+		defer db.Close()
+
+		err = db.Put("foo", []byte("baz"))
+		assert.NoError(err)
+	})
+
+	t.Run("StaleRewrites", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		for i := 0; i < 50; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(strings.Repeat("v", 32))))
+		}
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir, WithFencingToken(1), WithMaxDatafileSize(512))
+		assert.NoError(err)
+		defer db.Close()
+		assert.NoError(db.Put("k0", []byte("overwritten")))
+
+		var buf bytes.Buffer
+		assert.NoError(db.Backup(&buf))
+
+		_, err = AdvanceEpoch(testdir)
+		assert.NoError(err)
+
+		stats := db.DatafileStats()
+		assert.Len(stats, 2)
+		assert.Equal(ErrFenced, db.SplitDatafile(stats[0].FileID))
+		assert.Equal(ErrFenced, db.CompactDatafile(stats[0].FileID))
+		assert.Equal(stats, db.DatafileStats())
+
+		dec := streampb.NewDecoder(bytes.NewReader(buf.Bytes()[len(backupMagic):]))
+		assert.Equal(ErrFenced, db.restore(dec))
+	})
+}
+
+func TestOpenDatafile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Put("foo", []byte("baz")))
+	assert.NoError(db.Put("hello", []byte("world")))
+	assert.NoError(db.Delete("hello"))
+	assert.NoError(db.Close())
+
+	fns, err := internal.GetDatafiles(testdir)
+	assert.NoError(err)
+	assert.Len(fns, 1)
+	fn := fns[0]
+
+	read := func() ([]DatafileEntry, *DatafileIterator) {
+		it, err := OpenDatafile(fn)
+		assert.NoError(err)
+		defer it.Close()
+
+		var entries []DatafileEntry
+		for it.Next() {
+			entries = append(entries, it.Entry())
+		}
+		assert.NoError(it.Err())
+		return entries, it
+	}
+
+	t.Run("Iterate", func(t *testing.T) {
+		entries, it := read()
+		assert.False(it.Truncated())
+		assert.Len(entries, 4)
+		assert.Equal("foo", entries[0].Key)
+		assert.Equal([]byte("bar"), entries[0].Value)
+		assert.Equal([]byte("baz"), entries[1].Value)
+		assert.Equal("hello", entries[3].Key)
+		assert.Empty(entries[3].Value)
+		assert.Equal(FlagTombstone, entries[3].Flags)
+		assert.Equal(uint8(0), entries[0].Flags)
+		for _, e := range entries {
+			assert.True(e.Valid)
+			assert.False(e.Timestamp.IsZero())
+		}
+		assert.True(entries[1].Offset > entries[0].Offset)
+	})
+
+	t.Run("CorruptValue", func(t *testing.T) {
+		entries, _ := read()
+
+		data, err := ioutil.ReadFile(fn)
+		assert.NoError(err)
+
+		// Flip a byte of the value of the 3rd entry ("world")
+		i := bytes.Index(data[entries[2].Offset:], []byte("world"))
+		assert.True(i > 0)
+		data[entries[2].Offset+int64(i)] = 'W'
+		err = ioutil.WriteFile(fn, data, 0644)
+		assert.NoError(err)
+
+		entries, it := read()
+		assert.False(it.Truncated())
+		assert.Len(entries, 4)
+		assert.False(entries[2].Valid)
+		assert.Equal([]byte("World"), entries[2].Value)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		entries, _ := read()
+
+		stat, err := os.Stat(fn)
+		assert.NoError(err)
+		err = os.Truncate(fn, stat.Size()-3)
+		assert.NoError(err)
+
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0644)
+		assert.NoError(err)
+		_, err = f.Write([]byte{0xff, 0xff})
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		truncated, it := read()
+		assert.True(it.Truncated())
+		assert.Equal(entries[:3], truncated)
+		assert.Equal(entries[3].Offset, it.Offset())
+	})
+}
+
+func TestMergeSortKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	t.Run("Setup", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(4096))
+		assert.NoError(err)
+
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("k%02d", (i*7)%50)
+			err = db.Put(key, []byte("bar"))
+			assert.NoError(err)
+		}
+
+		// Force a rotation so the keys above are in an immutable datafile
+		err = db.Put("big", []byte(strings.Repeat(" ", 4000)))
+		assert.NoError(err)
+
+		err = db.Close()
+		assert.NoError(err)
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		err := Merge(testdir, true, WithMergeSortKeys())
+		assert.NoError(err)
+	})
+
+	t.Run("Offsets", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(4096), WithMergeSortKeys())
+		assert.NoError(err)
+		defer db.Close()
+
+		var offset int64 = -1
+		for i := 0; i < 50; i++ {
+			item, ok := db.keydir.Get(fmt.Sprintf("k%02d", i))
+			assert.True(ok)
+			assert.Equal(0, item.FileID)
+			assert.True(item.Offset > offset)
+			offset = item.Offset
+		}
+	})
+}
+
+func TestMergeRecovery(t *testing.T) {
+	assert := assert.New(t)
+
+	setup := func() string {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir, WithMaxDatafileSize(256))
+		assert.NoError(err)
+		for i := 0; i < 32; i++ {
+			err = db.Put(fmt.Sprintf("k%d", i), []byte(strings.Repeat("x", 64)))
+			assert.NoError(err)
+		}
+		assert.NoError(db.Close())
+
+		return testdir
+	}
+
+	verify := func(testdir string) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(32, db.Len())
+		for i := 0; i < 32; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte(strings.Repeat("x", 64)), val)
+		}
+
+		_, err = os.Stat(filepath.Join(testdir, mergeDirname))
+		assert.True(os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(testdir, mergeMarker))
+		assert.True(os.IsNotExist(err))
+	}
+
+	t.Run("Rollback", func(t *testing.T) {
+		testdir := setup()
+
+		// Simulate a crash part way through writing the merge output
+		temp, err := beginMerge(testdir)
+		assert.NoError(err)
+		err = ioutil.WriteFile(datafilePath(temp, 0), []byte("partial garbage"), 0644)
+		assert.NoError(err)
+
+		verify(testdir)
+	})
+
+	t.Run("RollForward", func(t *testing.T) {
+		testdir := setup()
+
+		fns, err := internal.GetDatafiles(testdir)
+		assert.NoError(err)
+		ids, err := internal.ParseIds(fns)
+		assert.NoError(err)
+
+		// Simulate a crash after committing the merge and moving some of
+		// its output into place (the output here is a copy of the input)
+		temp, err := beginMerge(testdir)
+		assert.NoError(err)
+		for _, fn := range fns[1:] {
+			data, err := ioutil.ReadFile(fn)
+			assert.NoError(err)
+			err = ioutil.WriteFile(filepath.Join(temp, filepath.Base(fn)), data, 0644)
+			assert.NoError(err)
+		}
+		state := mergeState{Committed: true, Merged: ids, Output: ids}
+		assert.NoError(writeMergeState(testdir, state))
+
+		verify(testdir)
+	})
+
+	t.Run("FailedFinish", func(t *testing.T) {
+		testdir := setup()
+
+		// Fails moving the committed merge output into place
+		obstruction := hintPath(testdir, 0)
+		assert.NoError(os.MkdirAll(filepath.Join(obstruction, "x"), 0755))
+
+		assert.Error(Merge(testdir, true))
+		_, err := os.Stat(filepath.Join(testdir, mergeMarker))
+		assert.NoError(err)
+		_, err = os.Stat(filepath.Join(testdir, mergeDirname))
+		assert.NoError(err)
+
+		assert.NoError(os.RemoveAll(obstruction))
+		verify(testdir)
+	})
+
+	t.Run("StrayOutput", func(t *testing.T) {
+		testdir := setup()
+
+		err := os.Mkdir(filepath.Join(testdir, mergeDirname), 0755)
+		assert.NoError(err)
+
+		verify(testdir)
+	})
+}
+
+func TestBulkLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(1024))
+	assert.NoError(err)
+
+	err = db.BulkLoad(func(put func(key string, value []byte) error) error {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("k%d", i)
+			if err := put(key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return put("k0", []byte("overwritten"))
+	})
+	assert.NoError(err)
+
+	check := func(db *Bitcask) {
+		assert.Equal(100, db.Len())
+		val, err := db.Get("k0")
+		assert.NoError(err)
+		assert.Equal([]byte("overwritten"), val)
+		for i := 1; i < 100; i++ {
+			key := fmt.Sprintf("k%d", i)
+			val, err := db.Get(key)
+			assert.NoError(err)
+			assert.Equal([]byte(key), val)
+		}
+	}
+
+	check(db)
+
+	t.Run("Error", func(t *testing.T) {
+		err := db.BulkLoad(func(put func(key string, value []byte) error) error {
+			if err := put("foo", []byte("bar")); err != nil {
+				return err
+			}
+			return put(strings.Repeat(" ", DefaultMaxKeySize+1), []byte("bar"))
+		})
+		assert.Equal(ErrKeyTooLarge, err)
+		assert.True(db.Has("foo"))
+		assert.NoError(db.Delete("foo"))
+	})
+
+	t.Run("Pending", func(t *testing.T) {
+		events := db.SubscribeKey("grouped")
+		defer db.Unsubscribe(events)
+
+		assert.NoError(db.PutGrouped("g", "grouped", []byte("pending")))
+		err = db.BulkLoad(func(put func(key string, value []byte) error) error {
+			return put("grouped", []byte("loaded"))
+		})
+		assert.NoError(err)
+		assert.NoError(db.FlushGroups())
+
+		val, err := db.Get("grouped")
+		assert.NoError(err)
+		assert.Equal([]byte("loaded"), val)
+		for _, expected := range []string{"pending", "loaded"} {
+			e := <-events
+			assert.Equal(EventPut, e.Type)
+			assert.Equal([]byte(expected), e.Value)
+		}
+		assert.NoError(db.Delete("grouped"))
+	})
+
+	assert.NoError(db.Close())
+
+	t.Run("Reopen", func(t *testing.T) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		check(db)
+	})
+}
+
+func TestPutGrouped(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(512))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 8; i++ {
+		assert.NoError(db.PutGrouped("a", fmt.Sprintf("a%d", i), []byte("foo")))
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte("bar")))
+		assert.NoError(db.PutGrouped("b", fmt.Sprintf("b%d", i), []byte("baz")))
+	}
+
+	val, err := db.Get("a3")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), val)
+	assert.True(db.Has("b3"))
+
+	assert.NoError(db.Sync())
+
+	for _, prefix := range []string{"a", "b"} {
+		first, ok := db.keydir.Get(prefix + "0")
+		assert.True(ok)
+
+		offset := first.Offset
+		for i := 0; i < 8; i++ {
+			item, ok := db.keydir.Get(fmt.Sprintf("%s%d", prefix, i))
+			assert.True(ok)
+			assert.Equal(first.FileID, item.FileID)
+			assert.Equal(offset, item.Offset)
+			offset += item.Size
+		}
+	}
+
+	t.Run("PutFlushes", func(t *testing.T) {
+		assert.NoError(db.PutGrouped("c", "c0", []byte("old")))
+		assert.NoError(db.Put("c0", []byte("new")))
+		assert.NoError(db.FlushGroups())
+
+		val, err := db.Get("c0")
+		assert.NoError(err)
+		assert.Equal([]byte("new"), val)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		err := db.PutGrouped("d", "d0", make([]byte, 512))
+		assert.Equal(ErrEntryTooLarge, errors.Cause(err))
+		assert.False(db.Has("d0"))
+	})
+
+	t.Run("ReusedBuffer", func(t *testing.T) {
+		buf := []byte("foo")
+		assert.NoError(db.PutGrouped("e", "e0", buf))
+		copy(buf, "bar")
+
+		val, err := db.Get("e0")
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), val)
+		assert.NoError(db.FlushGroups())
+		val, err = db.Get("e0")
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), val)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithExpiry(time.Hour))
+		assert.NoError(err)
+		defer db.Close()
+
+		// The expiry is that of the time of the write, not of the flush
+		assert.NoError(db.PutGrouped("f", "f0", []byte("foo")))
+		expiry := db.groups["f"].writes["f0"].expiry
+		assert.True(expiry > time.Now().Unix())
+		assert.NoError(db.FlushGroups())
+		item, ok := db.keydir.Get("f0")
+		assert.True(ok)
+		assert.Equal(expiry, item.Expiry)
+	})
+}
+
+func TestPutGroupedFailedFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	fi := &faultInjector{point: FaultWrite, after: 2}
+	db, err := Open(testdir, WithFaultInjector(fi))
+	assert.NoError(err)
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(db.PutGrouped("a", fmt.Sprintf("a%d", i), []byte("foo")))
+	}
+	assert.Equal(errInjected, errors.Cause(db.FlushGroups()))
+
+	// The writes not written out are kept and retried
+	for i := 0; i < 4; i++ {
+		val, err := db.Get(fmt.Sprintf("a%d", i))
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), val)
+	}
+	assert.Equal(2, db.Len())
+
+	fi.point = 0
+	assert.NoError(db.FlushGroups())
+	assert.Equal(4, db.Len())
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		val, err := db.Get(fmt.Sprintf("a%d", i))
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), val)
+	}
+}
+
+func TestTombstoneHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256), WithTombstoneHistory(2))
+	assert.NoError(err)
+
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(db.Put(key, []byte(key+"-value")))
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(db.Delete(key))
+	}
+
+	deletes := db.RecentDeletes()
+	assert.Len(deletes, 2)
+	assert.Equal("c", deletes[0].Key)
+	assert.Equal([]byte("c-value"), deletes[0].Value)
+	assert.Equal("b", deletes[1].Key)
+	assert.Equal([]byte("b-value"), deletes[1].Value)
+	assert.False(deletes[0].Time.IsZero())
+
+	// Force a rotation so the deletes above are in an immutable datafile
+	assert.NoError(db.Put("big", []byte(strings.Repeat(" ", 200))))
+	assert.NoError(db.Close())
+
+	t.Run("Merge", func(t *testing.T) {
+		err := Merge(testdir, true)
+		assert.NoError(err)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		db, err := Open(testdir, WithTombstoneHistory(2))
+		assert.NoError(err)
+		defer db.Close()
+
+		deletes := db.RecentDeletes()
+		assert.Len(deletes, 2)
+		assert.Equal("c", deletes[0].Key)
+		assert.Nil(deletes[0].Value)
+		assert.Equal("b", deletes[1].Key)
+		assert.Nil(deletes[1].Value)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Empty(db.RecentDeletes())
+	})
+}
+
+func TestDeletedKeysMerged(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+
+	value := []byte(strings.Repeat(" ", 24))
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Put("pad0", value))
+	assert.NoError(db.Delete("foo"))
+	assert.NoError(db.Put("pad1", value))
+	assert.NoError(db.Put("pad2", value))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.False(db.Has("foo"))
+	_, err = db.Get("foo")
+	assert.Equal(ErrKeyNotFound, err)
+}
+
+func TestReplaceWith(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(1024))
+	assert.NoError(err)
+	defer db.Close()
+
+	const N = 100
+
+	for i := 0; i < N; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte("old")))
+	}
+	assert.NoError(db.Put("stale", []byte("old")))
+
+	t.Run("ReplaceWith", func(t *testing.T) {
+		newdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		newdb, err := Open(newdir, WithMaxDatafileSize(1024))
+		assert.NoError(err)
+		for i := 0; i < N; i++ {
+			assert.NoError(newdb.Put(fmt.Sprintf("k%d", i), []byte("new")))
+		}
+		assert.NoError(newdb.Close())
+
+		var (
+			wg   sync.WaitGroup
+			stop = make(chan struct{})
+		)
+
+		reader := func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < N; i++ {
+					val, err := db.Get(fmt.Sprintf("k%d", i))
+					assert.NoError(err)
+					assert.Contains([]string{"old", "new"}, string(val))
+				}
+			}
+		}
+
+		wg.Add(4)
+		for i := 0; i < 4; i++ {
+			go reader()
+		}
+
+		err = db.ReplaceWith(newdir)
+		assert.NoError(err)
+
+		close(stop)
+		wg.Wait()
+
+		assert.Equal(N, db.Len())
+		assert.False(db.Has("stale"))
+		for i := 0; i < N; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte("new"), val)
+		}
+
+		assert.NoError(db.Put("foo", []byte("bar")))
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("Swap", func(t *testing.T) {
+		err := db.Swap(map[string][]byte{"hello": []byte("world")})
+		assert.NoError(err)
+
+		assert.Equal(1, db.Len())
+		val, err := db.Get("hello")
+		assert.NoError(err)
+		assert.Equal([]byte("world"), val)
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		newdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		newdb, err := Open(newdir)
+		assert.NoError(err)
+		defer newdb.Close()
+
+		err = db.ReplaceWith(newdir)
+		assert.Equal(ErrDatabaseLocked, err)
+	})
+}
+
+func TestReplaceWithFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("MoveBack", func(t *testing.T) {
+		src, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(src)
+		dst, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(dst)
+
+		fns := []string{datafilePath(src, 0), datafilePath(src, 1), datafilePath(src, 2)}
+		assert.NoError(ioutil.WriteFile(fns[0], []byte("foo"), 0644))
+		assert.NoError(ioutil.WriteFile(fns[2], []byte("bar"), 0644))
+
+		_, err = moveFiles(fns, dst)
+		assert.Error(err)
+
+		data, err := ioutil.ReadFile(fns[0])
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), data)
+		moved, err := ioutil.ReadDir(dst)
+		assert.NoError(err)
+		assert.Empty(moved)
+	})
+
+	t.Run("Fenced", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+		newdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(newdir)
+
+		newdb, err := Open(newdir)
+		assert.NoError(err)
+		assert.NoError(newdb.Put("foo", []byte("new")))
+		assert.NoError(newdb.Close())
+
+		db, err := Open(testdir, WithFencingToken(1))
+		assert.NoError(err)
+		defer db.Close()
+		assert.NoError(db.Put("foo", []byte("old")))
+
+		_, err = AdvanceEpoch(testdir)
+		assert.NoError(err)
+
+		assert.Equal(ErrFenced, db.ReplaceWith(newdir))
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("old"), val)
+
+		fns, err := internal.GetDatafiles(newdir)
+		assert.NoError(err)
+		assert.Len(fns, 1)
+	})
+}
+
+func TestMaxStaleness(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer func() { db.Close() }()
+
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Put("hello", []byte("world")))
+
+	const staleness = 50 * time.Millisecond
+
+	replica, err := Open(testdir, WithReadOnly(), WithMaxStaleness(staleness))
+	assert.NoError(err)
+	defer replica.Close()
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		assert.Equal(ErrReadOnly, replica.Put("foo", []byte("baz")))
+		assert.Equal(ErrReadOnly, replica.Delete("foo"))
+
+		val, err := replica.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		assert.NoError(db.Put("foo", []byte("baz")))
+		assert.NoError(db.Delete("hello"))
+
+		time.Sleep(2 * staleness)
+
+		val, err := replica.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), val)
+		assert.False(replica.Has("hello"))
+	})
+
+	t.Run("NewDatafiles", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(strings.Repeat("x", 16))))
+		}
+
+		time.Sleep(2 * staleness)
+
+		assert.Equal(db.Len(), replica.Len())
+		for i := 0; i < 50; i++ {
+			val, err := replica.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte(strings.Repeat("x", 16)), val)
+		}
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		other, err := Open(testdir, WithReadOnly())
+		assert.NoError(err)
+		defer other.Close()
+
+		assert.NoError(db.Put("foo", []byte("qux")))
+
+		val, err := other.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), val)
+
+		assert.NoError(other.Refresh())
+
+		val, err = other.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), val)
+	})
+
+	t.Run("Merged", func(t *testing.T) {
+		assert.NoError(db.Close())
+		assert.NoError(Merge(testdir, true))
+
+		db, err = Open(testdir, WithMaxDatafileSize(256))
+		assert.NoError(err)
+		assert.NoError(db.Put("foo", []byte("merged")))
+
+		assert.NoError(replica.Refresh())
+
+		val, err := replica.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("merged"), val)
+		assert.Equal(db.Len(), replica.Len())
+	})
+}
+
+func TestFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	const (
+		dirty  uint8 = 1 << 0
+		pinned uint8 = 1 << 1
+	)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+
+	assert.Equal(ErrReservedFlags, db.PutWithFlags("foo", []byte("bar"), FlagTombstone))
+	assert.Equal(ErrReservedFlags, db.PutWithFlags("foo", []byte("bar"), FlagCompressed|dirty))
+
+	assert.NoError(db.PutWithFlags("foo", []byte("bar"), dirty|pinned))
+	assert.NoError(db.PutWithFlags("hello", []byte("world"), pinned))
+	assert.NoError(db.Put("plain", []byte("value")))
+	assert.NoError(db.PutWithFlags("deleted", []byte("value"), dirty))
+	assert.NoError(db.Delete("deleted"))
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte("padding")))
+	}
+
+	check := func(db *Bitcask) {
+		flags, err := db.GetFlags("foo")
+		assert.NoError(err)
+		assert.Equal(dirty|pinned, flags)
+
+		flags, err = db.GetFlags("hello")
+		assert.NoError(err)
+		assert.Equal(pinned, flags)
+
+		flags, err = db.GetFlags("plain")
+		assert.NoError(err)
+		assert.Equal(uint8(0), flags)
+
+		_, err = db.GetFlags("deleted")
+		assert.Equal(ErrKeyNotFound, err)
+
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	}
+
+	check(db)
+
+	assert.NoError(db.Close())
+	db, err = Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	check(db)
+
+	assert.NoError(db.Close())
+	assert.NoError(Merge(testdir, true))
+	db, err = Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	check(db)
+	assert.NoError(db.Close())
+}
+
+func TestHintMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	populate := func(value string) {
+		db, err := Open(testdir, WithMaxDatafileSize(128))
+		assert.NoError(err)
+		for i := 0; i < 20; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(value)))
+		}
+		assert.NoError(db.Delete("k0"))
+		assert.NoError(db.Close())
+		assert.NoError(Merge(testdir, true))
+	}
+
+	hint := filepath.Join(testdir, "000000001.hint")
+
+	populate("old")
+	stale, err := ioutil.ReadFile(hint)
+	assert.NoError(err)
+
+	t.Run("Hinted", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(128), WithStrictHints())
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(19, db.Len())
+		assert.False(db.Has("k0"))
+		val, err := db.Get("k1")
+		assert.NoError(err)
+		assert.Equal([]byte("old"), val)
+	})
+
+	// Simulate a partial copy leaving an old hint behind for new datafiles.
+	fns, err := filepath.Glob(filepath.Join(testdir, "*.*"))
+	assert.NoError(err)
+	for _, fn := range fns {
+		assert.NoError(os.Remove(fn))
+	}
+	populate("new value")
+	assert.NoError(ioutil.WriteFile(hint, stale, 0644))
+
+	t.Run("Fallback", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(128))
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(19, db.Len())
+		for i := 1; i < 20; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte("new value"), val)
+		}
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		_, err := Open(testdir, WithMaxDatafileSize(128), WithStrictHints())
+		assert.Equal(ErrHintMismatch, err)
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(8192))
+		assert.NoError(err)
+		for i := 0; i < 100; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(strings.Repeat("v", 64))))
+		}
+		assert.NoError(db.Close())
+		assert.NoError(Merge(testdir, true))
+
+		// Corrupt the datafile before its final entries which Open checks
+		fn := datafilePath(testdir, 0)
+		data, err := ioutil.ReadFile(fn)
+		assert.NoError(err)
+		assert.True(len(data) > 4096)
+		i := bytes.Index(data, []byte("vvvv"))
+		assert.True(i > 0)
+		data[i] = 'x'
+		assert.NoError(ioutil.WriteFile(fn, data, 0644))
+
+		db, err = Open(testdir, WithMaxDatafileSize(8192), WithStrictHints())
+		assert.NoError(err)
+		defer db.Close()
+		assert.Equal(100, db.Len())
+
+		err = db.Verify()
+		assert.Equal(ErrHintMismatch, errors.Cause(err))
+	})
+}
+
+func TestCompressHints(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(1024))
+	assert.NoError(err)
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("key%d", i), []byte(strings.Repeat("v", 16))))
+	}
+	assert.NoError(db.Close())
+
+	plain, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	assert.NoError(copyDir(testdir, plain))
+	assert.NoError(Merge(plain, true))
+
+	assert.NoError(Merge(testdir, true, WithCompressHints()))
+
+	hint := hintPath(testdir, 1)
+	data, err := ioutil.ReadFile(hint)
+	assert.NoError(err)
+	assert.True(bytes.HasPrefix(data, []byte{0x1f, 0x8b}))
+	uncompressed, err := ioutil.ReadFile(hintPath(plain, 1))
+	assert.NoError(err)
+	assert.True(len(data) < len(uncompressed))
+
+	check := func(opts ...Option) {
+		db, err := Open(testdir, opts...)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(100, db.Len())
+		for i := 0; i < 100; i++ {
+			val, err := db.Get(fmt.Sprintf("key%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte(strings.Repeat("v", 16)), val)
+		}
+	}
+
+	t.Run("Hinted", func(t *testing.T) {
+		check(WithStrictHints())
+	})
+
+	data[len(data)/2] ^= 0xff
+	assert.NoError(ioutil.WriteFile(hint, data, 0644))
+
+	t.Run("Fallback", func(t *testing.T) {
+		check()
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		_, err := Open(testdir, WithStrictHints())
+		assert.Equal(ErrHintMismatch, err)
+	})
+}
+
+func TestSplitDatafile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	for i := 0; i < 50; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(strings.Repeat("v", 32))))
+	}
+	assert.NoError(db.Close())
+
+	const maxDatafileSize = 512
+
+	db, err = Open(testdir, WithMaxDatafileSize(maxDatafileSize))
+	assert.NoError(err)
+
+	assert.NoError(db.Put("k0", []byte("overwritten")))
+	assert.NoError(db.Delete("k1"))
+
+	stats := db.DatafileStats()
+	assert.Len(stats, 2)
+	assert.True(stats[0].Size > maxDatafileSize)
+	assert.True(stats[1].Active)
+
+	assert.Equal(ErrActiveDatafile, db.SplitDatafile(stats[1].FileID))
+	assert.Equal(ErrDatafileNotFound, db.SplitDatafile(42))
+
+	assert.NoError(db.SplitDatafile(stats[0].FileID))
+
+	check := func(db *Bitcask) {
+		stats := db.DatafileStats()
+		assert.True(len(stats) > 3)
+		for _, stat := range stats {
+			assert.NotEqual(0, stat.FileID)
+			assert.True(stat.Size <= maxDatafileSize)
+		}
+
+		assert.Equal(49, db.Len())
+		assert.False(db.Has("k1"))
+
+		val, err := db.Get("k0")
+		assert.NoError(err)
+		assert.Equal([]byte("overwritten"), val)
+
+		for i := 2; i < 50; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte(strings.Repeat("v", 32)), val)
+		}
+	}
+
+	check(db)
+
+	assert.NoError(db.Put("k2", []byte("after split")))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithMaxDatafileSize(maxDatafileSize))
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err := db.Get("k2")
+	assert.NoError(err)
+	assert.Equal([]byte("after split"), val)
+	assert.NoError(db.Put("k2", []byte(strings.Repeat("v", 32))))
+
+	check(db)
+}
+
+func TestMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxKeySize(128), WithMaxValueSize(1024))
+	assert.NoError(err)
+	assert.NoError(db.Put(strings.Repeat("k", 100), []byte(strings.Repeat("v", 1000))))
+	assert.NoError(db.Close())
+
+	t.Run("Adopt", func(t *testing.T) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.NoError(db.Put(strings.Repeat("x", 100), []byte(strings.Repeat("v", 1000))))
+		assert.Equal(ErrValueTooLarge, db.Put("foo", []byte(strings.Repeat("v", 1025))))
+	})
+
+	t.Run("Raise", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxValueSize(2048))
+		assert.NoError(err)
+		assert.NoError(db.Put("foo", []byte(strings.Repeat("v", 2000))))
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Len(val, 2000)
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		_, err := Open(testdir, WithMaxValueSize(16))
+		assert.Error(err)
+		assert.Equal(ErrOptionMismatch, errors.Cause(err))
+		assert.Contains(err.Error(), "max value size 16 is smaller than the database's 2048")
+
+		_, err = Open(testdir, WithMaxKeySize(16))
+		assert.Equal(ErrOptionMismatch, errors.Cause(err))
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		assert.NoError(db.Close())
+	})
+
+	stored := func() meta {
+		data, err := ioutil.ReadFile(filepath.Join(testdir, metaFilename))
+		assert.NoError(err)
+		var m meta
+		assert.NoError(json.Unmarshal(data, &m))
+		return m
+	}
+
+	t.Run("Creation", func(t *testing.T) {
+		// The options the database was created with are kept
+		db, err := Open(testdir, WithMaxDatafileSize(4096))
+		assert.NoError(err)
+		assert.NoError(db.Close())
+
+		assert.Equal(meta{
+			MaxDatafileSize: DefaultMaxDatafileSize,
+			MaxKeySize:      128,
+			MaxValueSize:    2048,
+		}, stored())
+	})
+
+	t.Run("FailedOpen", func(t *testing.T) {
+		// A datafile that can't be read fails the Open
+		fn := datafilePath(testdir, 99)
+		assert.NoError(os.Mkdir(fn, 0755))
+		defer os.Remove(fn)
+
+		before := stored()
+		_, err := Open(testdir, WithMaxValueSize(4096))
+		assert.Error(err)
+		assert.Equal(before, stored())
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+		assert.NoError(os.Mkdir(datafilePath(testdir, 0), 0755))
+
+		_, err = Open(testdir)
+		assert.Error(err)
+		_, err = os.Stat(filepath.Join(testdir, metaFilename))
+		assert.True(os.IsNotExist(err))
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	foo := db.SubscribeKey("foo")
+	users := db.SubscribePrefix("user/")
+
+	assert.NoError(db.Put("foo", []byte("1")))
+	assert.NoError(db.Put("bar", []byte("2")))
+	assert.NoError(db.Put("user/alice", []byte("3")))
+	assert.NoError(db.Delete("foo"))
+	assert.NoError(db.Delete("user/alice"))
+
+	next := func(ch <-chan Event) Event {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+			return Event{}
+		}
+	}
+
+	assert.Equal(Event{Type: EventPut, Key: "foo", Value: []byte("1")}, next(foo))
+	assert.Equal(Event{Type: EventDelete, Key: "foo"}, next(foo))
+	assert.Len(foo, 0)
+
+	assert.Equal(Event{Type: EventPut, Key: "user/alice", Value: []byte("3")}, next(users))
+	assert.Equal(Event{Type: EventDelete, Key: "user/alice"}, next(users))
+	assert.Len(users, 0)
+
+	db.Unsubscribe(foo)
+	assert.NoError(db.Put("foo", []byte("4")))
+
+	_, ok := <-foo
+	assert.False(ok)
+	assert.Len(db.subscribers.subs, 1)
+
+	db.Unsubscribe(users)
+	_, ok = <-users
+	assert.False(ok)
+	assert.Len(db.subscribers.subs, 0)
+}
+
+func TestRecentKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	assert.Empty(db.RecentKeys(10))
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(db.Put(key, []byte(key)))
+	}
+	assert.Equal([]string{"e", "d", "c", "b", "a"}, db.RecentKeys(10))
+	assert.Equal([]string{"e", "d"}, db.RecentKeys(2))
+
+	// Overwrites move a key to the front, reads don't and deletes remove it
+	assert.NoError(db.Put("b", []byte("b")))
+	_, err = db.Get("a")
+	assert.NoError(err)
+	assert.NoError(db.Delete("d"))
+	assert.Equal([]string{"b", "e", "c", "a"}, db.RecentKeys(10))
+
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal([]string{"b", "e", "c", "a"}, db.RecentKeys(10))
+}
+
+func TestCompactOnRead(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	const threshold = 5
+
+	db, err := Open(testdir, WithMaxDatafileSize(256), WithCompactOnRead(threshold))
+	assert.NoError(err)
+
+	value := []byte(strings.Repeat("v", 32))
+	for i := 0; i < 20; i++ {
+		assert.NoError(db.Put("hot", value))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("cold%d", i), value))
+	}
+
+	item, _ := db.keydir.Get("hot")
+	assert.Equal(uint16(19), item.Overwrites)
+	assert.NotEqual(db.curr.FileID(), item.FileID)
+
+	val, err := db.Get("hot")
+	assert.NoError(err)
+	assert.Equal(value, val)
+
+	item, _ = db.keydir.Get("hot")
+	assert.Equal(uint16(0), item.Overwrites)
+	assert.Equal(db.curr.FileID(), item.FileID)
+
+	// Consolidated keys aren't rewritten again until overwritten enough.
+	size := db.curr.Size()
+	for i := 0; i < threshold; i++ {
+		_, err := db.Get("hot")
+		assert.NoError(err)
+	}
+	assert.Equal(size, db.curr.Size())
+
+	diskSize := func() int64 {
+		var total int64
+		for _, stat := range db.DatafileStats() {
+			total += stat.Size
+		}
+		return total
+	}
+
+	before := diskSize()
+	assert.NoError(db.Close())
+	assert.NoError(Merge(testdir, true))
+
+	db, err = Open(testdir, WithMaxDatafileSize(256), WithCompactOnRead(threshold))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.True(diskSize() < before/2)
+
+	for _, key := range []string{"hot", "cold0", "cold9"} {
+		val, err := db.Get(key)
+		assert.NoError(err)
+		assert.Equal(value, val)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for _, key := range []string{"foo", "fooz", "foobaz", "fob", "f?o", "fao", "bar", "baz", "foo*z", "user:1", "user:22"} {
+		assert.NoError(db.Put(key, []byte(key)))
+	}
+
+	match := func(pattern string) []string {
+		var keys []string
+		assert.NoError(db.Match(pattern, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		return keys
+	}
+
+	regexMatch := func(expr string) []string {
+		var keys []string
+		assert.NoError(db.RegexMatch(expr, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		return keys
+	}
+
+	assert.Equal([]string{"foo*z", "foobaz", "fooz"}, match("foo*z"))
+	assert.Equal([]string{"f?o", "fao", "foo"}, match("f?o"))
+	assert.Equal([]string{"f?o"}, match(`f\?o`))
+	assert.Equal([]string{"bar", "baz"}, match("ba[rz]"))
+	assert.Equal([]string{"baz"}, match("ba[^r]"))
+	assert.Equal([]string{"fao", "fob", "foo"}, match("f[a-o][bo]"))
+	assert.Equal([]string{"baz", "foo*z", "foobaz", "fooz"}, match("*z"))
+	assert.Equal([]string{"bar"}, match("bar"))
+	assert.Empty(match("qux*"))
+
+	assert.Equal([]string{"user:1", "user:22"}, regexMatch(`^user:[0-9]+$`))
+	assert.Equal([]string{"foobaz", "fooz"}, regexMatch(`^foo[a-z]+$`))
+	assert.Equal([]string{"bar", "baz", "foobaz"}, regexMatch(`ba`))
+
+	err = db.RegexMatch("(", func(key string) error { return nil })
+	assert.Error(err)
+
+	// Deleting a key must not affect other keys sharing its prefix
+	assert.NoError(db.Delete("foo"))
+	assert.Equal([]string{"foo*z", "foobaz", "fooz"}, match("foo*"))
+	assert.NoError(db.Delete("foobaz"))
+	assert.Equal([]string{"foo*z", "fooz"}, match("foo*"))
+}
+
+func TestGroupCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	_, err = Open(testdir, WithGroupCommit(time.Millisecond, 0))
+	assert.Error(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(4096), WithGroupCommit(5*time.Millisecond, 16))
+	assert.NoError(err)
+
+	const (
+		writers = 8
+		writes  = 50
+	)
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		acked []string
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				key := fmt.Sprintf("w%d-%d", i, j)
+				if err := db.Put(key, []byte(key)); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				acked = append(acked, key)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	start := time.Now()
+	assert.NoError(db.Delete("w0-0"))
+	assert.True(time.Since(start) < time.Second)
+
+	// Simulate a crash by abandoning the database without closing it
+	assert.NoError(db.Flock.Unlock())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal(writers*writes-1, db.Len())
+	for _, key := range acked {
+		if key == "w0-0" {
+			continue
+		}
+		val, err := db.Get(key)
+		assert.NoError(err)
+		assert.Equal([]byte(key), val)
+	}
+	assert.False(db.Has("w0-0"))
+
+	t.Run("Close", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithGroupCommit(time.Millisecond, 16))
+		assert.NoError(err)
+
+		// A write the committer is stopped before syncing is only
+		// acknowledged once Close has synced it
+		db.stopCommitter()
+		done := make(chan error)
+		go func() {
+			done <- db.commit()
+		}()
+		select {
+		case <-done:
+			t.Fatal("commit returned before Close")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		// Close stops the (stopped) committer again
+		db.committer.quit = make(chan struct{})
+		assert.NoError(db.Close())
+		assert.NoError(<-done)
+	})
+}
+
+func TestExportSince(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	assert.NoError(db.Put("a", []byte("1")))
+	assert.NoError(db.Put("b", []byte("1")))
+	assert.NoError(db.Put("c", []byte("1")))
+	assert.NoError(db.Delete("c"))
+
+	baseline := db.Sequence()
+	assert.Equal(uint64(4), baseline)
+
+	// Deleted keys are exported as tombstones (with an empty value)
+	exported := func(seq uint64) map[string]string {
+		var buf bytes.Buffer
+		assert.NoError(db.ExportSince(seq, &buf))
+		assert.True(bytes.HasPrefix(buf.Bytes(), exportMagic))
+
+		kv := make(map[string]string)
+		dec := streampb.NewDecoder(bytes.NewReader(buf.Bytes()[len(exportMagic):]))
+		for {
+			var e pb.Entry
+			if _, err := dec.Decode(&e); err != nil {
+				assert.Equal(io.EOF, err)
+				return kv
+			}
+			assert.True(e.Sequence > seq)
+			assert.Equal(len(e.Value) == 0, e.Flags&uint32(FlagTombstone) != 0)
+			kv[e.Key] = string(e.Value)
+		}
+	}
+
+	assert.Equal(map[string]string{"a": "1", "b": "1", "c": ""}, exported(0))
+	assert.Equal(map[string]string{"c": ""}, exported(baseline-1))
+	assert.Empty(exported(baseline))
+
+	assert.NoError(db.Put("b", []byte("2")))
+	assert.NoError(db.Put("d", []byte("1")))
+	assert.NoError(db.Close())
+
+	// Sequence numbers survive merges (and hint files) and reopens
+	assert.NoError(Merge(testdir, true))
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal(baseline+2, db.Sequence())
+	assert.NoError(db.Put("e", []byte("1")))
+
+	assert.Equal(map[string]string{"b": "2", "d": "1", "e": "1"}, exported(baseline))
+	assert.Equal(map[string]string{"e": "1"}, exported(baseline+2))
+
+	// Keys deleted and written again are exported with their value
+	assert.NoError(db.Delete("e"))
+	assert.Equal(map[string]string{"e": ""}, exported(baseline+2))
+	assert.NoError(db.Put("e", []byte("2")))
+	assert.Equal(map[string]string{"e": "2"}, exported(baseline+2))
+
+	t.Run("SlowWriter", func(t *testing.T) {
+		r, w := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := db.ExportSince(baseline, w)
+			w.CloseWithError(err)
+			done <- err
+		}()
+
+		// The export is blocked writing its first entry
+		_, err := r.Read(make([]byte, 1))
+		assert.NoError(err)
+		assert.NoError(db.Put("f", []byte("1")))
+
+		_, err = io.Copy(ioutil.Discard, r)
+		assert.NoError(err)
+		assert.NoError(<-done)
+	})
+
+	t.Run("Checksum", func(t *testing.T) {
+		assert.NoError(db.Put("g", []byte("corrupted")))
+		assert.NoError(db.Sync())
+
+		fn := datafilePath(testdir, db.curr.FileID())
+		data, err := ioutil.ReadFile(fn)
+		assert.NoError(err)
+		i := bytes.LastIndex(data, []byte("corrupted"))
+		assert.True(i > 0)
+		data[i] = 'x'
+		assert.NoError(ioutil.WriteFile(fn, data, 0644))
+
+		err = db.ExportSince(baseline, ioutil.Discard)
+		assert.Equal(ErrChecksumFailed, err)
+	})
+}
+
+func TestApply(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(filepath.Join(testdir, "db"))
+	assert.NoError(err)
+	defer func() {
+		db.Close()
+	}()
+
+	assert.NoError(db.Put("a", []byte("1")))
+	assert.NoError(db.Put("b", []byte("1")))
+	assert.NoError(db.Put("c", []byte("1")))
+
+	var backup bytes.Buffer
+	assert.NoError(db.Backup(&backup))
+	seq := db.Sequence()
+
+	restored := filepath.Join(testdir, "restored")
+	assert.NoError(Restore(restored, &backup))
+	db2, err := Open(restored)
+	assert.NoError(err)
+	defer func() {
+		db2.Close()
+	}()
+
+	assert.NoError(db.Put("b", []byte("2")))
+	assert.NoError(db.Delete("c"))
+	assert.NoError(db.Put("d", []byte("1")))
+	tx := db.Transaction()
+	assert.NoError(tx.Delete("a"))
+	assert.NoError(tx.Put("e", []byte("1")))
+	assert.NoError(tx.Commit())
+
+	contents := func(db *Bitcask) map[string]string {
+		kv := make(map[string]string)
+		assert.NoError(db.Fold(func(key string) error {
+			value, err := db.Get(key)
+			kv[key] = string(value)
+			return err
+		}))
+		return kv
+	}
+	expected := map[string]string{"b": "2", "d": "1", "e": "1"}
+	assert.Equal(expected, contents(db))
+
+	var export bytes.Buffer
+	assert.NoError(db.ExportSince(seq, &export))
+	data := export.Bytes()
+
+	assert.NoError(db2.Apply(bytes.NewReader(data)))
+	assert.Equal(expected, contents(db2))
+	assert.Equal(db.Sequence(), db2.Sequence())
+
+	// Applying an export again is harmless and the deletes persist
+	assert.NoError(db2.Apply(bytes.NewReader(data)))
+	assert.NoError(db2.Close())
+	db2, err = Open(restored)
+	assert.NoError(err)
+	assert.Equal(expected, contents(db2))
+
+	// The deletes are known from the tombstones on disk after a reopen
+	assert.NoError(db.Close())
+	db, err = Open(filepath.Join(testdir, "db"))
+	assert.NoError(err)
+	export.Reset()
+	assert.NoError(db.ExportSince(seq, &export))
+	assert.Equal(data, export.Bytes())
+
+	t.Run("Invalid", func(t *testing.T) {
+		backup.Reset()
+		assert.NoError(db.Backup(&backup))
+		assert.Equal(ErrInvalidExport, db2.Apply(&backup))
+	})
+}
+
+func TestCounterRegion(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	n, err := db.Incr("hits", 2)
+	assert.NoError(err)
+	assert.Equal(int64(2), n)
+
+	assert.NoError(db.Put("name", []byte("foo")))
+	_, err = db.Incr("name", 1)
+	assert.Equal(ErrNotInteger, err)
+	assert.NoError(db.Close())
+
+	_, err = Open(testdir, WithCounterRegion(time.Millisecond, "name"))
+	assert.Equal(ErrNotInteger, err)
+
+	// The existing value of hits is moved to the counter region
+	db, err = Open(testdir, WithCounterRegion(time.Hour, "hits", "misses"))
+	assert.NoError(err)
+
+	for i := 0; i < 100; i++ {
+		_, err := db.Incr("hits", 1)
+		assert.NoError(err)
+	}
+	n, err = db.Incr("misses", -1)
+	assert.NoError(err)
+	assert.Equal(int64(-1), n)
+
+	value, err := db.Get("hits")
+	assert.NoError(err)
+	assert.Equal([]byte("102"), value)
+	assert.True(db.Has("misses"))
+	assert.Equal(1, db.Len())
+
+	assert.Equal(ErrCounterKey, db.Put("hits", []byte("0")))
+	assert.Equal(ErrCounterKey, db.Delete("hits"))
+
+	// Increments are not appended to the datafiles
+	stats := db.DatafileStats()
+	size := stats[len(stats)-1].Size
+	_, err = db.Incr("hits", 1)
+	assert.NoError(err)
+	stats = db.DatafileStats()
+	assert.Equal(size, stats[len(stats)-1].Size)
+
+	// Counters are checkpointed by Sync and survive reopening, even without
+	// registering them again
+	assert.NoError(db.Sync())
+
+	r, err := Open(testdir, WithReadOnly())
+	assert.NoError(err)
+	value, err = r.Get("hits")
+	assert.NoError(err)
+	assert.Equal([]byte("103"), value)
+	assert.NoError(r.Close())
+
+	_, err = db.Incr("misses", -1)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	value, err = db.Get("misses")
+	assert.NoError(err)
+	assert.Equal([]byte("-2"), value)
+
+	n, err = db.Incr("hits", 1)
+	assert.NoError(err)
+	assert.Equal(int64(104), n)
+
+	t.Run("InterruptedMove", func(t *testing.T) {
+		// As left behind by a crash after the counter was moved to the
+		// region but before it was removed from the datafiles
+		db.mu.Lock()
+		item, err := db.put("hits", []byte("42"), 0, 0)
+		db.keydir.Overwrite("hits", item)
+		db.mu.Unlock()
+		assert.NoError(err)
+		assert.NoError(db.Close())
+
+		for i := 0; i < 2; i++ {
+			db, err = Open(testdir)
+			assert.NoError(err)
+			value, err := db.Get("hits")
+			assert.NoError(err)
+			assert.Equal([]byte("104"), value)
+			_, ok := db.keydir.Get("hits")
+			assert.False(ok)
+			assert.NoError(db.SelfTest())
+			assert.NoError(db.Close())
+		}
+	})
+}
+
+func TestSelfTest(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("foo%d", i%20)
+		assert.NoError(db.Put(key, []byte(fmt.Sprintf("bar%d", i))))
+		if i%7 == 0 {
+			assert.NoError(db.Delete(key))
+		}
+	}
+	assert.NoError(db.SelfTest())
+	assert.NoError(db.Close())
+
+	assert.NoError(Merge(testdir, true))
+
+	db, err = Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.SelfTest())
+	assert.NoError(db.Delete("foo1"))
+	assert.NoError(db.SelfTest())
+
+	// Expired keys are neither counted by Len nor yielded by Keys (the
+	// key is expired as if it had been written with a TTL long ago)
+	n := db.Len()
+	assert.NoError(db.PutWithTTL("ttl", []byte("ttl"), time.Hour))
+	assert.Equal(n+1, db.Len())
+	item, ok := db.keydir.Get("ttl")
+	assert.True(ok)
+	item.Expiry = time.Now().Add(-time.Hour).Unix()
+	db.keydir.Add("ttl", item)
+	assert.Equal(n, db.Len())
+	var keys int
+	for range db.Keys() {
+		keys++
+	}
+	assert.Equal(n, keys)
+	assert.NoError(db.SelfTest())
+
+	item, ok = db.keydir.Get("foo3")
+	assert.True(ok)
+	db.keydir.Add("ghost", item)
+	db.trie.Add("phantom")
+
+	err = db.SelfTest()
+	assert.Equal(ErrInconsistent, errors.Cause(err))
+	assert.Contains(err.Error(), `key "ghost" refers to the entry of key "foo3"`)
+	assert.Contains(err.Error(), `key "phantom" is in the prefix index but not the keydir`)
+}
+
+func TestEagerCloseDatafiles(t *testing.T) {
+	assert := assert.New(t)
+
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("no /proc/self/fd to count open files")
+	}
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	// openDatafiles counts the open file descriptors of datafiles
+	openDatafiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		assert.NoError(err)
+
+		var n int
+		for _, fd := range fds {
+			fn, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+			if err == nil && strings.HasPrefix(fn, testdir) && strings.HasSuffix(fn, ".data") {
+				n++
+			}
+		}
+		return n
+	}
+
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithEagerCloseDatafiles())
+	assert.NoError(err)
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("foo%d", i), []byte("bar")))
+	}
+	assert.True(len(db.DatafileStats()) > 10)
+
+	// Only the active datafile is open (for writing and reading)
+	assert.Equal(2, openDatafiles())
+	for i := 0; i < 20; i++ {
+		val, err := db.Get(fmt.Sprintf("foo%d", i))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+		assert.Equal(2, openDatafiles())
+	}
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithEagerCloseDatafiles())
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal(2, openDatafiles())
+	val, err := db.Get("foo0")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+	assert.Equal(2, openDatafiles())
+}
+
+func TestMove(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	src := filepath.Join(testdir, "src")
+	dst := filepath.Join(testdir, "dst")
+
+	db, err := Open(src, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("foo%d", i), []byte("bar")))
+	}
+
+	assert.Equal(ErrDatabaseLocked, Move(src, dst))
+	assert.NoError(db.Close())
+
+	assert.NoError(os.Mkdir(dst, 0755))
+	assert.Error(Move(src, dst))
+	assert.NoError(os.Remove(dst))
+
+	assert.NoError(Move(src, dst))
+	_, err = os.Stat(src)
+	assert.True(os.IsNotExist(err))
+
+	// Copying (as when moving across filesystems) leaves an identical
+	// database behind
+	copied := filepath.Join(testdir, "copy")
+	assert.NoError(copyDir(dst, copied))
+
+	for _, path := range []string{dst, copied} {
+		db, err = Open(path)
+		assert.NoError(err)
+		assert.Equal(10, db.Len())
+		for i := 0; i < 10; i++ {
+			val, err := db.Get(fmt.Sprintf("foo%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		}
+		assert.NoError(db.Close())
+	}
+}
+
+func TestGetView(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("foo%d", i), []byte(fmt.Sprintf("bar%d", i))))
+	}
+
+	_, _, err = db.GetView("missing")
+	assert.Equal(ErrKeyNotFound, err)
+
+	// foo0 is in an older (mapped) datafile, foo9 in the active datafile
+	var releases []func()
+	for _, key := range []string{"foo0", "foo9"} {
+		val, release, err := db.GetView(key)
+		assert.NoError(err)
+		assert.Equal([]byte("bar"+key[3:]), val)
+		releases = append(releases, release)
+	}
+
+	view, release, err := db.GetView("foo1")
+	assert.NoError(err)
+
+	// Views outlive the datafiles they were taken from
+	assert.NoError(db.Swap(map[string][]byte{"foo1": []byte("baz")}))
+	assert.Equal([]byte("bar1"), view)
+	release()
+
+	val, err := db.Get("foo1")
+	assert.NoError(err)
+	assert.Equal([]byte("baz"), val)
+
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestMergeLocked(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(48))
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put("foo", []byte(fmt.Sprintf("bar%d", i))))
+	}
+
+	// A database open in this process is refused even with a timeout
+	assert.Equal(ErrDatabaseOpen, Merge(testdir, true))
+	assert.Equal(ErrDatabaseOpen, MergeWithOptions(testdir, WithMergeLockTimeout(time.Second)))
+	assert.NoError(db.Close())
+
+	// Another process holding the lock (simulated by taking it directly)
+	lock := flock.New(filepath.Join(testdir, "lock"))
+	locked, err := lock.TryLock()
+	assert.NoError(err)
+	assert.True(locked)
+
+	assert.Equal(ErrDatabaseLocked, Merge(testdir, true))
+
+	start := time.Now()
+	err = MergeWithOptions(testdir, WithMergeForce(), WithMergeLockTimeout(50*time.Millisecond))
+	assert.Equal(ErrDatabaseLocked, err)
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lock.Unlock()
+	}()
+	assert.NoError(MergeWithOptions(testdir, WithMergeForce(), WithMergeLockTimeout(time.Second)))
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err := db.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("bar9"), val)
+
+	_, err = os.Stat(hintPath(testdir, 0))
+	assert.NoError(err)
+}
+
+func TestFoldWithLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(128))
+	assert.NoError(err)
+	defer db.Close()
+
+	// The active datafile after each put is the one the key was written to
+	written := make(map[string]int)
+	put := func(key string) {
+		assert.NoError(db.Put(key, []byte(strings.Repeat("x", 32))))
+		stats := db.DatafileStats()
+		written[key] = stats[len(stats)-1].FileID
+	}
+	for i := 0; i < 20; i++ {
+		put(fmt.Sprintf("foo%d", i))
+	}
+	put("foo3")
+	put("foo7")
+	assert.NoError(db.Delete("foo5"))
+	delete(written, "foo5")
+
+	sizes := make(map[int]int64)
+	for _, stat := range db.DatafileStats() {
+		sizes[stat.FileID] = stat.Size
+	}
+
+	located := make(map[string]int)
+	assert.NoError(db.FoldWithLocation(func(key string, info KeyInfo) error {
+		located[key] = info.FileID
+		assert.True(info.Size > 0)
+		assert.True(info.Offset+info.Size <= sizes[info.FileID])
+		return nil
+	}))
+	assert.Equal(written, located)
+	assert.True(len(sizes) > 5)
+
+	errStop := errors.New("stop")
+	var n int
+	assert.Equal(errStop, db.FoldWithLocation(func(key string, info KeyInfo) error {
+		n++
+		return errStop
+	}))
+	assert.Equal(1, n)
+}
+
+var errInjected = errors.New("injected fault")
+
+// faultInjector fails the write (or operation) at its fault point after
+// the given number of successful ones, writing only `keep` bytes of it, or
+// panics (simulating a crash) if `crash` is set.
+type faultInjector struct {
+	point FaultPoint
+	after int
+	keep  int
+	crash bool
+
+	calls int
+}
+
+func (fi *faultInjector) Fault(point FaultPoint, p []byte) (int, error) {
+	if point != fi.point {
+		return len(p), nil
+	}
+	fi.calls++
+	if fi.calls <= fi.after {
+		return len(p), nil
+	}
+	if fi.crash {
+		panic(errInjected)
+	}
+	return fi.keep, errInjected
+}
+
+func TestFaultInjector(t *testing.T) {
+	assert := assert.New(t)
+
+	setup := func() string {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir, WithMaxDatafileSize(64))
+		assert.NoError(err)
+		for i := 0; i < 20; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("foo%d", i%10), []byte(fmt.Sprintf("bar%d", i))))
+		}
+		assert.NoError(db.Close())
+		return testdir
+	}
+
+	verify := func(testdir string, n int) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.NoError(db.SelfTest())
+		assert.Equal(n, db.Len())
+		for i := 10; i < 20; i++ {
+			val, err := db.Get(fmt.Sprintf("foo%d", i%10))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("bar%d", i)), val)
+		}
+	}
+
+	t.Run("TornMergeWrite", func(t *testing.T) {
+		testdir := setup()
+
+		fi := &faultInjector{point: FaultMergeWrite, after: 3, keep: 5}
+		assert.Equal(errInjected, errors.Cause(Merge(testdir, true, WithFaultInjector(fi))))
+
+		_, err := os.Stat(filepath.Join(testdir, mergeDirname))
+		assert.True(os.IsNotExist(err))
+		verify(testdir, 10)
+	})
+
+	t.Run("CrashBeforeMergeCommit", func(t *testing.T) {
+		testdir := setup()
+
+		fi := &faultInjector{point: FaultMergeCommit, crash: true}
+		assert.Panics(func() {
+			Merge(testdir, true, WithFaultInjector(fi))
+		})
+
+		// The uncommitted merge output is left behind as after a crash and
+		// discarded by Open
+		_, err := os.Stat(filepath.Join(testdir, mergeMarker))
+		assert.NoError(err)
+		verify(testdir, 10)
+		_, err = os.Stat(filepath.Join(testdir, mergeMarker))
+		assert.True(os.IsNotExist(err))
+	})
+
+	t.Run("FailedWrite", func(t *testing.T) {
+		testdir := setup()
+
+		fi := &faultInjector{point: FaultWrite}
+		db, err := Open(testdir, WithFaultInjector(fi))
+		assert.NoError(err)
+		assert.Equal(errInjected, errors.Cause(db.Put("foo0", []byte("lost"))))
+		assert.NoError(db.Close())
+
+		verify(testdir, 10)
+	})
+
+	t.Run("FailedRotate", func(t *testing.T) {
+		testdir := setup()
+
+		fi := &faultInjector{point: FaultRotate}
+		db, err := Open(testdir, WithMaxDatafileSize(64), WithFaultInjector(fi))
+		assert.NoError(err)
+		var written int
+		for i := 0; i < 10; i++ {
+			if err = db.Put(fmt.Sprintf("new%d", i), []byte("value")); err != nil {
+				break
+			}
+			written++
+		}
+		assert.Equal(errInjected, err)
+		db.Close()
+
+		// The keys written before the failed rotation are intact
+		verify(testdir, 10+written)
+	})
+}
+
+func TestKeyCollision(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	metrics := &testMetrics{}
+	db, err := Open(testdir, WithMaxVersions(2), WithMaxDatafileSize(64), WithMetrics(metrics))
+	assert.NoError(err)
+	defer db.Close()
+	metrics.db = db
+
+	assert.NoError(db.Put("foo", []byte("foo")))
+	assert.NoError(db.Put("bar", []byte("bar")))
+	assert.NoError(db.Put("qux", []byte("qux")))
+
+	collisions := func() int {
+		metrics.Lock()
+		defer metrics.Unlock()
+		return metrics.collisions
+	}
+
+	// Simulate colliding keys by pointing foo, which has an older version,
+	// and baz, which doesn't, at the entry of bar
+	item, ok := db.keydir.Get("bar")
+	assert.True(ok)
+	assert.NotEqual(db.curr.FileID(), item.FileID)
+	db.keydir.Overwrite("foo", item)
+	db.keydir.Overwrite("baz", item)
+
+	val, err := db.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), val)
+	assert.Equal(1, collisions())
+
+	_, err = db.Get("baz")
+	assert.Equal(ErrKeyNotFound, err)
+	assert.Equal(2, collisions())
+
+	val, release, err := db.GetView("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), val)
+	release()
+	assert.Equal(3, collisions())
+
+	values, err := db.GetMulti([]string{"foo", "bar", "baz"})
+	assert.NoError(err)
+	assert.Equal(map[string][]byte{"foo": []byte("foo"), "bar": []byte("bar")}, values)
+	assert.Equal(5, collisions())
+
+	_, err = db.GetReader("baz")
+	assert.Equal(ErrKeyNotFound, err)
+	assert.Equal(6, collisions())
+
+	versions, err := db.GetVersions("foo")
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("foo")}, versions)
+
+	val, err = db.Get("bar")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+}
+
+func TestScanParallel(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("foo%d", i), []byte("foo")))
+		assert.NoError(db.Put(fmt.Sprintf("bar%d", i), []byte("bar")))
+	}
+
+	t.Run("All", func(t *testing.T) {
+		var mu sync.Mutex
+		seen := make(map[string]int)
+		err := db.ScanParallel("foo", 8, func(key string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[key]++
+			return nil
+		})
+		assert.NoError(err)
+		assert.Len(seen, 1000)
+		for key, n := range seen {
+			assert.True(strings.HasPrefix(key, "foo"))
+			assert.Equal(1, n, key)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		var (
+			mu sync.Mutex
+			n  int
+		)
+		stop := errors.New("stop")
+		err := db.ScanParallel("bar", 4, func(key string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			n++
+			if n == 10 {
+				return stop
+			}
+			return nil
+		})
+		assert.Equal(stop, err)
+		mu.Lock()
+		assert.True(n < 1000)
+		mu.Unlock()
+	})
+}
+
+func TestCompactDatafile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+
+	value := []byte(strings.Repeat("v", 32))
+	for i := 0; i < 30; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), value))
+	}
+	assert.NoError(db.Put("k0", []byte("overwritten")))
+	assert.NoError(db.Delete("k5"))
+	stats := db.DatafileStats()
+	deleted := stats[len(stats)-1].FileID
+	for i := 30; i < 40; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), value))
+	}
+
+	stats = db.DatafileStats()
+	assert.Equal(0, stats[0].FileID)
+	assert.Equal(ErrActiveDatafile, db.CompactDatafile(stats[len(stats)-1].FileID))
+	assert.Equal(ErrDatafileNotFound, db.CompactDatafile(42))
+
+	assert.NoError(db.CompactDatafile(0))
+
+	after := db.DatafileStats()
+	assert.NotEqual(0, after[0].FileID)
+	for _, stat := range stats[1 : len(stats)-1] {
+		assert.Contains(after, stat)
+	}
+	_, err = os.Stat(datafilePath(testdir, 0))
+	assert.True(os.IsNotExist(err))
+
+	// The tombstone deletes k5 in an older datafile so must be kept
+	assert.NoError(db.CompactDatafile(deleted))
+
+	check := func(db *Bitcask) {
+		assert.Equal(39, db.Len())
+		assert.False(db.Has("k5"))
+
+		val, err := db.Get("k0")
+		assert.NoError(err)
+		assert.Equal([]byte("overwritten"), val)
+
+		for i := 1; i < 40; i++ {
+			if i == 5 {
+				continue
+			}
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+		assert.NoError(db.SelfTest())
+	}
+
+	check(db)
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer db.Close()
+	check(db)
+}
+
+// slowWriter calls `during` before its first write, e.g: to write to the
+// database while it is being backed up
+type slowWriter struct {
+	w      io.Writer
+	once   sync.Once
+	during func()
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	w.once.Do(w.during)
+	return w.w.Write(p)
+}
+
+func TestBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer db.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		key, value := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+		assert.NoError(db.Put(key, []byte(value)))
+		expected[key] = value
+	}
+	assert.NoError(db.Delete("k3"))
+	delete(expected, "k3")
+
+	var buf bytes.Buffer
+	w := &slowWriter{w: &buf, during: func() {
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("new%d", i), []byte("new")))
+		}
+		assert.NoError(db.Put("k1", []byte("overwritten")))
+		assert.NoError(db.Delete("k2"))
+		// Removes a datafile of the snapshot
+		assert.NoError(db.CompactDatafile(0))
+	}}
+	assert.NoError(db.Backup(w))
+
+	assert.Equal(backupMagic, buf.Next(len(backupMagic)))
+	backup := make(map[string]string)
+	dec := streampb.NewDecoder(&buf)
+	for {
+		var e pb.Entry
+		if _, err := dec.Decode(&e); err != nil {
+			assert.Equal(io.EOF, err)
+			break
+		}
+		assert.NotContains(backup, e.Key)
+		backup[e.Key] = string(e.Value)
+	}
+	assert.Equal(expected, backup)
+
+	assert.Equal(38, db.Len())
+	assert.NoError(db.SelfTest())
+}
+
+func TestTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(128))
+	assert.NoError(err)
+
+	assert.Equal(ErrInvalidTTL, db.PutWithTTL("foo", []byte("foo"), 0))
+
+	assert.NoError(db.Put("foo", []byte("old")))
+	assert.NoError(db.Put("bar", []byte("bar")))
+	assert.NoError(db.PutWithTTL("foo", []byte("foo"), time.Second))
+	assert.NoError(db.Close())
+
+	// Expiry times survive reopening
+	db, err = Open(testdir, WithMaxDatafileSize(128), WithExpiry(time.Second))
+	assert.NoError(err)
+	assert.NoError(db.Put("baz", []byte("baz")))
+	assert.NoError(db.PutWithTTL("qux", []byte("qux"), time.Hour))
+	// Rotates the active datafile so that baz is merged
+	assert.NoError(db.PutWithTTL("bar", []byte(strings.Repeat("b", 80)), time.Hour))
+
+	assert.True(db.Has("foo"))
+	val, err := db.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), val)
+
+	time.Sleep(2 * time.Second)
+
+	check := func(db *Bitcask) {
+		for _, key := range []string{"foo", "baz"} {
+			assert.False(db.Has(key))
+			_, err := db.Get(key)
+			assert.Equal(ErrKeyNotFound, err)
+		}
+
+		var keys []string
+		for key := range db.Keys() {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		assert.Equal([]string{"bar", "qux"}, keys)
+
+		keys = nil
+		assert.NoError(db.Fold(func(key string) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		sort.Strings(keys)
+		assert.Equal([]string{"bar", "qux"}, keys)
+
+		keys = nil
+		assert.NoError(db.Scan("", func(key string) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		assert.Equal([]string{"bar", "qux"}, keys)
+	}
+
+	check(db)
+	assert.NoError(db.Close())
+
+	// Expired keys are dropped by merges (without resurrecting older values)
+	assert.NoError(Merge(testdir, true))
+
+	db, err = Open(testdir, WithMaxDatafileSize(128))
+	assert.NoError(err)
+	defer db.Close()
+
+	check(db)
+	assert.Equal(2, db.Len())
+}
+
+func TestTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	assert.NoError(db.Put("foo", []byte("foo")))
+	assert.NoError(db.Put("bar", []byte("bar")))
+
+	t.Run("Rollback", func(t *testing.T) {
+		tx := db.Transaction()
+		assert.NoError(tx.Put("foo", []byte("changed")))
+		assert.NoError(tx.Delete("bar"))
+		assert.NoError(tx.Rollback())
+
+		assert.Equal(ErrTransactionClosed, tx.Put("baz", []byte("baz")))
+		assert.Equal(ErrTransactionClosed, tx.Commit())
+
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), val)
+		assert.True(db.Has("bar"))
+	})
+
+	t.Run("Crash", func(t *testing.T) {
+		tx := db.Transaction()
+		assert.NoError(tx.Put("foo", []byte("changed")))
+		assert.NoError(tx.Put("baz", []byte("baz")))
+		assert.NoError(tx.Delete("bar"))
+
+		// Nothing is visible (or written) until the transaction commits
+		assert.False(db.Has("baz"))
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		assert.Equal(2, db.Len())
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), val)
+		assert.True(db.Has("bar"))
+		assert.False(db.Has("baz"))
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		tx := db.Transaction()
+		assert.NoError(tx.Put("foo", []byte("changed")))
+		assert.NoError(tx.Put("baz", []byte("baz")))
+		assert.NoError(tx.Delete("bar"))
+		assert.NoError(tx.Commit())
+		assert.Equal(ErrTransactionClosed, tx.Commit())
+
+		check := func(db *Bitcask) {
+			assert.Equal(2, db.Len())
+			val, err := db.Get("foo")
+			assert.NoError(err)
+			assert.Equal([]byte("changed"), val)
+			val, err = db.Get("baz")
+			assert.NoError(err)
+			assert.Equal([]byte("baz"), val)
+			assert.False(db.Has("bar"))
+		}
+
+		check(db)
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		check(db)
+	})
+
+	t.Run("TornCommit", func(t *testing.T) {
+		size := db.curr.Size()
+
+		tx := db.Transaction()
+		assert.NoError(tx.Delete("baz"))
+		assert.NoError(tx.Put("qux", []byte("qux")))
+		assert.NoError(tx.Put("foo", []byte("torn")))
+		assert.NoError(tx.Commit())
+
+		last, ok := db.keydir.Get("foo")
+		assert.True(ok)
+		assert.NoError(db.Close())
+
+		// Simulate a crash before the last entry of the transaction was
+		// written
+		assert.NoError(os.Truncate(datafilePath(testdir, last.FileID), last.Offset))
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+
+		recovered := db.Recovered()
+		if assert.NotNil(recovered) {
+			assert.Equal(size, recovered.Offset)
+			assert.Equal(errIncompleteTransaction, recovered.Err)
+		}
+		assert.Equal(2, db.Len())
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("changed"), val)
+		assert.True(db.Has("baz"))
+		assert.False(db.Has("qux"))
+	})
+
+	assert.NoError(db.Close())
+}
+
+func TestGetCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put("foo", []byte("foo")))
+	assert.NoError(db.PutGrouped("group", "bar", []byte("bar")))
+
+	for _, key := range []string{"foo", "bar"} {
+		val, err := db.Get(key)
+		assert.NoError(err)
+		copy(val, "xxx")
+
+		val, err = db.Get(key)
+		assert.NoError(err)
+		assert.Equal([]byte(key), val)
+	}
+
+	t.Run("GetInto", func(t *testing.T) {
+		buf := make([]byte, 8)
+		for _, key := range []string{"foo", "bar"} {
+			n, err := db.GetInto(key, buf)
+			assert.NoError(err)
+			assert.Equal([]byte(key), buf[:n])
+		}
+
+		n, err := db.GetInto("foo", buf[:2])
+		assert.Equal(ErrBufferTooSmall, err)
+		assert.Equal(3, n)
+
+		_, err = db.GetInto("baz", buf)
+		assert.Equal(ErrKeyNotFound, err)
+	})
+}
+
+func TestRange(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for _, key := range []string{"2019-12", "2020-01", "2020-01-15", "2020-03", "2020-06", "2020-06-01", "2020-07", "a"} {
+		assert.NoError(db.Put(key, []byte(key)))
+	}
+
+	keys := func(lower, upper string) []string {
+		var keys []string
+		assert.NoError(db.Range(lower, upper, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		return keys
+	}
+
+	assert.Equal([]string{"2020-01", "2020-01-15", "2020-03", "2020-06"}, keys("2020-01", "2020-06"))
+	assert.Equal([]string{"2020-01-15", "2020-03"}, keys("2020-01-01", "2020-05"))
+	assert.Equal([]string{"2019-12", "2020-01"}, keys("", "2020-01"))
+	assert.Equal([]string{"2020-07", "a"}, keys("2020-06-02", ""))
+	assert.Len(keys("", ""), 8)
+	assert.Empty(keys("2020-06", "2020-01"))
+	assert.Empty(keys("b", ""))
+
+	stop := errors.New("stop")
+	var n int
+	err = db.Range("2020", "", func(key string) error {
+		n++
+		if n == 2 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(stop, err)
+	assert.Equal(2, n)
+}
+
+func TestStats(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(Stats{Datafiles: 1}, stats)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(strings.Repeat("v", 32))))
+	}
+
+	stats, err = db.Stats()
+	assert.NoError(err)
+	assert.Equal(10, stats.Keys)
+	assert.True(stats.Datafiles > 1)
+	assert.Equal(int64(0), stats.Reclaimable)
+
+	var size int64
+	for _, stat := range db.DatafileStats() {
+		size += stat.Size
+		if stat.Active {
+			assert.Equal(stat.Size, stats.ActiveSize)
+		}
+	}
+	assert.Equal(size, stats.Size)
+
+	assert.NoError(db.Put("k0", []byte("overwritten")))
+	assert.NoError(db.Delete("k1"))
+
+	stats, err = db.Stats()
+	assert.NoError(err)
+	assert.Equal(9, stats.Keys)
+	assert.True(stats.Reclaimable > 2*32)
+	reclaimable := stats.Reclaimable
+	assert.NoError(db.Close())
+
+	// Opening the database merges it reclaiming the space
+	db, err = Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer db.Close()
+	stats, err = db.Stats()
+	assert.NoError(err)
+	assert.Equal(9, stats.Keys)
+	assert.True(stats.Reclaimable < reclaimable)
+}
+
+func TestAutoMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir,
+		WithMaxDatafileSize(1024),
+		WithAutoMerge(0.5),
+		WithAutoMergeInterval(10*time.Millisecond),
+	)
+	assert.NoError(err)
+
+	value := []byte(strings.Repeat("v", 64))
+	for i := 0; i < 50; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), value))
+	}
+
+	// Overwrite every key a few times while merges run concurrently
+	for n := 0; n < 5; n++ {
+		for i := 0; i < 50; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("%d", n))))
+		}
+		for i := 0; i < 50; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("%d", n)), val)
+		}
+	}
+
+	merged := func() bool {
+		stats, err := db.Stats()
+		assert.NoError(err)
+		return float64(stats.Reclaimable)/float64(stats.Size) <= 0.5
+	}
+	for deadline := time.Now().Add(5 * time.Second); !merged() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(merged())
+
+	assert.Equal(50, db.Len())
+	assert.NoError(db.SelfTest())
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal(50, db.Len())
+	for i := 0; i < 50; i++ {
+		val, err := db.Get(fmt.Sprintf("k%d", i))
+		assert.NoError(err)
+		assert.Equal([]byte("4"), val)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	for _, key := range []string{"foo", "bar", "baz", "qux"} {
+		assert.NoError(db.Put(key, []byte(key)))
+	}
+
+	it := db.Iterator()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+		val, err := it.Value()
+		assert.NoError(err)
+		assert.Equal([]byte(it.Key()), val)
+
+		// Writes during the iteration are not seen by it
+		assert.NoError(db.Put("new", []byte("new")))
+		assert.NoError(db.Put("qux", []byte("changed")))
+		assert.NoError(db.Delete("foo"))
+	}
+	assert.NoError(it.Err())
+	assert.NoError(it.Close())
+	assert.NoError(it.Close())
+	assert.Equal([]string{"bar", "baz", "foo", "qux"}, keys)
+	assert.False(it.Next())
+
+	t.Run("Prefix", func(t *testing.T) {
+		it := db.PrefixIterator("ba")
+		defer it.Close()
+
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		assert.NoError(it.Err())
+		assert.Equal([]string{"bar", "baz"}, keys)
+	})
+
+	t.Run("Break", func(t *testing.T) {
+		it := db.Iterator()
+		assert.True(it.Next())
+		assert.NoError(it.Close())
+
+		// The write lock isn't held
+		assert.NoError(db.Put("foo", []byte("foo")))
+	})
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	assert.NoError(db.Put("foo", []byte("hello world")))
+	assert.NoError(db.Put("bar", []byte("bar")))
+	assert.NoError(db.Delete("bar"))
+	assert.NoError(db.Verify())
+	assert.NoError(db.Close())
+
+	// Simulate a bad disk returning garbage for the value
+	fn := datafilePath(testdir, 0)
+	data, err := ioutil.ReadFile(fn)
+	assert.NoError(err)
+	i := bytes.Index(data, []byte("hello world"))
+	assert.True(i > 0)
+	data[i] = 'j'
+	assert.NoError(ioutil.WriteFile(fn, data, 0644))
+
+	t.Run("Checksum", func(t *testing.T) {
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		_, err = db.Get("foo")
+		assert.Equal(ErrChecksumFailed, err)
+
+		err = db.Verify()
+		assert.Error(err)
+		assert.Equal(ErrChecksumFailed, errors.Cause(err))
+	})
+
+	t.Run("WithoutChecksum", func(t *testing.T) {
+		db, err := Open(testdir, WithoutChecksum())
+		assert.NoError(err)
+		defer db.Close()
+
+		val, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("jello world"), val)
+	})
+}
+
+func TestBytesKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	assert.Equal(ErrInvalidKey, db.PutBytes([]byte{0xff, 0xfe}, []byte("invalid")))
+
+	binary := []byte{0x00, 0xc3, 0xa9, 0x01}
+	assert.NoError(db.PutBytes(binary, []byte("binary")))
+	assert.NoError(db.PutBytes([]byte("foo"), []byte("foo")))
+	assert.NoError(db.Put("bar", []byte("bar")))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	val, err := db.GetBytes(binary)
+	assert.NoError(err)
+	assert.Equal([]byte("binary"), val)
+	assert.True(db.Has(string(binary)))
+
+	val, err = db.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), val)
+	val, err = db.GetBytes([]byte("bar"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+
+	assert.NoError(db.DeleteBytes(binary))
+	assert.False(db.HasBytes(binary))
+	assert.True(db.HasBytes([]byte("foo")))
+	_, err = db.Get(string(binary))
+	assert.Equal(ErrKeyNotFound, err)
+}
+
+func TestRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer db.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		key, value := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+		assert.NoError(db.Put(key, []byte(value)))
+		expected[key] = value
+	}
+	assert.NoError(db.Put("k1", []byte("overwritten")))
+	expected["k1"] = "overwritten"
+	assert.NoError(db.Delete("k2"))
+	delete(expected, "k2")
+	assert.NoError(db.PutWithFlags("flagged", []byte("bar"), 3))
+	expected["flagged"] = "bar"
+
+	var buf bytes.Buffer
+	assert.NoError(db.Backup(&buf))
+	backup := buf.Bytes()
+
+	// Written after the backup
+	assert.NoError(db.Put("new", []byte("new")))
+
+	restored := filepath.Join(testdir, "restored")
+	assert.NoError(Restore(restored, bytes.NewReader(backup)))
+
+	db2, err := Open(restored)
+	assert.NoError(err)
+	defer db2.Close()
+
+	actual := make(map[string]string)
+	assert.NoError(db2.Fold(func(key string) error {
+		value, err := db2.Get(key)
+		actual[key] = string(value)
+		return err
+	}))
+	assert.Equal(expected, actual)
+
+	flags, err := db2.GetFlags("flagged")
+	assert.NoError(err)
+	assert.Equal(uint8(3), flags)
+	assert.NoError(db2.SelfTest())
+
+	t.Run("Exists", func(t *testing.T) {
+		assert.Error(Restore(restored, bytes.NewReader(backup)))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		var export bytes.Buffer
+		assert.NoError(db.ExportSince(0, &export))
+		assert.Equal(ErrInvalidBackup, Restore(filepath.Join(testdir, "invalid"), &export))
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		corrupted := append([]byte(nil), backup...)
+		corrupted[bytes.Index(corrupted, []byte("v17"))] = 'x'
+		err := Restore(filepath.Join(testdir, "corrupted"), bytes.NewReader(corrupted))
+		assert.Equal(ErrChecksumFailed, errors.Cause(err))
+	})
+}
+
+func TestMergeOpenHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(1024))
+	assert.NoError(err)
+	defer db.Close()
+
+	value := []byte(strings.Repeat("v", 64))
+	for n := 0; n < 5; n++ {
+		for i := 0; i < 50; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), value))
+		}
+	}
+	assert.NoError(db.Delete("k0"))
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.True(stats.Reclaimable > stats.Size/2)
+
+	// Writes made during the merge aren't lost
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("new%d", i), []byte("new")))
+		}
+		assert.NoError(db.Put("k1", []byte("overwritten")))
+	}()
+	assert.NoError(db.Merge())
+	<-done
+
+	assert.Equal(99, db.Len())
+	val, err := db.Get("k1")
+	assert.NoError(err)
+	assert.Equal([]byte("overwritten"), val)
+	assert.False(db.Has("k0"))
+
+	assert.NoError(db.Merge())
+	stats, err = db.Stats()
+	assert.NoError(err)
+	assert.True(stats.Reclaimable < stats.Size/10)
+
+	for i := 1; i < 50; i++ {
+		assert.True(db.Has(fmt.Sprintf("k%d", i)))
+		assert.True(db.Has(fmt.Sprintf("new%d", i)))
+	}
+	assert.NoError(db.SelfTest())
+}
+
+func TestMergeOpenFailedFinish(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+
+	value := []byte(strings.Repeat("v", 64))
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%d", i), value))
+		}
+	}
+
+	// Fails moving the committed merge output into place
+	obstruction := hintPath(testdir, 0)
+	assert.NoError(os.MkdirAll(filepath.Join(obstruction, "x"), 0755))
+
+	assert.Error(db.Merge())
+	_, err = os.Stat(filepath.Join(testdir, mergeMarker))
+	assert.NoError(err)
+	assert.Equal(errMergePending, db.Merge())
+
+	// The merged datafiles are still read until the database is reopened
+	for i := 0; i < 10; i++ {
+		val, err := db.Get(fmt.Sprintf("k%d", i))
+		assert.NoError(err)
+		assert.Equal(value, val)
+	}
+	assert.NoError(db.Put("new", []byte("new")))
+	assert.NoError(db.Close())
+
+	assert.NoError(os.RemoveAll(obstruction))
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	_, err = os.Stat(filepath.Join(testdir, mergeMarker))
+	assert.True(os.IsNotExist(err))
+	assert.Equal(11, db.Len())
+	for i := 0; i < 10; i++ {
+		val, err := db.Get(fmt.Sprintf("k%d", i))
+		assert.NoError(err)
+		assert.Equal(value, val)
+	}
+	assert.NoError(db.SelfTest())
+}
+
+func TestSyncWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256), WithSyncWrites(true))
+	assert.NoError(err)
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		assert.NoError(db.Put(key, []byte(key)))
+	}
+	assert.NoError(db.Delete("k0"))
+
+	// Simulate a crash by abandoning the database without closing it
+	assert.NoError(db.Flock.Unlock())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Equal(19, db.Len())
+	for i := 1; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		val, err := db.Get(key)
+		assert.NoError(err)
+		assert.Equal([]byte(key), val)
+	}
+	assert.False(db.Has("k0"))
+}
+
+func TestVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	_, err = Open(testdir, WithMaxVersions(0))
+	assert.Error(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(128), WithMaxVersions(3))
+	assert.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.Put("foo", []byte(fmt.Sprintf("v%d", i))))
+		assert.NoError(db.Put("bar", []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.NoError(db.Put("once", []byte("v0")))
+	assert.NoError(db.Put("deleted", []byte("v0")))
+	assert.NoError(db.Put("deleted", []byte("v1")))
+	assert.NoError(db.Delete("deleted"))
+	assert.NoError(db.Put("readded", []byte("v0")))
+	assert.NoError(db.Delete("readded"))
+	assert.NoError(db.Put("readded", []byte("v1")))
+
+	versions := func(db *Bitcask, key string) []string {
+		values, err := db.GetVersions(key)
+		assert.NoError(err)
+		var versions []string
+		for _, value := range values {
+			versions = append(versions, string(value))
+		}
+		return versions
+	}
+	check := func(db *Bitcask) {
+		assert.Equal([]string{"v4", "v3", "v2"}, versions(db, "foo"))
+		assert.Equal([]string{"v4", "v3", "v2"}, versions(db, "bar"))
+		assert.Equal([]string{"v0"}, versions(db, "once"))
+		assert.Equal([]string{"v1"}, versions(db, "readded"))
+		_, err := db.GetVersions("deleted")
+		assert.Equal(ErrKeyNotFound, err)
+	}
+	check(db)
+
+	// Merging the open database keeps the versions
+	assert.NoError(db.Put("foo", []byte("v5")))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 6; i < 8; i++ {
+			assert.NoError(db.Put("foo", []byte(fmt.Sprintf("v%d", i))))
+		}
+	}()
+	assert.NoError(db.Merge())
+	<-done
+	assert.Equal([]string{"v7", "v6", "v5"}, versions(db, "foo"))
+	for i := 2; i < 5; i++ {
+		assert.NoError(db.Put("foo", []byte(fmt.Sprintf("v%d", i))))
+	}
+	check(db)
+	assert.NoError(db.Close())
+
+	// Reopening merges and loads the versions from the hint files
+	db, err = Open(testdir, WithMaxDatafileSize(128), WithMaxVersions(3))
+	assert.NoError(err)
+	check(db)
+	assert.NoError(db.Close())
+
+	assert.NoError(Merge(testdir, true, WithMaxVersions(3)))
+	db, err = Open(testdir, WithMaxDatafileSize(128), WithMaxVersions(3))
+	assert.NoError(err)
+	check(db)
+	assert.NoError(db.Close())
+
+	// The merge kept the three most recent versions only
+	fns, err := internal.GetDatafiles(testdir)
+	assert.NoError(err)
+	var foos []string
+	for _, fn := range fns {
+		it, err := OpenDatafile(fn)
+		assert.NoError(err)
+		for it.Next() {
+			if it.Entry().Key == "foo" {
+				foos = append(foos, string(it.Entry().Value))
+			}
+		}
+		assert.NoError(it.Err())
+		it.Close()
+	}
+	assert.Equal([]string{"v2", "v3", "v4"}, foos)
+
+	// With a single version only the current value is kept
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal([]string{"v4"}, versions(db, "foo"))
+	assert.Equal([]string{"v1"}, versions(db, "readded"))
+}
+
+// expiringContext is a context that is cancelled once Err has been called
+// `n` times
+type expiringContext struct {
+	context.Context
+	n int32
+}
+
+func (ctx *expiringContext) Err() error {
+	if atomic.AddInt32(&ctx.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer db.Close()
+
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 20; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", n))))
+		}
+	}
+
+	t.Run("Fold", func(t *testing.T) {
+		var keys int
+		err := db.FoldContext(&expiringContext{Context: context.Background(), n: 3}, func(key string) error {
+			keys++
+			return nil
+		})
+		assert.Equal(context.Canceled, err)
+		assert.Equal(3, keys)
+
+		// The index isn't left locked
+		assert.NoError(db.Put("k00", []byte("v2")))
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var keys []string
+		err := db.ScanContext(ctx, "k0", func(key string) error {
+			keys = append(keys, key)
+			if len(keys) == 2 {
+				cancel()
+			}
+			return nil
+		})
+		assert.Equal(context.Canceled, err)
+		assert.Equal([]string{"k00", "k01"}, keys)
+
+		ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+		defer cancel()
+		assert.Equal(context.DeadlineExceeded, db.ScanContext(ctx, "", func(key string) error {
+			return nil
+		}))
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		before, err := db.Stats()
+		assert.NoError(err)
+
+		err = db.MergeContext(&expiringContext{Context: context.Background(), n: 10})
+		assert.Equal(context.Canceled, err)
+		_, err = os.Stat(filepath.Join(testdir, mergeDirname))
+		assert.True(os.IsNotExist(err))
+
+		after, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(before.Reclaimable, after.Reclaimable)
+		assert.Equal(20, db.Len())
+		assert.NoError(db.SelfTest())
+
+		assert.NoError(db.MergeContext(context.Background()))
+		after, err = db.Stats()
+		assert.NoError(err)
+		assert.True(after.Reclaimable < before.Reclaimable)
+		for i := 0; i < 20; i++ {
+			val, err := db.Get(fmt.Sprintf("k%02d", i))
+			assert.NoError(err)
+			assert.Equal([]byte("v2"), val)
+		}
+	})
+}
+
+func TestEntryTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithMaxDatafileSize(96), WithMaxKeySize(40), WithMaxValueSize(40))
+	assert.NoError(err)
+	defer db.Close()
+
+	key := strings.Repeat("k", 40)
+	value := []byte(strings.Repeat("v", 40))
+
+	assert.NoError(db.Put("foo", value))
+	size := db.curr.Size()
+
+	err = db.Put(key, value)
+	assert.Equal(ErrEntryTooLarge, errors.Cause(err))
+	assert.Contains(err.Error(), "exceeds the maximum datafile size of 96 bytes")
+	assert.False(db.Has(key))
+	assert.Equal(size, db.curr.Size())
+
+	tx := db.Transaction()
+	assert.NoError(tx.Put("bar", []byte("bar")))
+	assert.NoError(tx.Put(key, value))
+	assert.Equal(ErrEntryTooLarge, errors.Cause(tx.Commit()))
+	assert.False(db.Has("bar"))
+
+	err = db.BulkLoad(func(put func(key string, value []byte) error) error {
+		return put(key, value)
+	})
+	assert.Equal(ErrEntryTooLarge, errors.Cause(err))
+	assert.False(db.Has(key))
+	assert.Equal(size, db.curr.Size())
+
+	assert.NoError(db.Put(key[:8], value))
+}
+
+func TestReadOnlyLock(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	src := filepath.Join(testdir, "src")
+
+	db, err := Open(src)
+	assert.NoError(err)
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Sync())
+
+	// Any number of read-only databases alongside the writer
+	r1, err := Open(src, WithReadOnly())
+	assert.NoError(err)
+	r2, err := Open(src, WithReadOnly())
+	assert.NoError(err)
+
+	for _, r := range []*Bitcask{r1, r2} {
+		val, err := r.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+
+		assert.Equal(ErrReadOnly, r.Put("foo", []byte("baz")))
+		assert.Equal(ErrReadOnly, r.Delete("foo"))
+		assert.Equal(ErrReadOnly, r.Sync())
+		assert.Equal(ErrReadOnly, r.Merge())
+	}
+
+	// Only a single writer
+	_, err = Open(src)
+	assert.Equal(ErrDatabaseLocked, err)
+	assert.NoError(db.Close())
+
+	// Databases open read-only can't be moved from under them
+	dst := filepath.Join(testdir, "dst")
+	assert.Equal(ErrDatabaseLocked, Move(src, dst))
+	assert.NoError(r1.Close())
+	assert.Equal(ErrDatabaseLocked, Move(src, dst))
+
+	other, err := Open(filepath.Join(testdir, "other"))
+	assert.NoError(err)
+	defer other.Close()
+	assert.Equal(ErrDatabaseLocked, other.ReplaceWith(src))
+
+	assert.NoError(r2.Close())
+	assert.NoError(Move(src, dst))
+
+	r, err := Open(dst, WithReadOnly())
+	assert.NoError(err)
+	defer r.Close()
+	val, err := r.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), val)
+}
+
+func TestPersistentIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir, WithPersistentIndex(false))
+	assert.NoError(err)
+	for i := 0; i < 20; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.NoError(db.Delete("k0"))
+	assert.NoError(db.Close())
+
+	index, err := internal.LoadIndex(filepath.Join(testdir, indexFilename))
+	assert.NoError(err)
+	assert.Len(index.Items, 19)
+	assert.Equal(uint64(21), index.Sequence)
+
+	check := func(db *Bitcask) {
+		assert.Equal(19, db.Len())
+		assert.False(db.Has("k0"))
+		for i := 1; i < 20; i++ {
+			val, err := db.Get(fmt.Sprintf("k%d", i))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("v%d", i)), val)
+		}
+	}
+
+	t.Run("Loaded", func(t *testing.T) {
+		db, err := Open(testdir, WithPersistentIndex(false))
+		assert.NoError(err)
+		check(db)
+		assert.Equal(uint64(21), db.Sequence())
+		assert.NoError(db.Close())
+
+		// Only the index is read: a key missing from it is missing
+		fn := filepath.Join(testdir, indexFilename)
+		saved, err := ioutil.ReadFile(fn)
+		assert.NoError(err)
+		delete(index.Items, "k1")
+		assert.NoError(index.Save(fn))
+
+		db, err = Open(testdir, WithPersistentIndex(false), WithReadOnly())
+		assert.NoError(err)
+		assert.False(db.Has("k1"))
+		assert.Equal(18, db.Len())
+		assert.NoError(db.Close())
+
+		// Without the option the index isn't used
+		db, err = Open(testdir, WithReadOnly())
+		assert.NoError(err)
+		check(db)
+		assert.NoError(db.Close())
+
+		assert.NoError(ioutil.WriteFile(fn, saved, 0644))
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		db, err := Open(testdir, WithPersistentIndex(false))
+		assert.NoError(err)
+		check(db)
+		assert.NoError(db.Put("k20", []byte("v20")))
+
+		// Simulate a crash by abandoning the database without closing it
+		assert.NoError(db.Flock.Unlock())
+
+		db, err = Open(testdir, WithPersistentIndex(false))
+		assert.NoError(err)
+		assert.True(db.Has("k20"))
+		assert.NoError(db.Delete("k20"))
+		assert.NoError(db.Close())
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		fn := filepath.Join(testdir, indexFilename)
+		data, err := ioutil.ReadFile(fn)
+		assert.NoError(err)
+		data[len(data)/2] ^= 0xff
+		assert.NoError(ioutil.WriteFile(fn, data, 0644))
+
+		db, err := Open(testdir, WithPersistentIndex(false))
+		assert.NoError(err)
+		check(db)
+		assert.NoError(db.Close())
+	})
+
+	t.Run("OnSync", func(t *testing.T) {
+		db, err := Open(testdir, WithPersistentIndex(true))
+		assert.NoError(err)
+		assert.NoError(db.Put("k0", []byte("v0")))
+		assert.NoError(db.Sync())
+		assert.NoError(db.Flock.Unlock())
+
+		index, err := internal.LoadIndex(filepath.Join(testdir, indexFilename))
+		assert.NoError(err)
+		assert.Len(index.Items, 20)
+	})
+}
+
+func TestGetMulti(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.NoError(db.Delete("k3"))
+	_, err = db.Incr("n", 2)
+	assert.NoError(err)
+
+	t.Run("Found", func(t *testing.T) {
+		values, err := db.GetMulti([]string{"k9", "k0", "k3", "missing", "k5", "k0", "n"})
+		assert.NoError(err)
+		assert.Equal(map[string][]byte{
+			"k0": []byte("v0"),
+			"k5": []byte("v5"),
+			"k9": []byte("v9"),
+			"n":  []byte("2"),
+		}, values)
+
+		// The values are copies
+		values["k0"][0] = 'x'
+		value, err := db.Get("k0")
+		assert.NoError(err)
+		assert.Equal([]byte("v0"), value)
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		values, err := db.GetMultiStrict([]string{"k1", "k2"})
+		assert.NoError(err)
+		assert.Len(values, 2)
+
+		_, err = db.GetMultiStrict([]string{"k1", "k3"})
+		assert.Error(err)
+		assert.Equal(ErrKeyNotFound, errors.Cause(err))
+	})
+}
+
+type testMetrics struct {
+	sync.Mutex
+	db *Bitcask
+
+	puts, hits, misses, merges, collisions int
+	diskBytes                              int64
+}
+
+func (m *testMetrics) IncPut() {
+	// The database must not hold its locks while calling into the metrics
+	m.db.Has("foo")
+
+	m.Lock()
+	defer m.Unlock()
+	m.puts++
+}
+
+func (m *testMetrics) IncGet(hit bool) {
+	m.db.Has("foo")
+
+	m.Lock()
+	defer m.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *testMetrics) ObserveMergeDuration(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.merges++
+}
+
+func (m *testMetrics) SetDiskBytes(n int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.diskBytes = n
+}
+
+func (m *testMetrics) IncCollision() {
+	m.db.Has("foo")
+
+	m.Lock()
+	defer m.Unlock()
+	m.collisions++
+}
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	metrics := &testMetrics{}
+	db, err := Open(testdir, WithMetrics(metrics))
+	assert.NoError(err)
+	defer db.Close()
+	metrics.db = db
+
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.PutWithTTL("baz", []byte("qux"), time.Hour))
+	assert.NoError(db.PutGrouped("g", "grouped", []byte("qux")))
+	assert.Equal(ErrKeyTooLarge, db.Put(strings.Repeat("k", DefaultMaxKeySize+1), nil))
+
+	_, err = db.Get("foo")
+	assert.NoError(err)
+	_, err = db.Get("missing")
+	assert.Equal(ErrKeyNotFound, err)
+	_, release, err := db.GetView("baz")
+	assert.NoError(err)
+	release()
+
+	assert.NoError(db.Sync())
+	stats, err := db.Stats()
+	assert.NoError(err)
+
+	metrics.Lock()
+	assert.Equal(3, metrics.puts)
+	assert.Equal(2, metrics.hits)
+	assert.Equal(1, metrics.misses)
+	assert.Equal(stats.Size, metrics.diskBytes)
+	metrics.Unlock()
+
+	assert.NoError(db.Put("foo", []byte("bar2")))
+	assert.NoError(db.Merge())
+	stats, err = db.Stats()
+	assert.NoError(err)
+
+	metrics.Lock()
+	assert.Equal(1, metrics.merges)
+	assert.Equal(stats.Size, metrics.diskBytes)
+	metrics.Unlock()
+}
+
+func TestFileMode(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	options := []Option{
+		WithSubdir("store"),
+		WithFileMode(0660),
+		WithDirMode(0770),
+		WithMaxDatafileSize(64),
+	}
+
+	// The modes are applied regardless of the umask (e.g: 022)
+	check := func() {
+		path := filepath.Join(testdir, "store")
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0770), stat.Mode().Perm())
+
+		fns, err := filepath.Glob(filepath.Join(path, "*"))
+		assert.NoError(err)
+		var n int
+		for _, fn := range fns {
+			if ext := filepath.Ext(fn); ext != ".data" && ext != ".hint" && filepath.Base(fn) != "lock" {
+				continue
+			}
+			stat, err := os.Stat(fn)
+			assert.NoError(err)
+			assert.Equal(os.FileMode(0660), stat.Mode().Perm(), fn)
+			n++
+		}
+		assert.True(n > 1)
+	}
+
+	db, err := Open(testdir, options...)
+	assert.NoError(err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put("foo", []byte(fmt.Sprintf("bar%d", i))))
+	}
+	check()
+	assert.NoError(db.Close())
+
+	// Open merges the datafiles writing hint files
+	db, err = Open(testdir, options...)
+	assert.NoError(err)
+	check()
+	value, err := db.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("bar9"), value)
+
+	assert.NoError(db.Put("baz", []byte("qux")))
+	assert.NoError(db.Merge())
+	check()
+	assert.NoError(db.Close())
+
+	for _, name := range []string{"", "..", "../other", "/abs"} {
+		_, err = Open(testdir, WithSubdir(name))
+		assert.Error(err, name)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	t.Run("Swap", func(t *testing.T) {
+		swapped, err := db.CompareAndSwap("foo", []byte("bar"), []byte("baz"))
+		assert.NoError(err)
+		assert.False(swapped)
+
+		swapped, err = db.PutIfAbsent("foo", []byte("bar"))
+		assert.NoError(err)
+		assert.True(swapped)
+
+		swapped, err = db.PutIfAbsent("foo", []byte("qux"))
+		assert.NoError(err)
+		assert.False(swapped)
+
+		swapped, err = db.CompareAndSwap("foo", []byte("qux"), []byte("baz"))
+		assert.NoError(err)
+		assert.False(swapped)
+
+		swapped, err = db.CompareAndSwap("foo", []byte("bar"), []byte("baz"))
+		assert.NoError(err)
+		assert.True(swapped)
+
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), value)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const (
+			workers = 8
+			tries   = 200
+		)
+
+		var (
+			wg      sync.WaitGroup
+			swaps   int64
+			winners int64
+		)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+
+				if swapped, err := db.PutIfAbsent("lock", []byte(strconv.Itoa(worker))); assert.NoError(err) && swapped {
+					atomic.AddInt64(&winners, 1)
+				}
+
+				for j := 0; j < tries; j++ {
+					value, err := db.Get("n")
+					if err == ErrKeyNotFound {
+						value = nil
+					} else if !assert.NoError(err) {
+						return
+					}
+					n, _ := strconv.Atoi(string(value))
+					swapped, err := db.CompareAndSwap("n", value, []byte(strconv.Itoa(n+1)))
+					assert.NoError(err)
+					if swapped {
+						atomic.AddInt64(&swaps, 1)
+					}
+					// Plain writes of other keys interleave with the swaps
+					assert.NoError(db.Put(fmt.Sprintf("w%d", worker), value))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(int64(1), winners)
+
+		value, err := db.Get("n")
+		assert.NoError(err)
+		assert.True(swaps > 0)
+		assert.Equal(strconv.FormatInt(swaps, 10), string(value))
+	})
+}
+
+func TestRecoverCorruptTail(t *testing.T) {
+	assert := assert.New(t)
+
+	tails := map[string][]byte{
+		"Garbage": []byte("\x00\x00\x00\x00\x00\x00\x00\x05garbage!"),
+		"Zeroes":  make([]byte, 64),
+		"Torn":    {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x0a, 0x03, 'f'},
+	}
+
+	// An entry whose value was only partially written to disk
+	var checksum bytes.Buffer
+	_, err := streampb.NewEncoder(&checksum).Encode(&pb.Entry{
+		Checksum:  1,
+		Key:       "k10",
+		Value:     []byte("\x00\x00\x00"),
+		Timestamp: time.Now().UnixNano(),
+	})
+	assert.NoError(err)
+	tails["Checksum"] = checksum.Bytes()
+
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir)
+			assert.NoError(err)
+			for i := 0; i < 10; i++ {
+				assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i))))
+			}
+			assert.NoError(db.Delete("k5"))
+			assert.Nil(db.Recovered())
+			assert.NoError(db.Close())
+
+			// Simulate a crash part way through writing an entry
+			fn := datafilePath(testdir, 0)
+			stat, err := os.Stat(fn)
+			assert.NoError(err)
+			f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0)
+			assert.NoError(err)
+			_, err = f.Write(tail)
+			assert.NoError(err)
+			assert.NoError(f.Close())
+
+			_, err = Open(testdir, WithStrictRecovery())
+			assert.Error(err)
+
+			db, err = Open(testdir)
+			assert.NoError(err)
+
+			recovered := db.Recovered()
+			if assert.NotNil(recovered) {
+				assert.Equal(0, recovered.FileID)
+				assert.Equal(stat.Size(), recovered.Offset)
+				assert.Equal(int64(len(tail)), recovered.Truncated)
+			}
+			for i := 0; i < 10; i++ {
+				value, err := db.Get(fmt.Sprintf("k%d", i))
+				if i == 5 {
+					assert.Equal(ErrKeyNotFound, err)
+					continue
+				}
+				assert.NoError(err)
+				assert.Equal([]byte(fmt.Sprintf("v%d", i)), value)
+			}
+			assert.NoError(db.Put("k10", []byte("v10")))
+			assert.NoError(db.Close())
+
+			db, err = Open(testdir, WithStrictRecovery())
+			assert.NoError(err)
+			defer db.Close()
+			assert.Nil(db.Recovered())
+			value, err := db.Get("k10")
+			assert.NoError(err)
+			assert.Equal([]byte("v10"), value)
+		})
+	}
+}
+
+func TestOpenBaselineDatafile(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	// Entries written before timestamps, flags, sequence numbers and
+	// expiry were added to them
+	df, err := internal.NewDatafile(testdir, 0, false)
+	assert.NoError(err)
+	for _, kv := range [][2]string{{"foo", "foo"}, {"bar", "bar"}, {"foo", "baz"}, {"qux", "qux"}} {
+		value := []byte(kv[1])
+		_, _, err := df.Write(pb.Entry{
+			Checksum: crc32.ChecksumIEEE(value),
+			Key:      kv[0],
+			Value:    value,
+		})
+		assert.NoError(err)
+	}
+	size := df.Size()
+	assert.NoError(df.Close())
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.Nil(db.Recovered())
+	assert.Equal(3, db.Len())
+	for key, expected := range map[string]string{"foo": "baz", "bar": "bar", "qux": "qux"} {
+		value, err := db.Get(key)
+		assert.NoError(err)
+		assert.Equal([]byte(expected), value)
+	}
+
+	stat, err := os.Stat(datafilePath(testdir, 0))
+	assert.NoError(err)
+	assert.Equal(size, stat.Size())
+}
+
+func TestSizeModTime(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+
+	before := time.Now()
+	assert.NoError(db.Put("foo", []byte("hello world")))
+	assert.NoError(db.Put("bar", []byte("bar")))
+	assert.NoError(db.Put("empty", []byte{}))
+	after := time.Now()
+
+	check := func(db *Bitcask) {
+		size, err := db.Size("foo")
+		assert.NoError(err)
+		assert.Equal(int64(11), size)
+
+		modtime, err := db.ModTime("foo")
+		assert.NoError(err)
+		assert.False(modtime.Before(before))
+		assert.False(modtime.After(after))
+
+		_, err = db.Size("missing")
+		assert.Equal(ErrKeyNotFound, err)
+		_, err = db.ModTime("missing")
+		assert.Equal(ErrKeyNotFound, err)
+	}
+	check(db)
+	assert.NoError(db.Close())
+
+	// Open merges the datafiles loading the keys from their hint files
+	db, err = Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	check(db)
+
+	// The values aren't read
+	for id := range db.datafiles {
+		fn := datafilePath(testdir, id)
+		data, err := ioutil.ReadFile(fn)
+		assert.NoError(err)
+		if i := bytes.Index(data, []byte("hello world")); i > 0 {
+			data[i] = 'j'
+			assert.NoError(ioutil.WriteFile(fn, data, 0644))
+		}
+	}
+	assert.NoError(db.Close())
+	db, err = Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+	_, err = db.Get("foo")
+	assert.Equal(ErrChecksumFailed, err)
+	check(db)
+
+	assert.NoError(db.PutGrouped("g", "baz", []byte("qux")))
+	size, err := db.Size("baz")
+	assert.NoError(err)
+	assert.Equal(int64(3), size)
+	modtime, err := db.ModTime("baz")
+	assert.NoError(err)
+	assert.False(modtime.Before(after))
+
+	// The pending write isn't written out but is timestamped as it will be
+	_, ok := db.pending["baz"]
+	assert.True(ok)
+	assert.NoError(db.FlushGroups())
+	flushed, err := db.ModTime("baz")
+	assert.NoError(err)
+	assert.Equal(modtime, flushed)
+}
+
+func TestGetReader(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(1<<20), WithMaxValueSize(1<<19))
+	assert.NoError(err)
+	defer db.Close()
+
+	blob := bytes.Repeat([]byte("0123456789abcdef"), 1<<15)
+	assert.NoError(db.Put("blob", blob))
+	assert.NoError(db.Put("empty", []byte{}))
+
+	t.Run("Read", func(t *testing.T) {
+		r, err := db.GetReader("empty")
+		assert.NoError(err)
+		value, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Len(value, 0)
+		assert.NoError(r.Close())
+
+		r, err = db.GetReader("blob")
+		assert.NoError(err)
+		defer r.Close()
+
+		// Only part of the value is read before it is overwritten and
+		// its datafile merged away
+		head := make([]byte, 1000)
+		_, err = io.ReadFull(r, head)
+		assert.NoError(err)
+
+		assert.NoError(db.Put("blob", []byte("small")))
+		assert.NoError(db.Merge())
+
+		rest, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(blob, append(head, rest...))
+
+		r, err = db.GetReader("blob")
+		assert.NoError(err)
+		value, err = ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal([]byte("small"), value)
+		assert.NoError(r.Close())
+
+		_, err = db.GetReader("missing")
+		assert.Equal(ErrKeyNotFound, err)
+	})
+
+	t.Run("Checksum", func(t *testing.T) {
+		assert.NoError(db.Put("blob", blob))
+		assert.NoError(db.Sync())
+
+		fn := datafilePath(testdir, db.curr.FileID())
+		data, err := ioutil.ReadFile(fn)
+		assert.NoError(err)
+		i := bytes.LastIndex(data, []byte("0123456789abcdef"))
+		assert.True(i > 0)
+		data[i] = 'x'
+		assert.NoError(ioutil.WriteFile(fn, data, 0644))
+
+		r, err := db.GetReader("blob")
+		assert.NoError(err)
+		defer r.Close()
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(ErrChecksumFailed, err)
+	})
+}
+
+func TestPrefixStats(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("tenant1/%d", i), []byte("value")))
+		assert.NoError(db.Put(fmt.Sprintf("tenant2/%d", i), []byte(strings.Repeat("longer value", 4))))
+	}
+	assert.NoError(db.Put("tenant1/0", []byte("overwritten")))
+	assert.NoError(db.Delete("tenant2/0"))
+	assert.NoError(db.Delete("tenant2/1"))
+
+	keys1, bytes1, err := db.PrefixStats("tenant1/")
+	assert.NoError(err)
+	assert.Equal(10, keys1)
+
+	keys2, bytes2, err := db.PrefixStats("tenant2/")
+	assert.NoError(err)
+	assert.Equal(8, keys2)
+	assert.True(bytes2 > bytes1)
+
+	keys, bytes, err := db.PrefixStats("")
+	assert.NoError(err)
+	assert.Equal(keys1+keys2, keys)
+	assert.Equal(bytes1+bytes2, bytes)
+	assert.Equal(db.Len(), keys)
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(stats.Size-stats.Reclaimable, bytes)
+
+	keys, bytes, err = db.PrefixStats("tenant3/")
+	assert.NoError(err)
+	assert.Equal(0, keys)
+	assert.Equal(int64(0), bytes)
+}
+
+func TestMergeTo(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(128))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i%5), []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.NoError(db.Delete("k4"))
+
+	before, err := db.Stats()
+	assert.NoError(err)
+
+	dest := filepath.Join(testdir, "merged")
+	assert.NoError(db.MergeTo(dest))
+	assert.Error(db.MergeTo(dest))
+
+	// The database is left as it is
+	after, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(before, after)
+
+	merged, err := Open(dest)
+	assert.NoError(err)
+	defer merged.Close()
+
+	assert.Equal(4, merged.Len())
+	for i := 0; i < 4; i++ {
+		value, err := merged.Get(fmt.Sprintf("k%d", i))
+		assert.NoError(err)
+		assert.Equal([]byte(fmt.Sprintf("v%d", i+15)), value)
+	}
+	assert.False(merged.Has("k4"))
+
+	stats, err := merged.Stats()
+	assert.NoError(err)
+	assert.Equal(int64(0), stats.Reclaimable)
+	assert.True(stats.Size < before.Size)
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithMaxOpenFiles(2))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.True(len(db.datafiles) > 4)
+
+	check := func() {
+		// Every other read evicts a handle
+		for n := 0; n < 2; n++ {
+			for i := 0; i < 20; i++ {
+				value, err := db.Get(fmt.Sprintf("k%02d", i))
+				assert.NoError(err)
+				assert.Equal([]byte(fmt.Sprintf("v%d", i)), value)
+				assert.True(db.handles.len() <= 2)
+			}
+		}
+		assert.Equal(2, db.handles.len())
+
+		// Iterators (and backups) read through the cache too
+		it := db.Iterator()
+		for i := 0; it.Next(); i++ {
+			value, err := it.Value()
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("v%d", i)), value)
+			assert.True(db.handles.len() <= 2)
+		}
+		assert.NoError(it.Err())
+		assert.True(len(it.snapshot.datafiles) <= 1)
+		assert.NoError(it.Close())
+		assert.NoError(db.Backup(ioutil.Discard))
+	}
+	check()
+
+	// The merged datafiles are read rather than the cached handles of the
+	// datafiles they replace
+	it := db.Iterator()
+	defer it.Close()
+	for i := 0; i < 20; i += 2 {
+		assert.NoError(db.Put(fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", i))))
+	}
+	assert.NoError(db.Merge())
+	check()
+
+	// An iterator created before the merge still reads the datafiles it
+	// replaced, which are pinned until it is closed
+	for i := 0; it.Next(); i++ {
+		value, err := it.Value()
+		assert.NoError(err)
+		assert.Equal([]byte(fmt.Sprintf("v%d", i)), value)
+	}
+	assert.NoError(it.Err())
+	assert.NoError(it.Close())
+	dirs, err := filepath.Glob(filepath.Join(testdir, snapshotDirPrefix+"*"))
+	assert.NoError(err)
+	assert.Empty(dirs)
+
+	t.Run("MergeDuringBackup", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(64), WithMaxOpenFiles(1))
+		assert.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 20; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%02d", i), []byte(fmt.Sprintf("v%d", i))))
+		}
+
+		r, w := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := db.Backup(w)
+			w.CloseWithError(err)
+			done <- err
+		}()
+
+		// The backup is blocked writing its header
+		first := make([]byte, 1)
+		_, err = r.Read(first)
+		assert.NoError(err)
+		for i := 0; i < 20; i++ {
+			assert.NoError(db.Put(fmt.Sprintf("k%02d", i), []byte("new")))
+		}
+		assert.NoError(db.Merge())
+
+		restored := filepath.Join(testdir, "restored")
+		assert.NoError(Restore(restored, io.MultiReader(bytes.NewReader(first), r)))
+		assert.NoError(<-done)
+		rdb, err := Open(restored)
+		assert.NoError(err)
+		defer rdb.Close()
+		for i := 0; i < 20; i++ {
+			value, err := rdb.Get(fmt.Sprintf("k%02d", i))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("v%d", i)), value)
+		}
+	})
+
+	assert.Error(WithMaxOpenFiles(0)(newDefaultConfig()))
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	ch1, stop1 := db.Watch()
+	ch2, stop2 := db.Watch()
+
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Delete("foo"))
+
+	for _, ch := range []<-chan Event{ch1, ch2} {
+		assert.Equal(Event{Type: EventPut, Key: "foo", Value: []byte("bar")}, <-ch)
+		assert.Equal(Event{Type: EventDelete, Key: "foo"}, <-ch)
+	}
+
+	stop1()
+	stop1()
+	_, ok := <-ch1
+	assert.False(ok)
+
+	// A watcher that falls behind misses events but never blocks writers
+	for i := 0; i < subscriberBuffer+10; i++ {
+		assert.NoError(db.Put(fmt.Sprintf("k%d", i), []byte("v")))
+	}
+	for i := 0; i < subscriberBuffer; i++ {
+		e := <-ch2
+		assert.Equal(fmt.Sprintf("k%d", i), e.Key)
+		assert.Equal(0, e.Missed)
+	}
+	assert.NoError(db.Put("last", []byte("v")))
+	e := <-ch2
+	assert.Equal("last", e.Key)
+	assert.Equal(10, e.Missed)
+
+	assert.NoError(db.Close())
+	_, ok = <-ch2
+	assert.False(ok)
+	stop2()
+}
+
+func TestCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	doc := []byte(strings.Repeat(`{"name": "bitcask", "type": "key/value store"}`, 20))
+
+	db, err := Open(testdir, WithMaxValueSize(len(doc)))
+	assert.NoError(err)
+	assert.NoError(db.Put("plain", doc))
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir, WithCompression(Gzip{}), WithMaxValueSize(len(doc)))
+	assert.NoError(err)
+	assert.NoError(db.PutWithFlags("compressed", doc, 1))
+	assert.NoError(db.Put("short", []byte("short")))
+	assert.NoError(db.PutWithTTL("ttl", doc, time.Hour))
+	assert.Equal(ErrValueTooLarge, db.Put("large", append(doc, ' ')))
+
+	item, _ := db.keydir.Get("compressed")
+	assert.Equal(FlagCompressed|1, item.Flags)
+	assert.True(item.Size < int64(len(doc)))
+	item, _ = db.keydir.Get("short")
+	assert.Equal(uint8(0), item.Flags)
+
+	check := func(db *Bitcask) {
+		for _, key := range []string{"plain", "compressed", "ttl"} {
+			value, err := db.Get(key)
+			assert.NoError(err)
+			assert.Equal(doc, value)
+
+			view, release, err := db.GetView(key)
+			assert.NoError(err)
+			assert.Equal(doc, view)
+			release()
+
+			r, err := db.GetReader(key)
+			assert.NoError(err)
+			value, err = ioutil.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(doc, value)
+			assert.NoError(r.Close())
+
+			size, err := db.Size(key)
+			assert.NoError(err)
+			assert.Equal(int64(len(doc)), size)
+		}
+
+		value, err := db.Get("short")
+		assert.NoError(err)
+		assert.Equal([]byte("short"), value)
+
+		flags, err := db.GetFlags("compressed")
+		assert.NoError(err)
+		assert.Equal(uint8(1), flags)
+
+		values, err := db.GetMulti([]string{"plain", "compressed"})
+		assert.NoError(err)
+		assert.Equal(map[string][]byte{"plain": doc, "compressed": doc}, values)
+
+		it := db.PrefixIterator("compressed")
+		assert.True(it.Next())
+		value, err = it.Value()
+		assert.NoError(err)
+		assert.Equal(doc, value)
+		it.Close()
+	}
+	check(db)
+
+	swapped, err := db.CompareAndSwap("compressed", doc, []byte("swapped"))
+	assert.NoError(err)
+	assert.True(swapped)
+	assert.NoError(db.PutWithFlags("compressed", doc, 1))
+	assert.NoError(db.Close())
+
+	// Compressed values are read without compression enabled, including
+	// once merged
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	check(db)
+	assert.NoError(db.Merge())
+	check(db)
+
+	t.Run("Datafile", func(t *testing.T) {
+		item, _ := db.keydir.Get("compressed")
+		it, err := OpenDatafile(datafilePath(testdir, item.FileID))
+		assert.NoError(err)
+		defer it.Close()
+
+		for it.Next() {
+			if e := it.Entry(); e.Key == "compressed" {
+				assert.Equal(FlagCompressed|1, e.Flags)
+				value, err := Gzip{}.Decompress(e.Value)
+				assert.NoError(err)
+				assert.Equal(doc, value)
+			}
+		}
+		assert.NoError(it.Err())
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		// The size is recorded so the value isn't read
+		item, _ := db.keydir.Get("ttl")
+		f, err := os.OpenFile(datafilePath(testdir, item.FileID), os.O_WRONLY, 0)
+		assert.NoError(err)
+		_, err = f.WriteAt([]byte("x"), item.Offset+item.Size/2)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		_, err = db.Get("ttl")
+		assert.Equal(ErrChecksumFailed, err)
+		size, err := db.Size("ttl")
+		assert.NoError(err)
+		assert.Equal(int64(len(doc)), size)
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithCompression(otherCodec{}))
+		assert.NoError(err)
+		assert.NoError(db.Put("doc", doc))
+		assert.NoError(db.Close())
+
+		// Values compressed with another codec than Gzip can't be read
+		// without it
+		_, err = Open(testdir)
+		assert.Equal(ErrOptionMismatch, errors.Cause(err))
+		assert.Contains(err.Error(), "compression gzip doesn't match the database's other")
+		_, err = Open(testdir, WithCompression(Gzip{}))
+		assert.Equal(ErrOptionMismatch, errors.Cause(err))
+
+		db, err = Open(testdir, WithCompression(otherCodec{}))
+		assert.NoError(err)
+		defer db.Close()
+		value, err := db.Get("doc")
+		assert.NoError(err)
+		assert.Equal(doc, value)
+	})
+}
+
+// otherCodec is a codec other than Gzip (though it compresses as Gzip)
+type otherCodec struct {
+	Gzip
+}
+
+func (otherCodec) Name() string {
+	return "other"
+}
+
+func TestDeleteReclaim(t *testing.T) {
+	assert := assert.New(t)
+
+	deletes := map[string]func(db *Bitcask, keys []string) error{
+		"Delete": func(db *Bitcask, keys []string) error {
+			for _, key := range keys {
+				if err := db.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"Transaction": func(db *Bitcask, keys []string) error {
+			tx := db.Transaction()
+			for _, key := range keys {
+				if err := tx.Delete(key); err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		},
+	}
+
+	for name, remove := range deletes {
+		t.Run(name, func(t *testing.T) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, WithMaxDatafileSize(1024), WithDeleteReclaim(0.5))
+			assert.NoError(err)
+			defer db.Close()
+
+			value := bytes.Repeat([]byte("v"), 100)
+			var keys []string
+			for i := 0; i < 50; i++ {
+				keys = append(keys, fmt.Sprintf("k%02d", i))
+				assert.NoError(db.Put(keys[i], value))
+			}
+			before, err := db.Stats()
+			assert.NoError(err)
+
+			assert.NoError(remove(db, keys[:40]))
+
+			// The merge is made in the background
+			var after Stats
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				after, err = db.Stats()
+				assert.NoError(err)
+				if after.Size < before.Size/2 {
+					break
+				}
+			}
+			assert.True(after.Size < before.Size/2, "size %d of %d", after.Size, before.Size)
+
+			assert.Equal(10, db.Len())
+			for _, key := range keys[40:] {
+				v, err := db.Get(key)
+				assert.NoError(err)
+				assert.Equal(value, v)
+			}
+		})
+	}
+
+	assert.Error(WithDeleteReclaim(0)(newDefaultConfig()))
+	assert.Error(WithDeleteReclaim(1)(newDefaultConfig()))
+}
+
+type benchmarkTestCase struct {
+	name string
+	size int
+}
+
+func BenchmarkGet(b *testing.B) {
+	testdir, err := ioutil.TempDir("", "bitcask")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	db, err := Open(testdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []benchmarkTestCase{
+		{"128B", 128},
+		{"256B", 256},
+		{"512B", 512},
+		{"1K", 1024},
+		{"2K", 2048},
+		{"4K", 4096},
+		{"8K", 8192},
+		{"16K", 16384},
+		{"32K", 32768},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			key := "foo"
+			value := []byte(strings.Repeat(" ", tt.size))
+
+			err = db.Put(key, value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				val, err := db.Get(key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if string(val) != string(value) {
+					b.Errorf("unexpected value")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	testdir, err := ioutil.TempDir("", "bitcask")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	db, err := Open(testdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []benchmarkTestCase{
+		{"128B", 128},
+		{"256B", 256},
+		{"512B", 512},
+		{"1K", 1024},
+		{"2K", 2048},
+		{"4K", 4096},
+		{"8K", 8192},
+		{"16K", 16384},
+		{"32K", 32768},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			key := "foo"
+			value := []byte(strings.Repeat(" ", tt.size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := db.Put(key, value)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	testdir, err := ioutil.TempDir("", "bitcask")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	db, err := Open(testdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	var items = map[string][]byte{
+		"1":     []byte("1"),
+		"2":     []byte("2"),
+		"3":     []byte("3"),
+		"food":  []byte("pizza"),
+		"foo":   []byte("foo"),
+		"fooz":  []byte("fooz ball"),
+		"hello": []byte("world"),
+	}
+	for k, v := range items {
+		err := db.Put(k, v)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var expected = []string{"foo", "food", "fooz"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var keys []string
+		err = db.Scan("fo", func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		sort.Strings(keys)
+		if !reflect.DeepEqual(expected, keys) {
+			b.Fatal(fmt.Errorf("expected keys=#%v got=%#v", expected, keys))
+		}
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	value := []byte(strings.Repeat(" ", 128))
+
+	open := func(b *testing.B) *Bitcask {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		db, err := Open(testdir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return db
+	}
+
+	b.Run("Put", func(b *testing.B) {
+		db := open(b)
+		defer db.Close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Put(fmt.Sprintf("k%d", i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("BulkLoad", func(b *testing.B) {
+		db := open(b)
+		defer db.Close()
+
+		b.ResetTimer()
+		err := db.BulkLoad(func(put func(key string, value []byte) error) error {
+			for i := 0; i < b.N; i++ {
+				if err := put(fmt.Sprintf("k%d", i), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkDurablePut(b *testing.B) {
+	tests := []struct {
+		name    string
+		options []Option
+		sync    bool
+	}{
+		{"Sync", nil, true},
+		{"GroupCommit", []Option{WithGroupCommit(time.Millisecond, 64)}, false},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, tt.options...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			value := []byte(strings.Repeat(" ", 128))
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := db.Put("foo", value); err != nil {
+						b.Fatal(err)
+					}
+					if tt.sync {
+						if err := db.Sync(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkSyncWrites(b *testing.B) {
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{"Off", false},
+		{"On", true},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, WithSyncWrites(tt.enabled))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			value := []byte(strings.Repeat(" ", 128))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Put("foo", value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{"Scan", nil},
+		{"PersistentIndex", []Option{WithPersistentIndex(false)}},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, append(tt.options, WithMaxDatafileSize(1<<30))...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 100000; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				b.Fatal(err)
+			}
+
+			// Read-only so that closing doesn't save the index again
+			options := append(tt.options, WithReadOnly())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db, err := Open(testdir, options...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				db.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkIncr(b *testing.B) {
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{"Append", nil},
+		{"CounterRegion", []Option{WithCounterRegion(time.Second, "foo")}},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir, tt.options...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Incr("foo", 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetView(b *testing.B) {
+	tests := []benchmarkTestCase{
+		{"1K", 1024},
+		{"32K", 32768},
+	}
+
+	for _, tt := range tests {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(tt.size+128))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+
+		key := "foo"
+		value := []byte(strings.Repeat(" ", tt.size))
+		if err := db.Put(key, value); err != nil {
+			b.Fatal(err)
+		}
+
+		// Rotate the active datafile so that the key is in an older
+		// (memory mapped) datafile
+		if err := db.Put("bar", value); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(tt.name+"/Get", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				val, err := db.Get(key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(val) != len(value) {
+					b.Errorf("unexpected value")
+				}
+			}
+		})
+
+		b.Run(tt.name+"/GetView", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				val, release, err := db.GetView(key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(val) != len(value) {
+					b.Errorf("unexpected value")
+				}
+				release()
+			}
+		})
 	}
 }
@@ -0,0 +1,28 @@
+package bitcask
+
+// The index of the database is keyed by strings, which in Go are sequences
+// of bytes, so the methods below are merely conveniences for keys held as
+// byte slices: the key []byte("foo") is the same key as "foo" and a key
+// written with PutBytes can be read with Get (and vice versa). Keys are
+// stored as protobuf strings in the datafiles so, whichever methods are
+// used, must be valid UTF-8 (see ErrInvalidKey).
+
+// PutBytes is Put for a key held as a byte slice
+func (b *Bitcask) PutBytes(key, value []byte) error {
+	return b.Put(string(key), value)
+}
+
+// GetBytes is Get for a key held as a byte slice
+func (b *Bitcask) GetBytes(key []byte) ([]byte, error) {
+	return b.Get(string(key))
+}
+
+// HasBytes is Has for a key held as a byte slice
+func (b *Bitcask) HasBytes(key []byte) bool {
+	return b.Has(string(key))
+}
+
+// DeleteBytes is Delete for a key held as a byte slice
+func (b *Bitcask) DeleteBytes(key []byte) error {
+	return b.Delete(string(key))
+}
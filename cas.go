@@ -0,0 +1,66 @@
+package bitcask
+
+import (
+	"bytes"
+)
+
+// CompareAndSwap atomically sets the value of the given key to `new` if its
+// current value is `old`, or if `old` is nil if the key is not found (an
+// empty but non-nil `old` only matches an empty value), and returns whether
+// it did. The comparison and the write are made under the write lock so no
+// other write of the key can come in between them. If the value was
+// swapped but syncing it (see WithSyncWrites) failed the error is returned
+// along with true.
+func (b *Bitcask) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	if err := b.checkPut(key, new); err != nil {
+		return false, err
+	}
+
+	swapped, err := b.compareAndSwap(key, old, new)
+	if err != nil || !swapped {
+		return false, err
+	}
+	if err := b.commit(); err != nil {
+		return true, err
+	}
+	b.config.metrics.IncPut()
+	return true, nil
+}
+
+// PutIfAbsent stores the key and value in the database if the key is not
+// found and returns whether it did, like CompareAndSwap with a nil `old`.
+func (b *Bitcask) PutIfAbsent(key string, value []byte) (bool, error) {
+	return b.CompareAndSwap(key, nil, value)
+}
+
+func (b *Bitcask) compareAndSwap(key string, old, new []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current, err := b.current(key)
+	switch {
+	case err == ErrKeyNotFound:
+		if old != nil {
+			return false, nil
+		}
+	case err != nil:
+		return false, err
+	case old == nil || !bytes.Equal(current, old):
+		return false, nil
+	}
+
+	if err := b.update(key, new, 0, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// current returns the current value of the key; the caller must hold the
+// read (or write) lock.
+func (b *Bitcask) current(key string) ([]byte, error) {
+	e, _, err := b.read(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.config.value(e)
+}
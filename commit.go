@@ -0,0 +1,118 @@
+package bitcask
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// committer batches the syncs of concurrent writes (see WithGroupCommit)
+type committer struct {
+	requests chan chan error
+	quit     chan struct{}
+	done     chan struct{}
+
+	// closed is closed once Close has synced the writes the committer was
+	// stopped before syncing, with the error returned by Close in err
+	closed chan struct{}
+	err    error
+}
+
+func (b *Bitcask) startCommitter() {
+	b.committer = &committer{
+		requests: make(chan chan error),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go b.runCommitter(b.config.groupCommitDelay, b.config.groupCommitBatch)
+}
+
+// stopCommitter stops the committer once the batch in progress, if any, has
+// been synced.
+func (b *Bitcask) stopCommitter() {
+	if b.committer == nil {
+		return
+	}
+	close(b.committer.quit)
+	<-b.committer.done
+}
+
+// closeCommitter reports the result `err` of closing the database, and so
+// of syncing the writes made since the committer was stopped, to the writes
+// waiting for it.
+func (b *Bitcask) closeCommitter(err error) {
+	if b.committer == nil {
+		return
+	}
+	b.committer.err = err
+	close(b.committer.closed)
+}
+
+// commit waits until the writes made so far have been synced to disk (see
+// WithGroupCommit and WithSyncWrites); the caller must not hold the lock.
+func (b *Bitcask) commit() error {
+	if b.committer == nil {
+		if b.config.syncWrites {
+			return b.syncActive()
+		}
+		return nil
+	}
+
+	req := make(chan error, 1)
+	select {
+	case b.committer.requests <- req:
+		return <-req
+	case <-b.committer.done:
+		// The database is being closed which syncs all writes
+		<-b.committer.closed
+		return b.committer.err
+	}
+}
+
+func (b *Bitcask) runCommitter(maxDelay time.Duration, maxBatch int) {
+	defer close(b.committer.done)
+
+	for {
+		var batch []chan error
+
+		select {
+		case req := <-b.committer.requests:
+			batch = append(batch, req)
+		case <-b.committer.quit:
+			return
+		}
+
+		timer := time.NewTimer(maxDelay)
+	collect:
+		for len(batch) < maxBatch {
+			select {
+			case req := <-b.committer.requests:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		err := b.syncActive()
+		for _, req := range batch {
+			req <- err
+		}
+	}
+}
+
+// syncActive syncs the active datafile without holding the lock for the
+// duration of the sync so that writers can keep writing to it in the
+// meantime. Datafiles that are rotated out are synced when they are closed.
+func (b *Bitcask) syncActive() error {
+	b.mu.RLock()
+	curr := b.curr
+	b.mu.RUnlock()
+
+	err := curr.Sync()
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package bitcask
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	pb "github.com/prologic/bitcask/internal/proto"
+)
+
+// Codec compresses and decompresses the values of the database (see
+// WithCompression).
+type Codec interface {
+	// Name returns the name of the codec, which is recorded in the
+	// database's meta file so that the database isn't opened with another
+	// codec (see ErrOptionMismatch)
+	Name() string
+
+	// Compress returns the compressed value
+	Compress(value []byte) []byte
+
+	// Decompress returns the value decompressed from the value `data`
+	// compressed by Compress
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Gzip is the built-in Codec compressing values with gzip, which is also
+// used to decompress the values of a database written with it once it is
+// opened without WithCompression.
+type Gzip struct{}
+
+// Name returns "gzip"
+func (Gzip) Name() string {
+	return "gzip"
+}
+
+// Compress returns the value gzip compressed
+func (Gzip) Compress(value []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	// Writes to a bytes.Buffer don't fail
+	w.Write(value)
+	w.Close()
+	return buf.Bytes()
+}
+
+// Decompress returns the value decompressed from the gzip compressed `data`
+func (Gzip) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// compress returns the value to write for the given value and whether it is
+// compressed, which it is only if compressing it makes it smaller.
+func (cfg *config) compress(value []byte) ([]byte, bool) {
+	if cfg.compression == nil || len(value) == 0 {
+		return value, false
+	}
+	if data := cfg.compression.Compress(value); len(data) < len(value) {
+		return data, true
+	}
+	return value, false
+}
+
+// value returns the value of the entry `e`, decompressing it if it is
+// compressed, with the codec set by WithCompression or otherwise Gzip.
+func (cfg *config) value(e pb.Entry) ([]byte, error) {
+	if uint8(e.Flags)&FlagCompressed == 0 {
+		return e.Value, nil
+	}
+
+	codec := cfg.compression
+	if codec == nil {
+		codec = Gzip{}
+	}
+	value, err := codec.Decompress(e.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decompressing value of key %q", e.Key)
+	}
+	return value, nil
+}
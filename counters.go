@@ -0,0 +1,433 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+const countersFilename = "counters"
+
+var (
+	// ErrNotInteger is the error returned by Incr when the value of the key
+	// is not an integer
+	ErrNotInteger = errors.New("error: value is not an integer")
+
+	// ErrCounterKey is the error returned when trying to put or delete a
+	// key of the counter region (see WithCounterRegion)
+	ErrCounterKey = errors.New("error: key is a counter")
+)
+
+// Incr increments the integer value of the key by `delta` and returns the
+// new value. A key that doesn't exist is taken to be zero. Values are
+// stored as decimal strings so Get returns them as such.
+//
+// Counters registered with WithCounterRegion are incremented in memory and
+// checkpointed to the counter region, all other keys are read and written
+// back to the active datafile like any other put.
+func (b *Bitcask) Incr(key string, delta int64) (int64, error) {
+	if b.config.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	// Other keys are fenced when they are written
+	if b.config.fencing && b.counters.has(key) {
+		if err := b.checkFence(); err != nil {
+			return 0, err
+		}
+	}
+
+	if n, ok := b.counters.incr(key, delta); ok {
+		return n, nil
+	}
+
+	if len(key) > b.config.maxKeySize {
+		return 0, ErrKeyTooLarge
+	}
+
+	n, err := b.incr(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	return n, b.commit()
+}
+
+func (b *Bitcask) incr(key string, delta int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var n int64
+	current, err := b.current(key)
+	switch err {
+	case nil:
+		n, err = strconv.ParseInt(string(current), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	case ErrKeyNotFound:
+	default:
+		return 0, err
+	}
+	n += delta
+
+	if err := b.flushPending(key); err != nil {
+		return 0, err
+	}
+
+	value := []byte(strconv.FormatInt(n, 10))
+	item, err := b.put(key, value, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	b.keydir.Overwrite(key, item)
+	b.trie.Add(key)
+	b.recent.Add(key)
+
+	b.notify(EventPut, key, value)
+
+	return n, nil
+}
+
+// loadCounters opens the counter region of the database adding the counters
+// registered with WithCounterRegion. Registered keys already stored in the
+// datafiles are moved to the counter region.
+func (b *Bitcask) loadCounters() error {
+	c, err := openCounters(b.path, b.config.counterKeys, b.config.readOnly, func(key string) (int64, error) {
+		e, _, err := b.get(key)
+		if err == ErrKeyNotFound {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		value, err := b.config.value(e)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+		return n, nil
+	})
+	if err != nil {
+		return err
+	}
+	b.counters = c
+
+	if b.config.readOnly {
+		return nil
+	}
+
+	// The values moved are safely in the counter region by now and are
+	// removed from the datafiles. The region is preferred over any copy of
+	// a counter still in the datafiles, e.g: one left behind by a crash
+	// while it was moved, which is removed too.
+	for _, key := range c.list() {
+		if _, ok := b.keydir.Get(key); !ok {
+			continue
+		}
+		if err := b.remove(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// counters is the counter region (see WithCounterRegion). The region file
+// holds a fixed size slot for each counter, a big-endian 16-bit key length
+// followed by the key and its big-endian 64-bit value, which is laid out
+// when the database is opened and then memory mapped. Increments only
+// update the values held in memory; checkpoints then overwrite the 8 bytes
+// of the value of each counter changed since the last checkpoint in place
+// in the mapping and sync it to disk.
+type counters struct {
+	sync.Mutex
+
+	path   string
+	region *internal.WritableRegion
+	keys   []string
+	slots  map[string]*slot
+
+	// checkpointing serialises checkpoints so that an older value is never
+	// written over a newer one
+	checkpointing sync.Mutex
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+type slot struct {
+	offset int64 // of the value in the region file
+	value  int64
+	dirty  bool
+}
+
+// openCounters loads the counter region of the database at `path` and adds
+// the given keys to it. New counters are initialised with the value returned
+// by `initial` for them. The region is not modified for a read-only
+// database.
+func openCounters(path string, keys []string, readOnly bool, initial func(key string) (int64, error)) (*counters, error) {
+	c := &counters{path: filepath.Join(path, countersFilename)}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return c, nil
+	}
+
+	var added bool
+	for _, key := range keys {
+		if _, ok := c.slots[key]; ok {
+			continue
+		}
+		if len(key) > math.MaxUint16 {
+			return nil, ErrKeyTooLarge
+		}
+		value, err := initial(key)
+		if err != nil {
+			return nil, err
+		}
+		c.keys = append(c.keys, key)
+		c.slots[key] = &slot{value: value}
+		added = true
+	}
+
+	if len(c.keys) == 0 {
+		return c, nil
+	}
+
+	if added {
+		if err := c.layout(); err != nil {
+			return nil, err
+		}
+	}
+
+	region, err := internal.OpenWritableRegion(c.path)
+	if err != nil {
+		return nil, err
+	}
+	c.region = region
+
+	return c, nil
+}
+
+// load reads the counters and their values from the region file
+func (c *counters) load() error {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.keys = nil
+	c.slots = make(map[string]*slot)
+
+	for offset := 0; offset < len(data); {
+		if offset+2 > len(data) {
+			return errors.New("error: counter region is truncated")
+		}
+		n := int(binary.BigEndian.Uint16(data[offset:]))
+		offset += 2
+
+		if offset+n+8 > len(data) {
+			return errors.New("error: counter region is truncated")
+		}
+		key := string(data[offset : offset+n])
+		offset += n
+
+		c.keys = append(c.keys, key)
+		c.slots[key] = &slot{
+			offset: int64(offset),
+			value:  int64(binary.BigEndian.Uint64(data[offset:])),
+		}
+		offset += 8
+	}
+
+	return nil
+}
+
+// layout atomically rewrites the region file with a slot for every counter
+func (c *counters) layout() error {
+	var data []byte
+	for _, key := range c.keys {
+		s := c.slots[key]
+
+		data = append(data, 0, 0)
+		binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(key)))
+		data = append(data, key...)
+
+		s.offset = int64(len(data))
+		data = append(data, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(data[s.offset:], uint64(s.value))
+		s.dirty = false
+	}
+
+	f, err := os.Create(c.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(c.path+".tmp", c.path)
+}
+
+func (c *counters) has(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.slots[key]
+	return ok
+}
+
+// list returns the keys of the counters
+func (c *counters) list() []string {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]string(nil), c.keys...)
+}
+
+func (c *counters) get(key string) (int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	s, ok := c.slots[key]
+	if !ok {
+		return 0, false
+	}
+	return s.value, true
+}
+
+func (c *counters) incr(key string, delta int64) (int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	s, ok := c.slots[key]
+	if !ok {
+		return 0, false
+	}
+	s.value += delta
+	s.dirty = true
+	return s.value, true
+}
+
+// checkpoint writes the values of the counters changed since the last
+// checkpoint to their slots in the mapped region file and syncs it
+func (c *counters) checkpoint() error {
+	if c.region == nil {
+		return nil
+	}
+
+	c.checkpointing.Lock()
+	defer c.checkpointing.Unlock()
+
+	type write struct {
+		offset int64
+		value  int64
+	}
+
+	c.Lock()
+	var writes []write
+	for _, s := range c.slots {
+		if s.dirty {
+			writes = append(writes, write{s.offset, s.value})
+			s.dirty = false
+		}
+	}
+	c.Unlock()
+
+	if len(writes) == 0 {
+		return nil
+	}
+
+	data := c.region.Bytes()
+	for _, w := range writes {
+		binary.BigEndian.PutUint64(data[w.offset:], uint64(w.value))
+	}
+	if err := c.region.Sync(); err != nil {
+		c.redirty()
+		return err
+	}
+	return nil
+}
+
+// redirty marks all counters as changed after a failed checkpoint so that
+// the next checkpoint writes them again.
+func (c *counters) redirty() {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, s := range c.slots {
+		s.dirty = true
+	}
+}
+
+// start checkpoints the region every `interval` until stopped
+func (c *counters) start(interval time.Duration) {
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// A failed checkpoint is retried by the next one (or
+				// Close which returns the error)
+				c.checkpoint()
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (c *counters) stop() {
+	if c.quit == nil {
+		return
+	}
+	close(c.quit)
+	<-c.done
+	c.quit = nil
+}
+
+// close writes a final checkpoint and unmaps the region file
+func (c *counters) close() error {
+	c.stop()
+
+	if c.region == nil {
+		return nil
+	}
+	if err := c.checkpoint(); err != nil {
+		c.region.Close()
+		return err
+	}
+	return c.region.Close()
+}
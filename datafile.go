@@ -0,0 +1,143 @@
+package bitcask
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	pb "github.com/prologic/bitcask/internal/proto"
+	"github.com/prologic/bitcask/internal/streampb"
+)
+
+// DatafileEntry is a single entry read from a datafile with OpenDatafile
+type DatafileEntry struct {
+	// Key is the entry's key
+	Key string
+
+	// Value is the entry's value as it is stored, i.e: compressed if
+	// Flags has FlagCompressed set (see WithCompression)
+	Value []byte
+
+	// Flags are the entry's flags (see PutWithFlags) including those
+	// reserved by the library (see ReservedFlags): the tombstone of a
+	// deleted key has FlagTombstone set, or for tombstones written by
+	// older versions an empty value
+	Flags uint8
+
+	// Sequence is the entry's sequence number (see Bitcask.Sequence) or
+	// zero for entries written before sequence numbers were recorded
+	Sequence uint64
+
+	// Expiry is the time the entry expires at (see PutWithTTL) or the zero
+	// time if it doesn't expire
+	Expiry time.Time
+
+	// Offset is the entry's offset in the datafile
+	Offset int64
+
+	// Timestamp is the time the entry was written or the zero time for
+	// entries written before timestamps were recorded
+	Timestamp time.Time
+
+	// Valid is false if the entry's value does not match its checksum
+	Valid bool
+}
+
+// DatafileIterator iterates over all entries of a single datafile in the
+// order they were written, including stale entries superseded by later
+// writes and tombstones of deleted keys. See OpenDatafile.
+type DatafileIterator struct {
+	f         *os.File
+	dec       *streampb.Decoder
+	offset    int64
+	entry     DatafileEntry
+	truncated bool
+	err       error
+}
+
+// OpenDatafile opens the datafile at the given path for reading its entries
+// independent of any database, index or lock. This is intended for tooling
+// and recovery of databases that cannot be opened. A truncated or otherwise
+// unreadable trailing entry ends the iteration and is reported by Truncated
+// rather than as an error.
+func OpenDatafile(path string) (*DatafileIterator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DatafileIterator{
+		f:   f,
+		dec: streampb.NewDecoder(f),
+	}, nil
+}
+
+// Next advances the iterator to the next entry returning false when there
+// are no more entries or an error occurred.
+func (it *DatafileIterator) Next() bool {
+	if it.err != nil || it.truncated {
+		return false
+	}
+
+	var e pb.Entry
+	n, err := it.dec.Decode(&e)
+	if err != nil {
+		if err == io.EOF {
+			return false
+		}
+		if _, ok := errors.Cause(err).(*os.PathError); ok {
+			it.err = err
+		} else {
+			it.truncated = true
+		}
+		return false
+	}
+
+	it.entry = DatafileEntry{
+		Key:      e.Key,
+		Value:    e.Value,
+		Flags:    uint8(e.Flags),
+		Sequence: e.Sequence,
+		Offset:   it.offset,
+		Valid:    crc32.ChecksumIEEE(e.Value) == e.Checksum,
+	}
+	if e.Timestamp != 0 {
+		it.entry.Timestamp = time.Unix(0, e.Timestamp)
+	}
+	if e.Expiry != 0 {
+		it.entry.Expiry = time.Unix(e.Expiry, 0)
+	}
+	it.offset += n
+
+	return true
+}
+
+// Entry returns the current entry
+func (it *DatafileIterator) Entry() DatafileEntry {
+	return it.entry
+}
+
+// Truncated returns true if the iteration stopped at a truncated or
+// unreadable trailing entry. Offset then returns the offset of the first
+// unreadable byte (i.e: the size of the valid portion of the datafile).
+func (it *DatafileIterator) Truncated() bool {
+	return it.truncated
+}
+
+// Offset returns the offset following the last entry read
+func (it *DatafileIterator) Offset() int64 {
+	return it.offset
+}
+
+// Err returns the error, if any, that occurred during iteration
+func (it *DatafileIterator) Err() error {
+	return it.err
+}
+
+// Close closes the underlying datafile
+func (it *DatafileIterator) Close() error {
+	return it.f.Close()
+}
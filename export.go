@@ -0,0 +1,329 @@
+package bitcask
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	pb "github.com/prologic/bitcask/internal/proto"
+	"github.com/prologic/bitcask/internal/streampb"
+)
+
+var (
+	// ErrInvalidBackup is the error returned by Restore when the stream
+	// isn't a backup written by Backup
+	ErrInvalidBackup = errors.New("error: invalid backup")
+
+	// ErrInvalidExport is the error returned by Apply when the stream
+	// isn't an export written by ExportSince
+	ErrInvalidExport = errors.New("error: invalid export")
+)
+
+// backupMagic starts every backup so that Restore can tell a backup from
+// any other stream (including ExportSince's)
+var backupMagic = []byte("bitcask backup 1\n")
+
+// exportMagic starts every export written by ExportSince so that Apply can
+// tell an export from any other stream (including Backup's)
+var exportMagic = []byte("bitcask export 1\n")
+
+// Sequence returns the sequence number of the last write to the database.
+// Every put and delete is assigned the next sequence number, so recording
+// the sequence number when taking a full backup allows the keys written
+// since to be exported later with ExportSince.
+func (b *Bitcask) Sequence() uint64 {
+	if err := b.maybeRefresh(); err != nil {
+		return 0
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.keydir.Sequence()
+}
+
+// ExportSince writes the current value of every key written after the
+// write with the sequence number `seq` (see Sequence), and a tombstone for
+// every key deleted since, to `w` in the order they were written, allowing
+// incremental backups that only contain the keys that changed since the
+// last backup, which are applied with Apply. Entries are encoded as in the
+// datafiles after a short header and, as with Backup, are of a point in
+// time snapshot taken under the read lock after which they are streamed
+// (and verified as by Get) without holding any lock, so a slow `w` doesn't
+// block writes. Deletes are known from the tombstones on disk when the
+// database is opened, so those whose tombstones were since dropped by a
+// merge (of the oldest datafile) are only exported until the database is
+// reopened; nor does the history carry over ReplaceWith and Swap after
+// which a full backup must be taken.
+func (b *Bitcask) ExportSince(seq uint64, w io.Writer) error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+
+	s, err := b.snapshotSince(seq)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if _, err := w.Write(exportMagic); err != nil {
+		return err
+	}
+
+	enc := streampb.NewEncoder(w)
+	for _, key := range s.keys {
+		e, err := s.entry(key)
+		if err != nil {
+			return err
+		}
+		if _, err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotSince takes a snapshot of the keys written or deleted after the
+// write with the sequence number `seq`, in the order they were written,
+// which must be closed
+func (b *Bitcask) snapshotSince(seq uint64) (*snapshot, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	items := b.keydir.Snapshot()
+	deleted := b.keydir.DeletedSince(seq)
+	sequence := func(key string) uint64 {
+		if n, ok := deleted[key]; ok {
+			return n
+		}
+		return items[key].Sequence
+	}
+
+	var keys []string
+	for key, item := range items {
+		if item.Sequence > seq {
+			keys = append(keys, key)
+		}
+	}
+	for key := range deleted {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return sequence(keys[i]) < sequence(keys[j]) })
+
+	s := b.newSnapshot()
+	s.deleted = deleted
+	for _, key := range keys {
+		if _, ok := deleted[key]; ok {
+			s.keys = append(s.keys, key)
+			continue
+		}
+		if err := s.add(b, key, items[key]); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Backup writes the value of every key in the database to `w`, encoded as in
+// the datafiles after a short header, as of a point in time snapshot of the
+// database. Each entry carries its key, value, checksum, flags and expiry so
+// the backup can be restored with Restore. The snapshot is taken under the
+// read lock, which only briefly blocks writes, after which the values are
+// streamed without holding any lock so writes continue while the backup is
+// written; writes after the snapshot are not included. The datafiles of the
+// snapshot are held open until the backup is written so that values of
+// datafiles removed in the meantime (e.g: by CompactDatafile or ReplaceWith)
+// can still be read; with WithEagerCloseDatafiles or WithMaxOpenFiles they
+// are instead pinned by hard links, so as not to hold them all open, and
+// opened as they are read. Recording Sequence before taking a backup allows
+// following backups to be incremental (see ExportSince).
+func (b *Bitcask) Backup(w io.Writer) error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+
+	snapshot, err := b.snapshot("")
+	if err != nil {
+		return err
+	}
+	defer snapshot.close()
+
+	// Read in datafile order
+	keys := append([]string(nil), snapshot.keys...)
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, aok := snapshot.items[keys[i]]
+		b, bok := snapshot.items[keys[j]]
+		switch {
+		case aok && bok && a.FileID != b.FileID:
+			return a.FileID < b.FileID
+		case aok && bok:
+			return a.Offset < b.Offset
+		default:
+			// Values held in memory last
+			return aok && !bok
+		}
+	})
+
+	if _, err := w.Write(backupMagic); err != nil {
+		return err
+	}
+
+	enc := streampb.NewEncoder(w)
+	for _, key := range keys {
+		e, err := snapshot.entry(key)
+		if err != nil {
+			return err
+		}
+		if _, err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore creates a new database at `dir`, which must not exist yet, from
+// a backup written by Backup. The restored database contains exactly the
+// keys and values (and their flags, expiry and sequence numbers) of the
+// backup. Restore accepts the same options as Open with which the restored
+// database is opened while restoring. If Restore fails `dir` is left
+// behind with whatever was restored so far and should be removed.
+func Restore(dir string, r io.Reader, options ...Option) error {
+	if _, err := os.Stat(dir); err == nil {
+		return errors.Errorf("error: destination %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, backupMagic) {
+		return ErrInvalidBackup
+	}
+
+	db, err := Open(dir, options...)
+	if err != nil {
+		return err
+	}
+
+	if err := db.restore(streampb.NewDecoder(br)); err != nil {
+		db.Close()
+		return err
+	}
+
+	return db.Close()
+}
+
+// Apply applies an export written by ExportSince to the database, writing
+// the keys and values (and their flags, expiry and sequence numbers) of
+// the export and deleting the keys it deleted, so that a database restored
+// from a backup (see Restore) is brought up to date by applying the
+// exports taken since, in order. If Apply fails the entries applied so far
+// are kept and the export should be applied again.
+func (b *Bitcask) Apply(r io.Reader) error {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, exportMagic) {
+		return ErrInvalidExport
+	}
+
+	return b.restore(streampb.NewDecoder(br))
+}
+
+// restore writes the entries decoded by `dec` to the database as is,
+// deleting the keys of tombstones
+func (b *Bitcask) restore(dec *streampb.Decoder) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var e pb.Entry
+		if _, err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrap(err, "error decoding backup")
+		}
+		if crc32.ChecksumIEEE(e.Value) != e.Checksum {
+			return ErrChecksumFailed
+		}
+		if len(e.Key) > b.config.maxKeySize {
+			return ErrKeyTooLarge
+		}
+		if len(e.Value) > b.config.maxValueSize {
+			return ErrValueTooLarge
+		}
+
+		if err := b.flushPending(e.Key); err != nil {
+			return err
+		}
+		item, err := b.write(copied(e))
+		if err != nil {
+			return err
+		}
+		b.keydir.UpdateSequence(e.Sequence)
+
+		// Tombstone value  (deleted key)
+		if len(e.Value) == 0 {
+			b.keydir.Remove(e.Key, e.Sequence)
+			b.trie.Remove(e.Key)
+			b.recent.Remove(e.Key)
+			continue
+		}
+
+		b.keydir.Overwrite(e.Key, item)
+		b.trie.Add(e.Key)
+		b.recent.Add(e.Key)
+	}
+
+	return b.curr.Sync()
+}
+
+// MergeTo writes a merged copy of the database, containing only the
+// current value of every key (and no overwritten values or deleted keys),
+// to a new database at `dir`, which must not exist yet, leaving the
+// database itself as it is. It is the equivalent of restoring a backup (see
+// Backup and Restore) without the intermediate stream: the copy is of a
+// point in time snapshot of the database taken under the read lock and is
+// opened with the database's maximum datafile, key and value sizes and
+// then `options` while it is written. If MergeTo fails `dir` is left behind
+// with whatever was written so far and should be removed.
+func (b *Bitcask) MergeTo(dir string, options ...Option) error {
+	options = append([]Option{
+		WithMaxDatafileSize(b.config.maxDatafileSize),
+		WithMaxKeySize(b.config.maxKeySize),
+		WithMaxValueSize(b.config.maxValueSize),
+	}, options...)
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := b.Backup(w)
+		w.CloseWithError(err)
+		done <- err
+	}()
+
+	err := Restore(dir, r, options...)
+	// Stops the backup if the copy failed
+	r.CloseWithError(err)
+	if berr := <-done; err == nil {
+		err = berr
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package bitcask
+
+import (
+	"github.com/prologic/bitcask/internal"
+)
+
+// FaultPoint is a point at which a FaultInjector is called
+type FaultPoint int
+
+const (
+	// FaultWrite is the point at which bytes are written to the active
+	// datafile (by Put, Delete, etc.)
+	FaultWrite FaultPoint = iota + 1
+
+	// FaultRotate is the point between closing the full active datafile
+	// and creating the next one
+	FaultRotate
+
+	// FaultMergeWrite is the point at which bytes are written to the
+	// output of a merge
+	FaultMergeWrite
+
+	// FaultMergeCommit is the point at which the complete output of a
+	// merge is about to be committed
+	FaultMergeCommit
+)
+
+// String returns the name of the fault point
+func (p FaultPoint) String() string {
+	switch p {
+	case FaultWrite:
+		return "write"
+	case FaultRotate:
+		return "rotate"
+	case FaultMergeWrite:
+		return "merge write"
+	case FaultMergeCommit:
+		return "merge commit"
+	default:
+		return "unknown"
+	}
+}
+
+// FaultInjector injects faults into the database's writes to test its
+// crash consistency and recovery (see WithFaultInjector).
+type FaultInjector interface {
+	// Fault is called at every fault point. At FaultWrite and
+	// FaultMergeWrite `p` are the bytes about to be written, otherwise it
+	// is nil. Returning a nil error lets the operation proceed as normal
+	// (and `n` is ignored); otherwise only the first `n` bytes of `p` are
+	// written (a short, torn, write) and the operation fails with the
+	// error.
+	Fault(point FaultPoint, p []byte) (n int, err error)
+}
+
+// fault calls the fault injector, if any, at the given (non-write) fault
+// point.
+func (cfg *config) fault(point FaultPoint) error {
+	if cfg.faultInjector == nil {
+		return nil
+	}
+	_, err := cfg.faultInjector.Fault(point, nil)
+	return err
+}
+
+// injectWrites makes the writes to the datafile call the fault injector, if
+// any, at the given fault point.
+func (cfg *config) injectWrites(df *internal.Datafile, point FaultPoint) {
+	if cfg.faultInjector == nil {
+		return
+	}
+	fi := cfg.faultInjector
+	df.SetWriteHook(func(p []byte) (int, error) {
+		return fi.Fault(point, p)
+	})
+}
@@ -0,0 +1,213 @@
+package bitcask
+
+import (
+	"math"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	pb "github.com/prologic/bitcask/internal/proto"
+)
+
+// maxGroupBatch is the number of pending writes to a group (see PutGrouped)
+// after which the group is written out
+const maxGroupBatch = 64
+
+// group holds the pending writes to a group of co-accessed keys
+type group struct {
+	keys   []string
+	writes map[string]pendingWrite
+}
+
+// pendingWrite is a pending write to a group
+type pendingWrite struct {
+	value []byte
+
+	// time is the time (in nanoseconds since the epoch) the write was made
+	// and expiry the time (in seconds since the epoch) it expires at, if
+	// any, which its entry is written with
+	time   int64
+	expiry int64
+}
+
+// PutGrouped stores the key and value in the database as part of the group
+// `groupID`. Writes to the same group are buffered and written out together
+// at contiguous offsets of the same datafile so that reading the keys of a
+// group together needs fewer seeks (useful for spinning disks and cold
+// caches). A group is written out once it has accumulated enough writes,
+// when one of its keys is written with Put or Delete, or by FlushGroups,
+// Sync and Close.
+//
+// Placement is best-effort: the keys of a group may be relocated by a merge
+// and keys of a group that are written out at different times are not
+// placed together. Pending writes are visible to Get and Has but not to Len,
+// Keys, Fold or Scan until the group is written out and, like any unwritten
+// data, are lost if the process crashes.
+func (b *Bitcask) PutGrouped(groupID, key string, value []byte) error {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+	if err := b.checkPut(key, value); err != nil {
+		return err
+	}
+	// The write is acknowledged before it is written out and so must be
+	// known to fit into a datafile
+	if err := b.checkEntrySize(groupedEntry(key, value, b.config.expiry)); err != nil {
+		return err
+	}
+
+	// The caller may reuse the value once PutGrouped returns
+	value = append([]byte(nil), value...)
+
+	b.mu.Lock()
+	err := b.putGrouped(groupID, key, value)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	b.config.metrics.IncPut()
+	return nil
+}
+
+// putGrouped adds the write of the key and value to the group; the caller
+// must hold the write lock.
+func (b *Bitcask) putGrouped(groupID, key string, value []byte) error {
+	if id, ok := b.pending[key]; ok && id != groupID {
+		if err := b.flushGroup(id); err != nil {
+			return err
+		}
+	}
+
+	g, ok := b.groups[groupID]
+	if !ok {
+		g = &group{writes: make(map[string]pendingWrite)}
+		b.groups[groupID] = g
+	}
+
+	if _, ok := g.writes[key]; !ok {
+		g.keys = append(g.keys, key)
+	}
+	w := pendingWrite{value: value, time: time.Now().UnixNano()}
+	if b.config.expiry > 0 {
+		w.expiry = expiry(b.config.expiry)
+	}
+	g.writes[key] = w
+	b.pending[key] = groupID
+	b.recent.Add(key)
+
+	b.notify(EventPut, key, value)
+
+	if len(g.keys) >= maxGroupBatch {
+		return b.flushGroup(groupID)
+	}
+
+	return nil
+}
+
+// FlushGroups writes out all pending writes made with PutGrouped
+func (b *Bitcask) FlushGroups() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flushGroups()
+}
+
+// getPending returns the value of a pending grouped write of the key, if
+// any; the caller must hold the read lock.
+func (b *Bitcask) getPending(key string) ([]byte, bool) {
+	id, ok := b.pending[key]
+	if !ok {
+		return nil, false
+	}
+	return b.groups[id].writes[key].value, true
+}
+
+// pendingTime returns the time (in nanoseconds since the epoch) of the
+// pending grouped write of the key, if any; the caller must hold the read
+// lock.
+func (b *Bitcask) pendingTime(key string) (int64, bool) {
+	id, ok := b.pending[key]
+	if !ok {
+		return 0, false
+	}
+	return b.groups[id].writes[key].time, true
+}
+
+// flushPending writes out the group with a pending write of the key, if
+// any; the caller must hold the write lock.
+func (b *Bitcask) flushPending(key string) error {
+	if id, ok := b.pending[key]; ok {
+		return b.flushGroup(id)
+	}
+	return nil
+}
+
+func (b *Bitcask) flushGroups() error {
+	for id := range b.groups {
+		if err := b.flushGroup(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupedEntry returns an entry for the key and value at least as large as
+// the entry flushGroup writes for them.
+func groupedEntry(key string, value []byte, ttl time.Duration) pb.Entry {
+	e := internal.NewEntry(key, value)
+	e.Flags = math.MaxUint32
+	e.Sequence = math.MaxUint64
+	e.ValueSize = int64(len(value))
+	if ttl > 0 {
+		e.Expiry = expiry(ttl)
+	}
+	return e
+}
+
+// flushGroup writes out the pending writes of the group rotating the active
+// datafile first if they would not fit; the caller must hold the write lock.
+// If a write fails the writes of the group not written out yet are kept
+// (and retried by the next flush).
+func (b *Bitcask) flushGroup(groupID string) error {
+	g, ok := b.groups[groupID]
+	if !ok {
+		return nil
+	}
+
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return err
+		}
+	}
+
+	var size int64
+	entries := make([]pb.Entry, len(g.keys))
+	for i, key := range g.keys {
+		w := g.writes[key]
+		entries[i] = b.entry(key, w.value)
+		entries[i].Timestamp = w.time
+		entries[i].Expiry = w.expiry
+		size += b.curr.EncodedSize(entries[i])
+	}
+
+	if err := b.maybeRotate(size); err != nil {
+		return err
+	}
+
+	for i, key := range g.keys {
+		item, err := b.write(entries[i])
+		if err != nil {
+			g.keys = g.keys[i:]
+			return err
+		}
+
+		delete(g.writes, key)
+		delete(b.pending, key)
+		b.keydir.Overwrite(key, item)
+		b.trie.Add(key)
+	}
+
+	delete(b.groups, groupID)
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package bitcask
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// handleCache is the LRU cache of the open handles of the (closed)
+// immutable datafiles read with WithMaxOpenFiles. Handles of the datafiles
+// of the database are cached by datafile, rather than by id, so that those
+// of datafiles that have since been replaced (e.g: by a merge) are never
+// used and are evicted in time; those of the datafiles pinned by snapshots
+// by their path (see snapshot).
+type handleCache struct {
+	sync.Mutex
+	max     int
+	lru     *list.List // of *handle, most recently used first
+	handles map[interface{}]*list.Element
+}
+
+type handle struct {
+	key     interface{}
+	df      *internal.Datafile
+	refs    int
+	evicted bool
+}
+
+func newHandleCache(max int) *handleCache {
+	return &handleCache{
+		max:     max,
+		lru:     list.New(),
+		handles: make(map[interface{}]*list.Element),
+	}
+}
+
+// get returns an open handle of the datafile cached as `key`, opening it
+// with `open` if it isn't cached, and the function releasing it which must
+// be called once done with it.
+func (c *handleCache) get(key interface{}, open func() (*internal.Datafile, error)) (*internal.Datafile, func(), error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.handles[key]; ok {
+		c.lru.MoveToFront(el)
+		h := el.Value.(*handle)
+		h.refs++
+		return h.df, func() { c.release(h) }, nil
+	}
+
+	df, err := open()
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &handle{key: key, df: df, refs: 1}
+	c.handles[key] = c.lru.PushFront(h)
+
+	for c.lru.Len() > c.max {
+		c.evict(c.lru.Back())
+	}
+
+	return h.df, func() { c.release(h) }, nil
+}
+
+// drop evicts the handle cached as `key`, if any
+func (c *handleCache) drop(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	if el, ok := c.handles[key]; ok {
+		c.evict(el)
+	}
+}
+
+func (c *handleCache) release(h *handle) {
+	c.Lock()
+	defer c.Unlock()
+
+	h.refs--
+	if h.evicted && h.refs == 0 {
+		h.df.Close()
+	}
+}
+
+// evict removes the handle from the cache closing it once it is released;
+// the caller must hold the cache's lock.
+func (c *handleCache) evict(el *list.Element) {
+	h := c.lru.Remove(el).(*handle)
+	delete(c.handles, h.key)
+	h.evicted = true
+	if h.refs == 0 {
+		h.df.Close()
+	}
+}
+
+// close closes all of the cached handles
+func (c *handleCache) close() {
+	c.Lock()
+	defer c.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// len returns the number of cached handles
+func (c *handleCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
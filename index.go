@@ -0,0 +1,101 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// indexFilename is the file the index is persisted to (see
+// WithPersistentIndex)
+const indexFilename = "index"
+
+// saveIndex saves the index along with the size and modification time of
+// the datafiles; the caller must hold the write lock.
+func (b *Bitcask) saveIndex() error {
+	ids := []int{b.curr.FileID()}
+	for id := range b.datafiles {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	datafiles, err := statDatafiles(b.path, ids)
+	if err != nil {
+		return err
+	}
+
+	index := &internal.Index{
+		Datafiles: datafiles,
+		Items:     b.keydir.Snapshot(),
+		Versions:  b.keydir.AllVersions(),
+		Sequence:  b.keydir.Sequence(),
+	}
+	return index.Save(filepath.Join(b.path, indexFilename))
+}
+
+// loadIndex loads the index saved by saveIndex into the keydir, trie and
+// recent keys if it was saved for the datafiles with the given ids as they
+// are now. It returns false, for the index to be rebuilt from the datafiles,
+// if the index is missing, corrupt or stale.
+func loadIndex(path string, ids []int, keydir *internal.Keydir, trie *internal.Trie, recent *internal.RecentKeys) (bool, error) {
+	index, err := internal.LoadIndex(filepath.Join(path, indexFilename))
+	if err != nil {
+		return false, nil
+	}
+
+	datafiles, err := statDatafiles(path, ids)
+	if err != nil {
+		return false, err
+	}
+	if len(datafiles) != len(index.Datafiles) {
+		return false, nil
+	}
+	for i, df := range datafiles {
+		if df != index.Datafiles[i] {
+			return false, nil
+		}
+	}
+
+	// The recent keys are in the order they were written
+	type keyItem struct {
+		key  string
+		item internal.Item
+	}
+	items := make([]keyItem, 0, len(index.Items))
+	for key, item := range index.Items {
+		items = append(items, keyItem{key, item})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].item.Sequence < items[j].item.Sequence
+	})
+
+	keydir.UpdateSequence(index.Sequence)
+	for _, ki := range items {
+		keydir.Add(ki.key, ki.item)
+		trie.Add(ki.key)
+		recent.Add(ki.key)
+	}
+	for key, versions := range index.Versions {
+		keydir.SetVersions(key, versions)
+	}
+
+	return true, nil
+}
+
+func statDatafiles(path string, ids []int) ([]internal.IndexedDatafile, error) {
+	datafiles := make([]internal.IndexedDatafile, len(ids))
+	for i, id := range ids {
+		stat, err := os.Stat(datafilePath(path, id))
+		if err != nil {
+			return nil, err
+		}
+		datafiles[i] = internal.IndexedDatafile{
+			ID:      id,
+			Size:    stat.Size(),
+			ModTime: stat.ModTime().UnixNano(),
+		}
+	}
+	return datafiles, nil
+}
@@ -1,14 +1,17 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
-	"golang.org/x/exp/mmap"
 
 	pb "github.com/prologic/bitcask/internal/proto"
 	"github.com/prologic/bitcask/internal/streampb"
@@ -28,7 +31,7 @@ type Datafile struct {
 
 	id     int
 	r      *os.File
-	ra     *mmap.ReaderAt
+	ra     *mapping
 	w      *os.File
 	offset int64
 	dec    *streampb.Decoder
@@ -38,7 +41,7 @@ type Datafile struct {
 func NewDatafile(path string, id int, readonly bool) (*Datafile, error) {
 	var (
 		r   *os.File
-		ra  *mmap.ReaderAt
+		ra  *mapping
 		w   *os.File
 		err error
 	)
@@ -61,7 +64,7 @@ func NewDatafile(path string, id int, readonly bool) (*Datafile, error) {
 		return nil, errors.Wrap(err, "error calling Stat()")
 	}
 
-	ra, err = mmap.Open(fn)
+	ra, err = openMapping(fn)
 	if err != nil {
 		return nil, err
 	}
@@ -90,20 +93,29 @@ func (df *Datafile) Name() string {
 	return df.r.Name()
 }
 
+// Stat returns the FileInfo of the open datafile which may differ from that
+// of the file at its path if it has since been replaced.
+func (df *Datafile) Stat() (os.FileInfo, error) {
+	return df.r.Stat()
+}
+
 func (df *Datafile) Close() error {
-	if df.w == nil {
-		err := df.ra.Close()
+	if df.w != nil {
+		err := df.Sync()
+		if err != nil {
+			return err
+		}
+		err = df.w.Close()
 		if err != nil {
 			return err
 		}
-		return df.r.Close()
 	}
 
-	err := df.Sync()
+	err := df.ra.Close()
 	if err != nil {
 		return err
 	}
-	return df.w.Close()
+	return df.r.Close()
 }
 
 func (df *Datafile) Sync() error {
@@ -119,6 +131,13 @@ func (df *Datafile) Size() int64 {
 	return df.offset
 }
 
+// EncodedSize returns an upper bound of the number of bytes needed to write
+// the entry `e` at the end of the datafile.
+func (df *Datafile) EncodedSize(e pb.Entry) int64 {
+	e.Offset = df.Size()
+	return streampb.Size(&e)
+}
+
 func (df *Datafile) Read() (e pb.Entry, n int64, err error) {
 	df.Lock()
 	defer df.Unlock()
@@ -131,6 +150,15 @@ func (df *Datafile) Read() (e pb.Entry, n int64, err error) {
 	return
 }
 
+// SeekTo positions the datafile so the next Read reads the entry at `offset`.
+func (df *Datafile) SeekTo(offset int64) error {
+	df.Lock()
+	defer df.Unlock()
+
+	_, err := df.r.Seek(offset, io.SeekStart)
+	return err
+}
+
 func (df *Datafile) ReadAt(index, size int64) (e pb.Entry, err error) {
 	var n int
 
@@ -155,6 +183,160 @@ func (df *Datafile) ReadAt(index, size int64) (e pb.Entry, err error) {
 	return
 }
 
+// View returns the key and value of the entry at `index` of encoded size
+// `size`, the value as a slice of the datafile's memory mapping rather than
+// a copy, along with the checksum of the entry and a function which must be
+// called exactly once when the value is no longer used (after which it must
+// not be used). The value must not be modified. The mapping remains valid
+// until all views of it are released, even if the datafile is closed in the
+// meantime. ErrNoView is returned for writable datafiles and on platforms
+// where the mapping isn't accessible.
+func (df *Datafile) View(index, size int64) (string, []byte, uint32, func(), error) {
+	if df.w != nil {
+		return "", nil, 0, nil, ErrNoView
+	}
+
+	b, err := df.ra.bytes(index, size)
+	if err != nil {
+		return "", nil, 0, nil, err
+	}
+
+	key, value, checksum, err := entryValue(b)
+	if err != nil {
+		return "", nil, 0, nil, err
+	}
+
+	df.ra.ref()
+	return key, value, checksum, df.ra.release, nil
+}
+
+// OpenValue returns the key of the entry at `index` of encoded size `size`
+// along with the size of its value and a reader of the value which reads it
+// lazily from a file handle of its own. The reader remains valid until it is
+// closed, even if the datafile is closed, removed or replaced in the
+// meantime.
+func (df *Datafile) OpenValue(index, size int64) (string, int64, io.ReadCloser, error) {
+	f, err := os.Open(df.Name())
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(f, index, size))
+	key, n, err := seekValue(br, size)
+	if err != nil {
+		f.Close()
+		return "", 0, nil, err
+	}
+
+	return key, n, valueReader{io.LimitReader(br, n), f}, nil
+}
+
+// seekValue reads the encoded entry of size `size` from `br` up to its value
+// returning its key and the size of the value.
+func seekValue(br *bufio.Reader, size int64) (string, int64, error) {
+	prefix := make([]byte, 8)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return "", 0, err
+	}
+	if binary.BigEndian.Uint64(prefix) != uint64(size-8) {
+		return "", 0, ErrReadError
+	}
+
+	var key string
+	for {
+		tag, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			// Empty values aren't encoded
+			return key, 0, nil
+		}
+		if err != nil {
+			return "", 0, ErrReadError
+		}
+
+		field, wire := tag>>3, tag&7
+		switch wire {
+		case proto.WireVarint:
+			if _, err := binary.ReadUvarint(br); err != nil {
+				return "", 0, ErrReadError
+			}
+		case proto.WireBytes:
+			l, err := binary.ReadUvarint(br)
+			if err != nil || l > uint64(size) {
+				return "", 0, ErrReadError
+			}
+			switch field {
+			case 2: // Key
+				b := make([]byte, l)
+				if _, err := io.ReadFull(br, b); err != nil {
+					return "", 0, ErrReadError
+				}
+				key = string(b)
+			case 4: // Value
+				return key, int64(l), nil
+			default:
+				if _, err := br.Discard(int(l)); err != nil {
+					return "", 0, ErrReadError
+				}
+			}
+		default:
+			return "", 0, ErrReadError
+		}
+	}
+}
+
+type valueReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r valueReader) Close() error {
+	return r.f.Close()
+}
+
+// SetWriteHook makes the writable datafile call `hook` with the bytes of
+// every write before writing them. If the hook returns an error only the
+// first `n` bytes are written and the write fails with the error.
+func (df *Datafile) SetWriteHook(hook func(p []byte) (n int, err error)) {
+	df.enc = streampb.NewEncoder(hookWriter{df.w, hook})
+}
+
+type hookWriter struct {
+	w    io.Writer
+	hook func(p []byte) (int, error)
+}
+
+func (w hookWriter) Write(p []byte) (int, error) {
+	n, err := w.hook(p)
+	if err != nil {
+		if n > len(p) {
+			n = len(p)
+		}
+		m, werr := w.w.Write(p[:n])
+		if werr != nil {
+			return m, werr
+		}
+		return m, err
+	}
+	return w.w.Write(p)
+}
+
+// Truncate discards the entries written to the writable datafile from
+// `offset` onwards.
+func (df *Datafile) Truncate(offset int64) error {
+	if df.w == nil {
+		return ErrReadonly
+	}
+
+	df.Lock()
+	defer df.Unlock()
+
+	if err := df.w.Truncate(offset); err != nil {
+		return err
+	}
+	df.offset = offset
+	return nil
+}
+
 func (df *Datafile) Write(e pb.Entry) (int64, int64, error) {
 	if df.w == nil {
 		return -1, 0, ErrReadonly
@@ -167,6 +349,11 @@ func (df *Datafile) Write(e pb.Entry) (int64, int64, error) {
 
 	n, err := df.enc.Encode(&e)
 	if err != nil {
+		// Drops what was written of the entry so the next entry
+		// written follows the last complete one
+		if terr := df.w.Truncate(df.offset); terr != nil {
+			return -1, 0, errors.Wrap(terr, "error truncating partially written entry")
+		}
 		return -1, 0, err
 	}
 	df.offset += n
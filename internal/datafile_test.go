@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatafileFailedWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	df, err := NewDatafile(testdir, 0, false)
+	assert.NoError(err)
+	defer df.Close()
+
+	_, n, err := df.Write(NewEntry("foo", []byte("bar")))
+	assert.NoError(err)
+
+	// Fails partway through writing the entry's value
+	errFailed := errors.New("write failed")
+	failing := true
+	df.SetWriteHook(func(p []byte) (int, error) {
+		if failing {
+			return len(p) / 2, errFailed
+		}
+		return len(p), nil
+	})
+	_, _, err = df.Write(NewEntry("hello", []byte("world")))
+	assert.Equal(errFailed, errors.Cause(err))
+	assert.Equal(n, df.Size())
+
+	// The encoder and datafile are usable again and the partial entry
+	// was dropped
+	failing = false
+	offset, _, err := df.Write(NewEntry("hello", []byte("world")))
+	assert.NoError(err)
+	assert.Equal(n, offset)
+	assert.NoError(df.Sync())
+
+	r, err := NewDatafile(testdir, 0, true)
+	assert.NoError(err)
+	defer r.Close()
+	for _, key := range []string{"foo", "hello"} {
+		e, _, err := r.Read()
+		assert.NoError(err)
+		assert.Equal(key, e.Key)
+	}
+}
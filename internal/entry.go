@@ -1,7 +1,11 @@
 package internal
 
 import (
+	"encoding/binary"
 	"hash/crc32"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
 
 	pb "github.com/prologic/bitcask/internal/proto"
 )
@@ -10,8 +14,69 @@ func NewEntry(key string, value []byte) pb.Entry {
 	checksum := crc32.ChecksumIEEE(value)
 
 	return pb.Entry{
-		Checksum: checksum,
-		Key:      key,
-		Value:    value,
+		Checksum:  checksum,
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Now().UnixNano(),
+	}
+}
+
+// ValueSize returns the size of the value of the entry `e`, which for
+// compressed values is the size they were before they were compressed.
+func ValueSize(e pb.Entry) int64 {
+	if e.ValueSize != 0 {
+		return e.ValueSize
 	}
+	return int64(len(e.Value))
+}
+
+// entryValue returns the key, value and checksum of the encoded (and length
+// prefixed) entry `b` without copying the value.
+func entryValue(b []byte) (string, []byte, uint32, error) {
+	if len(b) < 8 || binary.BigEndian.Uint64(b) != uint64(len(b)-8) {
+		return "", nil, 0, ErrReadError
+	}
+	b = b[8:]
+
+	var (
+		key      string
+		value    []byte
+		checksum uint32
+	)
+	for len(b) > 0 {
+		tag, n := proto.DecodeVarint(b)
+		if n == 0 {
+			return "", nil, 0, ErrReadError
+		}
+		b = b[n:]
+
+		field, wire := tag>>3, tag&7
+		switch wire {
+		case proto.WireVarint:
+			x, n := proto.DecodeVarint(b)
+			if n == 0 {
+				return "", nil, 0, ErrReadError
+			}
+			b = b[n:]
+			if field == 1 { // Checksum
+				checksum = uint32(x)
+			}
+		case proto.WireBytes:
+			l, n := proto.DecodeVarint(b)
+			if n == 0 || l > uint64(len(b)-n) {
+				return "", nil, 0, ErrReadError
+			}
+			switch field {
+			case 2: // Key
+				key = string(b[n : n+int(l)])
+			case 4: // Value
+				value = b[n : n+int(l) : n+int(l)]
+			}
+			b = b[n+int(l):]
+		default:
+			return "", nil, 0, ErrReadError
+		}
+	}
+
+	return key, value, checksum, nil
 }
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// GlobPrefix returns the literal prefix of the glob pattern, that is the
+// prefix any key matching the pattern must start with.
+func GlobPrefix(pattern string) string {
+	var prefix strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[':
+			return prefix.String()
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+		}
+		prefix.WriteByte(pattern[i])
+	}
+	return prefix.String()
+}
+
+// Glob returns true if the key matches the glob pattern. The pattern syntax
+// is that of Redis' KEYS: `*` matches any sequence of characters, `?` any
+// single character, `[abc]` and `[a-z]` any character in the set or range,
+// `[^abc]` any character not in the set and `\` escapes the following
+// character. Unlike filepath.Match there are no special separators.
+func Glob(pattern, key string) bool {
+	// Position to backtrack to on a mismatch after the last `*`
+	var (
+		starPattern = -1
+		starKey     int
+	)
+
+	p, k := 0, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starKey = p, k
+				p++
+				continue
+			case '?':
+				_, n := utf8.DecodeRuneInString(key[k:])
+				p, k = p+1, k+n
+				continue
+			case '[':
+				r, n := utf8.DecodeRuneInString(key[k:])
+				if end, ok := matchClass(pattern[p+1:], r); ok {
+					p, k = p+1+end, k+n
+					continue
+				}
+			default:
+				c, n := literal(pattern[p:])
+				if strings.HasPrefix(key[k:], c) {
+					p, k = p+n, k+len(c)
+					continue
+				}
+			}
+		}
+
+		if starPattern < 0 {
+			return false
+		}
+
+		// Let the last `*` match one more character and try again
+		_, n := utf8.DecodeRuneInString(key[starKey:])
+		starKey += n
+		p, k = starPattern+1, starKey
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// literal returns the literal character at the start of the pattern and the
+// number of bytes of the pattern it takes up (including any escape).
+func literal(pattern string) (string, int) {
+	if pattern[0] == '\\' && len(pattern) > 1 {
+		_, n := utf8.DecodeRuneInString(pattern[1:])
+		return pattern[1 : 1+n], 1 + n
+	}
+	_, n := utf8.DecodeRuneInString(pattern)
+	return pattern[:n], n
+}
+
+// matchClass matches the rune against the character class at the start of
+// the pattern (following the opening `[`) and returns the number of bytes
+// of the class including the closing `]` if it matches. An unterminated
+// class never matches.
+func matchClass(pattern string, r rune) (int, bool) {
+	i := 0
+	negate := i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!')
+	if negate {
+		i++
+	}
+
+	var matched bool
+	for first := true; i < len(pattern); first = false {
+		if pattern[i] == ']' && !first {
+			return i + 1, matched != negate
+		}
+
+		lo, n := literal(pattern[i:])
+		i += n
+		hi := lo
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			hi, n = literal(pattern[i+1:])
+			i += 1 + n
+		}
+
+		l, _ := utf8.DecodeRuneInString(lo)
+		h, _ := utf8.DecodeRuneInString(hi)
+		if l <= r && r <= h {
+			matched = true
+		}
+	}
+
+	return 0, false
+}
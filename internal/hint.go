@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Hint is the index of a merged datafile which allows the datafile to be
+// loaded without reading all of its entries. The size and checksums of the
+// datafile it was created for are recorded so that a hint which no longer
+// matches its datafile (e.g: one left behind by a partial copy) is detected.
+type Hint struct {
+	Size     int64
+	Checksum uint32
+	Items    map[string]Item
+	Deleted  []string
+
+	// Versions are the older versions, oldest first, of the keys in Items
+	// that were kept in the datafile (see Bitcask.GetVersions).
+	Versions map[string][]Item
+
+	// Sequence is the highest sequence number of the entries the datafile
+	// was merged from, including those that were dropped.
+	Sequence uint64
+
+	// TailChecksum is the checksum of the last (up to) hintTailSize bytes
+	// of the datafile, which are the final entries, as checked by Matches.
+	TailChecksum uint32
+}
+
+// hintTailSize is the number of bytes at the end of a datafile covered by
+// the tail checksum of its hint
+const hintTailSize = 4096
+
+// Save saves the hint to the file `fn` recording the size and checksums of
+// the datafile `datafile` it was created for, gzip compressed if requested.
+func (h *Hint) Save(fn, datafile string, compress bool) error {
+	size, checksum, err := checksumFile(datafile)
+	if err != nil {
+		return err
+	}
+	tail, err := checksumTail(datafile, size)
+	if err != nil {
+		return err
+	}
+	h.Size = size
+	h.Checksum = checksum
+	h.TailChecksum = tail
+
+	var buf bytes.Buffer
+	if compress {
+		w := gzip.NewWriter(&buf)
+		if err := gob.NewEncoder(w).Encode(h); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	} else if err := gob.NewEncoder(&buf).Encode(h); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn, buf.Bytes(), 0644)
+}
+
+// Matches returns true if the datafile `datafile` is the one the hint was
+// created for judging by its size and the checksum of its final entries,
+// which is cheap enough to be checked whenever the hint is used. Verify
+// checks the whole datafile.
+func (h *Hint) Matches(datafile string) (bool, error) {
+	stat, err := os.Stat(datafile)
+	if err != nil {
+		return false, err
+	}
+	if stat.Size() != h.Size {
+		return false, nil
+	}
+
+	tail, err := checksumTail(datafile, h.Size)
+	if err != nil {
+		return false, err
+	}
+	return tail == h.TailChecksum, nil
+}
+
+// Verify returns true if the checksum of the whole datafile `datafile`
+// matches the one of the datafile the hint was created for.
+func (h *Hint) Verify(datafile string) (bool, error) {
+	size, checksum, err := checksumFile(datafile)
+	if err != nil {
+		return false, err
+	}
+	return size == h.Size && checksum == h.Checksum, nil
+}
+
+// LoadHint loads the hint saved in the file `fn`, decompressing it if it
+// was compressed. A compressed hint is only trusted if its gzip checksum
+// matches.
+func LoadHint(fn string) (*Hint, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		// Reading to the end verifies the checksum
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var h Hint
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// gzipMagic are the first bytes of a gzip stream which a gob stream (of a
+// Hint) never starts with
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// checksumTail returns the checksum of the last (up to) hintTailSize bytes
+// of the file `fn` of size `size`
+func checksumTail(fn string, size int64) (uint32, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	offset := size - hintTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, size-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+func checksumFile(fn string) (int64, uint32, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, h.Sum32(), nil
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+)
+
+// ErrIndexCorrupt is the error returned by LoadIndex for an index whose
+// checksum doesn't match
+var ErrIndexCorrupt = errors.New("error: index corrupt")
+
+// Index is a saved copy of the keydir which allows the keydir to be loaded
+// without reading the hint files and datafiles. The size and modification
+// time of the datafiles it was saved for are recorded so that an index that
+// no longer matches the datafiles (e.g: because the database was written
+// to after it was saved) is detected.
+type Index struct {
+	Datafiles []IndexedDatafile
+	Items     map[string]Item
+	Versions  map[string][]Item
+	Sequence  uint64
+}
+
+// IndexedDatafile is a datafile an index was saved for
+type IndexedDatafile struct {
+	ID      int
+	Size    int64
+	ModTime int64 // in nanoseconds since the epoch
+}
+
+// Save saves the index to the file `fn` followed by its checksum, replacing
+// the file atomically so that a crash leaves either the old or new index.
+func (i *Index) Save(fn string) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(i); err != nil {
+		return err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes())); err != nil {
+		return err
+	}
+
+	temp := fn + ".tmp"
+	if err := ioutil.WriteFile(temp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, fn)
+}
+
+// LoadIndex loads the index saved in the file `fn` checking its checksum
+func LoadIndex(fn string) (*Index, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, ErrIndexCorrupt
+	}
+
+	data, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, ErrIndexCorrupt
+	}
+
+	var i Index
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&i); err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
@@ -6,39 +6,190 @@ import (
 	"io"
 	"io/ioutil"
 	"sync"
+	"time"
+
+	pb "github.com/prologic/bitcask/internal/proto"
 )
 
 type Item struct {
-	FileID int
-	Offset int64
-	Size   int64
+	FileID   int
+	Offset   int64
+	Size     int64
+	Checksum uint32
+	Flags    uint8
+
+	// Overwrites is the (saturating) number of older versions of the key
+	// that have been overwritten by this one and may still be on disk.
+	Overwrites uint16
+
+	// Sequence is the sequence number of the entry (see Bitcask.Sequence)
+	Sequence uint64
+
+	// Expiry is the time (in seconds since the epoch) the key expires at
+	// or zero if it doesn't expire
+	Expiry int64
+
+	// ValueSize and Timestamp are the size of the value (before it was
+	// compressed, see ValueSize) and the time (in nanoseconds since the
+	// epoch) the entry was written, which are zero for items loaded from
+	// hint files written by older versions
+	ValueSize int64
+	Timestamp int64
+}
+
+// Expired returns true if the item has expired by the time `now`
+func (i Item) Expired(now time.Time) bool {
+	return i.Expiry != 0 && now.Unix() >= i.Expiry
+}
+
+// NewItem returns the keydir item for the entry `e` of encoded size `size`
+// stored in the datafile `fileid`.
+func NewItem(fileid int, e pb.Entry, size int64) Item {
+	return Item{
+		FileID:   fileid,
+		Offset:   e.Offset,
+		Size:     size,
+		Checksum: e.Checksum,
+		Flags:    uint8(e.Flags),
+		Sequence: e.Sequence,
+		Expiry:   e.Expiry,
+
+		ValueSize: ValueSize(e),
+		Timestamp: e.Timestamp,
+	}
 }
 
 type Keydir struct {
 	sync.RWMutex
-	kv map[string]Item
+	kv   map[string]Item
+	seq  uint64
+	size int64 // of the items' entries, including older versions
+
+	// expiring is the number of items with an expiry (see LiveLen)
+	expiring int
+
+	// The older versions of keys, oldest first, kept by Overwrite (see
+	// SetMaxVersions)
+	maxVersions int
+	versions    map[string][]Item
+
+	// deleted are the sequence numbers of the deletions of the keys
+	// deleted (see Remove) and not since written again
+	deleted map[string]uint64
 }
 
 func NewKeydir() *Keydir {
 	return &Keydir{
-		kv: make(map[string]Item),
+		kv:      make(map[string]Item),
+		deleted: make(map[string]uint64),
 	}
 }
 
-func (k *Keydir) Add(key string, fileid int, offset, size int64) Item {
-	item := Item{
-		FileID: fileid,
-		Offset: offset,
-		Size:   size,
+func (k *Keydir) Add(key string, item Item) Item {
+	k.Lock()
+	k.set(key, item)
+	k.Unlock()
+
+	return item
+}
+
+// set sets the item of the key keeping track of the size of the items;
+// the caller must hold the lock.
+func (k *Keydir) set(key string, item Item) {
+	if old, ok := k.kv[key]; ok {
+		k.size -= old.Size
+		if old.Expiry != 0 {
+			k.expiring--
+		}
+	}
+	k.kv[key] = item
+	k.size += item.Size
+	if item.Expiry != 0 {
+		k.expiring++
 	}
+	delete(k.deleted, key)
+}
 
+// Overwrite adds the item for the key counting the item it overwrites, if
+// any, towards the overwrites of the new item. The overwritten item is kept
+// as an older version of the key if the keydir keeps versions.
+func (k *Keydir) Overwrite(key string, item Item) Item {
 	k.Lock()
-	k.kv[key] = item
-	k.Unlock()
+	defer k.Unlock()
+
+	old, ok := k.kv[key]
+	if ok && old.Overwrites < ^uint16(0) {
+		item.Overwrites = old.Overwrites + 1
+	}
+	k.set(key, item)
+	if ok && k.maxVersions > 1 {
+		k.setVersions(key, append(k.versions[key], old))
+	}
 
 	return item
 }
 
+// SetMaxVersions makes the keydir keep up to `n` versions of each key (the
+// current item and n-1 older versions); the oldest versions are dropped
+// once a key has more.
+func (k *Keydir) SetMaxVersions(n int) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.maxVersions = n
+	if k.versions == nil {
+		k.versions = make(map[string][]Item)
+	}
+}
+
+// Versions returns the older versions of the key, oldest first
+func (k *Keydir) Versions(key string) []Item {
+	k.RLock()
+	defer k.RUnlock()
+
+	return append([]Item(nil), k.versions[key]...)
+}
+
+// AllVersions returns the older versions of all keys, oldest first
+func (k *Keydir) AllVersions() map[string][]Item {
+	k.RLock()
+	defer k.RUnlock()
+
+	versions := make(map[string][]Item, len(k.versions))
+	for key, items := range k.versions {
+		versions[key] = append([]Item(nil), items...)
+	}
+	return versions
+}
+
+// SetVersions replaces the older versions of the key, oldest first
+func (k *Keydir) SetVersions(key string, versions []Item) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.setVersions(key, append([]Item(nil), versions...))
+}
+
+// setVersions sets the older versions of the key dropping the oldest ones
+// in excess of the maximum number of versions; the caller must hold the
+// lock.
+func (k *Keydir) setVersions(key string, versions []Item) {
+	if n := len(versions) - (k.maxVersions - 1); n > 0 {
+		versions = versions[n:]
+	}
+	for _, item := range k.versions[key] {
+		k.size -= item.Size
+	}
+	for _, item := range versions {
+		k.size += item.Size
+	}
+	if len(versions) == 0 {
+		delete(k.versions, key)
+		return
+	}
+	k.versions[key] = versions
+}
+
 func (k *Keydir) Get(key string) (Item, bool) {
 	k.RLock()
 	defer k.RUnlock()
@@ -51,13 +202,118 @@ func (k *Keydir) Delete(key string) {
 	k.Lock()
 	defer k.Unlock()
 
-	delete(k.kv, key)
+	if old, ok := k.kv[key]; ok {
+		k.size -= old.Size
+		if old.Expiry != 0 {
+			k.expiring--
+		}
+		delete(k.kv, key)
+	}
+	if k.versions != nil {
+		k.setVersions(key, nil)
+	}
+}
+
+// Remove deletes the key like Delete and records the sequence number `seq`
+// of the tombstone that deleted it (see DeletedSince).
+func (k *Keydir) Remove(key string, seq uint64) {
+	k.Delete(key)
+
+	k.Lock()
+	defer k.Unlock()
+
+	if seq > k.deleted[key] {
+		k.deleted[key] = seq
+	}
+}
+
+// DeletedSince returns the keys deleted (see Remove) after the sequence
+// number `seq`, and not since written again, with the sequence numbers of
+// their deletions.
+func (k *Keydir) DeletedSince(seq uint64) map[string]uint64 {
+	k.RLock()
+	defer k.RUnlock()
+
+	deleted := make(map[string]uint64)
+	for key, n := range k.deleted {
+		if n > seq {
+			deleted[key] = n
+		}
+	}
+	return deleted
+}
+
+// Snapshot returns a point-in-time copy of all items in the keydir
+func (k *Keydir) Snapshot() map[string]Item {
+	k.RLock()
+	defer k.RUnlock()
+
+	kv := make(map[string]Item, len(k.kv))
+	for key, item := range k.kv {
+		kv[key] = item
+	}
+	return kv
+}
+
+// Sequence returns the highest sequence number of the entries written or
+// indexed so far, including those of deleted keys.
+func (k *Keydir) Sequence() uint64 {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.seq
+}
+
+// NextSequence returns the sequence number for the next entry written
+func (k *Keydir) NextSequence() uint64 {
+	k.Lock()
+	defer k.Unlock()
+
+	k.seq++
+	return k.seq
+}
+
+// UpdateSequence raises the sequence number to `seq` if it is higher
+func (k *Keydir) UpdateSequence(seq uint64) {
+	k.Lock()
+	defer k.Unlock()
+
+	if seq > k.seq {
+		k.seq = seq
+	}
 }
 
 func (k *Keydir) Len() int {
 	return len(k.kv)
 }
 
+// LiveLen is like Len but doesn't count the keys that have expired by
+// `now`, which are only looked for if any key has an expiry.
+func (k *Keydir) LiveLen(now time.Time) int {
+	k.RLock()
+	defer k.RUnlock()
+
+	if k.expiring == 0 {
+		return len(k.kv)
+	}
+	n := 0
+	for _, item := range k.kv {
+		if !item.Expired(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Size returns the total size of the entries of the items in the keydir,
+// that is of the live data of the database.
+func (k *Keydir) Size() int64 {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.size
+}
+
 func (k *Keydir) Keys() chan string {
 	ch := make(chan string)
 	go func() {
@@ -71,6 +327,22 @@ func (k *Keydir) Keys() chan string {
 	return ch
 }
 
+// LiveKeys is like Keys but skips the keys that have expired by `now`
+func (k *Keydir) LiveKeys(now time.Time) chan string {
+	ch := make(chan string)
+	go func() {
+		k.RLock()
+		defer k.RUnlock()
+		for key, item := range k.kv {
+			if !item.Expired(now) {
+				ch <- key
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
 func (k *Keydir) Bytes() ([]byte, error) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -97,5 +369,11 @@ func NewKeydirFromBytes(r io.Reader) (*Keydir, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, item := range k.kv {
+		k.size += item.Size
+		if item.Expiry != 0 {
+			k.expiring++
+		}
+	}
 	return k, nil
 }
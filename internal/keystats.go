@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sketchDepth is the number of rows (independent hash functions) in the
+	// count-min sketch
+	sketchDepth = 4
+
+	// sketchWidth is the number of counters per row in the count-min sketch
+	sketchWidth = 1 << 11
+
+	// MaxHotKeys is the maximum number of candidate hot keys tracked
+	MaxHotKeys = 256
+)
+
+// KeyStats tracks approximate per-key access counts using a count-min
+// sketch with a bounded set of candidate hot keys. Estimates may over-count
+// (never under-count) due to hash collisions and memory usage is fixed
+// regardless of the number of distinct keys. Counts are halved every
+// `decay` interval so that keys that were once hot eventually fade.
+type KeyStats struct {
+	sync.Mutex
+
+	decay    time.Duration
+	decayed  time.Time
+	counters [sketchDepth][sketchWidth]uint32
+	hot      hotKeys
+	index    map[string]*hotKey
+}
+
+// NewKeyStats returns a new KeyStats whose counts are halved every `decay`
+// interval. A zero decay disables decaying.
+func NewKeyStats(decay time.Duration) *KeyStats {
+	return &KeyStats{
+		decay:   decay,
+		decayed: time.Now(),
+		index:   make(map[string]*hotKey),
+	}
+}
+
+// Touch records an access of the given key
+func (s *KeyStats) Touch(key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maybeDecay()
+
+	h1, h2 := hashKey(key)
+
+	var estimate uint32
+	for i := 0; i < sketchDepth; i++ {
+		j := (h1 + uint32(i)*h2) % sketchWidth
+		if s.counters[i][j] < ^uint32(0) {
+			s.counters[i][j]++
+		}
+		if i == 0 || s.counters[i][j] < estimate {
+			estimate = s.counters[i][j]
+		}
+	}
+
+	if hk, ok := s.index[key]; ok {
+		hk.count = estimate
+		heap.Fix(&s.hot, hk.index)
+		return
+	}
+
+	if len(s.hot) < MaxHotKeys {
+		hk := &hotKey{key: key, count: estimate}
+		heap.Push(&s.hot, hk)
+		s.index[key] = hk
+		return
+	}
+
+	if min := s.hot[0]; estimate > min.count {
+		delete(s.index, min.key)
+		min.key = key
+		min.count = estimate
+		heap.Fix(&s.hot, 0)
+		s.index[key] = min
+	}
+}
+
+// Top returns up to n of the most frequently accessed keys, most accessed
+// first.
+func (s *KeyStats) Top(n int) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maybeDecay()
+
+	candidates := make([]*hotKey, len(s.hot))
+	copy(candidates, s.hot)
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].count == candidates[j].count {
+			return candidates[i].key < candidates[j].key
+		}
+		return candidates[i].count > candidates[j].count
+	})
+
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	keys := make([]string, 0, n)
+	for _, hk := range candidates[:n] {
+		keys = append(keys, hk.key)
+	}
+	return keys
+}
+
+func (s *KeyStats) maybeDecay() {
+	if s.decay <= 0 {
+		return
+	}
+
+	periods := time.Since(s.decayed) / s.decay
+	if periods == 0 {
+		return
+	}
+
+	shift := uint(32)
+	if periods < 32 {
+		shift = uint(periods)
+	}
+
+	for i := range s.counters {
+		for j := range s.counters[i] {
+			s.counters[i][j] = uint32(uint64(s.counters[i][j]) >> shift)
+		}
+	}
+	for _, hk := range s.hot {
+		hk.count = uint32(uint64(hk.count) >> shift)
+	}
+	s.decayed = s.decayed.Add(periods * s.decay)
+}
+
+func hashKey(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+type hotKey struct {
+	key   string
+	count uint32
+	index int
+}
+
+// hotKeys is a min-heap of candidate hot keys ordered by their estimated
+// access count
+type hotKeys []*hotKey
+
+func (h hotKeys) Len() int           { return len(h) }
+func (h hotKeys) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hotKeys) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotKeys) Push(x interface{}) {
+	hk := x.(*hotKey)
+	hk.index = len(*h)
+	*h = append(*h, hk)
+}
+
+func (h *hotKeys) Pop() interface{} {
+	old := *h
+	n := len(old)
+	hk := old[n-1]
+	*h = old[:n-1]
+	return hk
+}
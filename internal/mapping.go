@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoView is the error returned when a datafile's entries can't be viewed
+// in place (see Datafile.View)
+var ErrNoView = errors.New("error: datafile is not memory mapped")
+
+// mapping is a read-only memory mapping of a datafile. It is reference
+// counted so that views of it (see Datafile.View) remain valid after the
+// datafile is closed, the mapping is only unmapped once the datafile has
+// been closed and all views released.
+type mapping struct {
+	region
+
+	refs   int32
+	closed sync.Once
+
+	// release drops a reference to the mapping; it is allocated once so
+	// that taking a view doesn't allocate.
+	release func()
+}
+
+func openMapping(fn string) (*mapping, error) {
+	r, err := openRegion(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mapping{region: r, refs: 1}
+	m.release = func() { m.unref() }
+	return m, nil
+}
+
+func (m *mapping) ref() {
+	atomic.AddInt32(&m.refs, 1)
+}
+
+func (m *mapping) unref() error {
+	if atomic.AddInt32(&m.refs, -1) == 0 {
+		return m.unmap()
+	}
+	return nil
+}
+
+// Close drops the datafile's reference to the mapping; further calls do
+// nothing.
+func (m *mapping) Close() error {
+	var err error
+	m.closed.Do(func() {
+		err = m.unref()
+	})
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build !linux && !darwin
+
+package internal
+
+import (
+	"golang.org/x/exp/mmap"
+)
+
+// region is the mapped memory of a file. Its bytes aren't accessible on
+// this platform so datafiles can't be viewed in place.
+type region struct {
+	ra *mmap.ReaderAt
+}
+
+func openRegion(fn string) (region, error) {
+	ra, err := mmap.Open(fn)
+	if err != nil {
+		return region{}, err
+	}
+	return region{ra: ra}, nil
+}
+
+func (r *region) ReadAt(p []byte, off int64) (int, error) {
+	return r.ra.ReadAt(p, off)
+}
+
+func (r *region) bytes(off, n int64) ([]byte, error) {
+	return nil, ErrNoView
+}
+
+func (r *region) unmap() error {
+	return r.ra.Close()
+}
@@ -0,0 +1,74 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// region is the mapped memory of a file
+type region struct {
+	data []byte
+}
+
+func openRegion(fn string) (region, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return region{}, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return region{}, err
+	}
+
+	size := stat.Size()
+	if size == 0 {
+		return region{}, nil
+	}
+	if size != int64(int(size)) {
+		return region{}, fmt.Errorf("mmap: file %q is too large", fn)
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return region{}, err
+	}
+	return region{data: data}, nil
+}
+
+func (r *region) ReadAt(p []byte, off int64) (int, error) {
+	if r.data == nil {
+		return 0, errors.New("mmap: closed")
+	}
+	if off < 0 || int64(len(r.data)) < off {
+		return 0, fmt.Errorf("mmap: invalid ReadAt offset %d", off)
+	}
+	n := copy(p, r.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// bytes returns the `n` bytes at offset `off` of the mapped memory
+func (r *region) bytes(off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > int64(len(r.data)) {
+		return nil, ErrReadError
+	}
+	return r.data[off : off+n : off+n], nil
+}
+
+func (r *region) unmap() error {
+	if r.data == nil {
+		return nil
+	}
+	data := r.data
+	r.data = nil
+	return syscall.Munmap(data)
+}
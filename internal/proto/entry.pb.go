@@ -3,9 +3,11 @@
 
 package proto
 
-import proto "github.com/golang/protobuf/proto"
-import fmt "fmt"
-import math "math"
+import (
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	math "math"
+)
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
@@ -16,13 +18,18 @@ var _ = math.Inf
 // is compatible with the proto package it is being compiled against.
 // A compilation error at this line likely means your copy of the
 // proto package needs to be updated.
-const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type Entry struct {
 	Checksum             uint32   `protobuf:"varint,1,opt,name=Checksum,proto3" json:"Checksum,omitempty"`
 	Key                  string   `protobuf:"bytes,2,opt,name=Key,proto3" json:"Key,omitempty"`
 	Offset               int64    `protobuf:"varint,3,opt,name=Offset,proto3" json:"Offset,omitempty"`
 	Value                []byte   `protobuf:"bytes,4,opt,name=Value,proto3" json:"Value,omitempty"`
+	Timestamp            int64    `protobuf:"varint,5,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
+	Flags                uint32   `protobuf:"varint,6,opt,name=Flags,proto3" json:"Flags,omitempty"`
+	Sequence             uint64   `protobuf:"varint,7,opt,name=Sequence,proto3" json:"Sequence,omitempty"`
+	Expiry               int64    `protobuf:"varint,8,opt,name=Expiry,proto3" json:"Expiry,omitempty"`
+	ValueSize            int64    `protobuf:"varint,9,opt,name=ValueSize,proto3" json:"ValueSize,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -32,16 +39,17 @@ func (m *Entry) Reset()         { *m = Entry{} }
 func (m *Entry) String() string { return proto.CompactTextString(m) }
 func (*Entry) ProtoMessage()    {}
 func (*Entry) Descriptor() ([]byte, []int) {
-	return fileDescriptor_entry_3e91842c99935ae2, []int{0}
+	return fileDescriptor_daa6c5b6c627940f, []int{0}
 }
+
 func (m *Entry) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Entry.Unmarshal(m, b)
 }
 func (m *Entry) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_Entry.Marshal(b, m, deterministic)
 }
-func (dst *Entry) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_Entry.Merge(dst, src)
+func (m *Entry) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Entry.Merge(m, src)
 }
 func (m *Entry) XXX_Size() int {
 	return xxx_messageInfo_Entry.Size(m)
@@ -80,20 +88,60 @@ func (m *Entry) GetValue() []byte {
 	return nil
 }
 
+func (m *Entry) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *Entry) GetFlags() uint32 {
+	if m != nil {
+		return m.Flags
+	}
+	return 0
+}
+
+func (m *Entry) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *Entry) GetExpiry() int64 {
+	if m != nil {
+		return m.Expiry
+	}
+	return 0
+}
+
+func (m *Entry) GetValueSize() int64 {
+	if m != nil {
+		return m.ValueSize
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Entry)(nil), "proto.Entry")
 }
 
-func init() { proto.RegisterFile("entry.proto", fileDescriptor_entry_3e91842c99935ae2) }
+func init() { proto.RegisterFile("entry.proto", fileDescriptor_daa6c5b6c627940f) }
 
-var fileDescriptor_entry_3e91842c99935ae2 = []byte{
-	// 126 bytes of a gzipped FileDescriptorProto
+var fileDescriptor_daa6c5b6c627940f = []byte{
+	// 203 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x4e, 0xcd, 0x2b, 0x29,
-	0xaa, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x05, 0x53, 0x4a, 0xc9, 0x5c, 0xac, 0xae,
-	0x20, 0x51, 0x21, 0x29, 0x2e, 0x0e, 0xe7, 0x8c, 0xd4, 0xe4, 0xec, 0xe2, 0xd2, 0x5c, 0x09, 0x46,
-	0x05, 0x46, 0x0d, 0xde, 0x20, 0x38, 0x5f, 0x48, 0x80, 0x8b, 0xd9, 0x3b, 0xb5, 0x52, 0x82, 0x49,
-	0x81, 0x51, 0x83, 0x33, 0x08, 0xc4, 0x14, 0x12, 0xe3, 0x62, 0xf3, 0x4f, 0x4b, 0x2b, 0x4e, 0x2d,
-	0x91, 0x60, 0x56, 0x60, 0xd4, 0x60, 0x0e, 0x82, 0xf2, 0x84, 0x44, 0xb8, 0x58, 0xc3, 0x12, 0x73,
-	0x4a, 0x53, 0x25, 0x58, 0x14, 0x18, 0x35, 0x78, 0x82, 0x20, 0x9c, 0x24, 0x36, 0xb0, 0x5d, 0xc6,
-	0x80, 0x00, 0x00, 0x00, 0xff, 0xff, 0x76, 0xd2, 0x3e, 0x83, 0x81, 0x00, 0x00, 0x00,
+	0xaa, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x05, 0x53, 0x4a, 0x2f, 0x19, 0xb9, 0x58,
+	0x5d, 0x41, 0xc2, 0x42, 0x52, 0x5c, 0x1c, 0xce, 0x19, 0xa9, 0xc9, 0xd9, 0xc5, 0xa5, 0xb9, 0x12,
+	0x8c, 0x0a, 0x8c, 0x1a, 0xbc, 0x41, 0x70, 0xbe, 0x90, 0x00, 0x17, 0xb3, 0x77, 0x6a, 0xa5, 0x04,
+	0x93, 0x02, 0xa3, 0x06, 0x67, 0x10, 0x88, 0x29, 0x24, 0xc6, 0xc5, 0xe6, 0x9f, 0x96, 0x56, 0x9c,
+	0x5a, 0x22, 0xc1, 0xac, 0xc0, 0xa8, 0xc1, 0x1c, 0x04, 0xe5, 0x09, 0x89, 0x70, 0xb1, 0x86, 0x25,
+	0xe6, 0x94, 0xa6, 0x4a, 0xb0, 0x28, 0x30, 0x6a, 0xf0, 0x04, 0x41, 0x38, 0x42, 0x32, 0x5c, 0x9c,
+	0x21, 0x99, 0xb9, 0xa9, 0xc5, 0x25, 0x89, 0xb9, 0x05, 0x12, 0xac, 0x60, 0x0d, 0x08, 0x01, 0x90,
+	0x1e, 0xb7, 0x9c, 0xc4, 0xf4, 0x62, 0x09, 0x36, 0xb0, 0xb5, 0x10, 0x0e, 0xc8, 0x3d, 0xc1, 0xa9,
+	0x85, 0xa5, 0xa9, 0x79, 0xc9, 0xa9, 0x12, 0xec, 0x0a, 0x8c, 0x1a, 0x2c, 0x41, 0x70, 0x3e, 0xc8,
+	0x76, 0xd7, 0x8a, 0x82, 0xcc, 0xa2, 0x4a, 0x09, 0x0e, 0x88, 0xed, 0x10, 0x1e, 0xc8, 0x1e, 0xb0,
+	0x85, 0xc1, 0x99, 0x55, 0xa9, 0x12, 0x9c, 0x10, 0x7b, 0xe0, 0x02, 0x49, 0x6c, 0x60, 0x2f, 0x1b,
+	0x03, 0x06, 0x00, 0x7d, 0xba, 0x78, 0x58, 0x08, 0x01, 0x00, 0x00,
 }
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MaxRecentKeys is the maximum number of recently written keys tracked
+const MaxRecentKeys = 1024
+
+// RecentKeys tracks up to MaxRecentKeys of the most recently written keys
+// in the order they were last written.
+type RecentKeys struct {
+	sync.Mutex
+
+	order *list.List
+	index map[string]*list.Element
+}
+
+// NewRecentKeys returns a new empty RecentKeys
+func NewRecentKeys() *RecentKeys {
+	return &RecentKeys{
+		order: list.New(),
+		index: make(map[string]*list.Element),
+	}
+}
+
+// Add records a write of the given key making it the most recent key
+func (r *RecentKeys) Add(key string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if e, ok := r.index[key]; ok {
+		r.order.MoveToFront(e)
+		return
+	}
+
+	r.index[key] = r.order.PushFront(key)
+
+	if r.order.Len() > MaxRecentKeys {
+		e := r.order.Back()
+		r.order.Remove(e)
+		delete(r.index, e.Value.(string))
+	}
+}
+
+// Remove stops tracking the given key (e.g: because it was deleted)
+func (r *RecentKeys) Remove(key string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if e, ok := r.index[key]; ok {
+		r.order.Remove(e)
+		delete(r.index, key)
+	}
+}
+
+// Top returns up to n of the most recently written keys, most recent first
+func (r *RecentKeys) Top(n int) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	if n > r.order.Len() {
+		n = r.order.Len()
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	keys := make([]string, 0, n)
+	for e := r.order.Front(); e != nil && len(keys) < n; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
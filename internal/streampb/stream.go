@@ -2,6 +2,7 @@ package streampb
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 
@@ -13,22 +14,34 @@ const (
 	// prefixSize is the number of bytes we preallocate for storing
 	// our big endian lenth prefix buffer.
 	prefixSize = 8
+
+	// maxPrealloc is the largest message size we preallocate a buffer
+	// for when decoding.
+	maxPrealloc = 1 << 20
 )
 
 // NewEncoder creates a streaming protobuf encoder.
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{w: bufio.NewWriter(w)}
+	return &Encoder{w: bufio.NewWriter(w), dst: w}
 }
 
 // Encoder wraps an underlying io.Writer and allows you to stream
 // proto encodings on it.
 type Encoder struct {
-	w *bufio.Writer
+	w   *bufio.Writer
+	dst io.Writer
 }
 
 // Encode takes any proto.Message and streams it to the underlying writer.
-// Messages are framed with a length prefix.
-func (e *Encoder) Encode(msg proto.Message) (int64, error) {
+// Messages are framed with a length prefix. If writing fails what remains
+// buffered of the message is discarded so the encoder may be used again.
+func (e *Encoder) Encode(msg proto.Message) (_ int64, err error) {
+	defer func() {
+		if err != nil {
+			e.w.Reset(e.dst)
+		}
+	}()
+
 	prefixBuf := make([]byte, prefixSize)
 
 	buf, err := proto.Marshal(msg)
@@ -53,6 +66,12 @@ func (e *Encoder) Encode(msg proto.Message) (int64, error) {
 	return int64(n + prefixSize), nil
 }
 
+// Size returns the number of bytes Encode writes for the given message
+// including its length prefix.
+func Size(msg proto.Message) int64 {
+	return int64(proto.Size(msg) + prefixSize)
+}
+
 // NewDecoder creates a streaming protobuf decoder.
 func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{r: r}
@@ -76,17 +95,18 @@ func (d *Decoder) Decode(v proto.Message) (int64, error) {
 
 	n := binary.BigEndian.Uint64(prefixBuf)
 
-	buf := make([]byte, n)
+	// Don't trust the length prefix for preallocating large buffers as it
+	// may be garbage (e.g: a partially written trailing message).
+	var buf bytes.Buffer
+	if n <= maxPrealloc {
+		buf.Grow(int(n))
+	}
 
-	idx := uint64(0)
-	for idx < n {
-		m, err := d.r.Read(buf[idx:n])
-		if err != nil {
-			return 0, errors.Wrap(translateError(err), "failed reading marshaled data")
-		}
-		idx += uint64(m)
+	m, err := io.CopyN(&buf, d.r, int64(n))
+	if err != nil {
+		return 0, errors.Wrap(translateError(err), "failed reading marshaled data")
 	}
-	return int64(idx + prefixSize), proto.Unmarshal(buf[:n], v)
+	return m + prefixSize, proto.Unmarshal(buf.Bytes(), v)
 }
 
 func translateError(err error) error {
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Trie is a radix tree of keys used to find keys by prefix in lexicographic
+// (byte-wise) order.
+type Trie struct {
+	sync.RWMutex
+
+	root node
+	size int
+}
+
+type node struct {
+	// prefix is the label of the edge from the node's parent
+	prefix   string
+	children []*node // sorted by the first byte of their prefix
+	leaf     bool
+}
+
+// NewTrie returns a new empty Trie
+func NewTrie() *Trie {
+	return &Trie{}
+}
+
+// child returns the index of the child whose prefix starts with `c` or, if
+// there is no such child, the index it would be inserted at.
+func (n *node) child(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= c
+	})
+	return i, i < len(n.children) && n.children[i].prefix[0] == c
+}
+
+func (n *node) insert(i int, child *node) {
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+// Add adds the key to the trie
+func (t *Trie) Add(key string) {
+	t.Lock()
+	defer t.Unlock()
+
+	n := &t.root
+	for key != "" {
+		i, ok := n.child(key[0])
+		if !ok {
+			n.insert(i, &node{prefix: key, leaf: true})
+			t.size++
+			return
+		}
+
+		c := n.children[i]
+		common := commonPrefix(c.prefix, key)
+		if common < len(c.prefix) {
+			// Split the edge at the end of the common prefix
+			split := &node{prefix: c.prefix[:common], children: []*node{c}}
+			c.prefix = c.prefix[common:]
+			n.children[i] = split
+			c = split
+		}
+
+		n = c
+		key = key[common:]
+	}
+
+	if !n.leaf {
+		n.leaf = true
+		t.size++
+	}
+}
+
+// Remove removes the key from the trie, if present
+func (t *Trie) Remove(key string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.root.remove(key) {
+		t.size--
+	}
+}
+
+func (n *node) remove(key string) bool {
+	if key == "" {
+		if !n.leaf {
+			return false
+		}
+		n.leaf = false
+		return true
+	}
+
+	i, ok := n.child(key[0])
+	if !ok || !strings.HasPrefix(key, n.children[i].prefix) {
+		return false
+	}
+
+	c := n.children[i]
+	if !c.remove(key[len(c.prefix):]) {
+		return false
+	}
+
+	// Prune nodes that no longer lead to any key and merge nodes with a
+	// single child back into it.
+	if !c.leaf {
+		switch len(c.children) {
+		case 0:
+			n.children = append(n.children[:i], n.children[i+1:]...)
+		case 1:
+			gc := c.children[0]
+			gc.prefix = c.prefix + gc.prefix
+			n.children[i] = gc
+		}
+	}
+
+	return true
+}
+
+// Len returns the number of keys in the trie
+func (t *Trie) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.size
+}
+
+// PrefixSearch returns all keys with the given prefix in lexicographic
+// order
+func (t *Trie) PrefixSearch(prefix string) []string {
+	var keys []string
+	t.Walk(prefix, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Walk calls the function `f` with all keys with the given prefix in
+// lexicographic order until `f` returns false. The trie must not be modified
+// by `f`.
+func (t *Trie) Walk(prefix string, f func(key string) bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	n, path := &t.root, ""
+	for key := prefix; key != ""; {
+		i, ok := n.child(key[0])
+		if !ok {
+			return
+		}
+
+		c := n.children[i]
+		switch {
+		case strings.HasPrefix(key, c.prefix):
+			key = key[len(c.prefix):]
+		case strings.HasPrefix(c.prefix, key):
+			// The prefix ends part way through the edge
+			key = ""
+		default:
+			return
+		}
+
+		n, path = c, path+c.prefix
+	}
+
+	n.walk(path, f)
+}
+
+func (n *node) walk(path string, f func(key string) bool) bool {
+	if n.leaf && !f(path) {
+		return false
+	}
+	for _, c := range n.children {
+		if !c.walk(path+c.prefix, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// RangeSearch returns all keys between `lower` and `upper` (inclusive) in
+// lexicographic order. An empty `lower` or `upper` leaves the range
+// unbounded at that end.
+func (t *Trie) RangeSearch(lower, upper string) []string {
+	t.RLock()
+	defer t.RUnlock()
+
+	var keys []string
+	t.root.walkRange("", lower, upper, func(key string) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// walkRange is walk for the keys between `lower` and `upper`; it returns
+// false once past `upper`.
+func (n *node) walkRange(path, lower, upper string, f func(key string)) bool {
+	if upper != "" && path > upper {
+		return false
+	}
+	// All keys of the subtree are before `lower`
+	if path < lower && !strings.HasPrefix(lower, path) {
+		return true
+	}
+
+	if n.leaf && path >= lower {
+		f(path)
+	}
+	for _, c := range n.children {
+		if !c.walkRange(path+c.prefix, lower, upper, f) {
+			return false
+		}
+	}
+	return true
+}
+
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,51 @@
+//go:build !linux && !darwin
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// WritableRegion is a writable mapping of a file whose bytes are updated in
+// place and written back to the file by Sync. On this platform the file is
+// read into memory instead and written back as a whole.
+type WritableRegion struct {
+	f    *os.File
+	data []byte
+}
+
+// OpenWritableRegion maps the whole of the existing file `fn` for reading
+// and writing.
+func OpenWritableRegion(fn string) (*WritableRegion, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &WritableRegion{f: f, data: data}, nil
+}
+
+// Bytes returns the mapped memory, which is only valid until Close
+func (r *WritableRegion) Bytes() []byte {
+	return r.data
+}
+
+// Sync writes the mapped memory back to the file and waits for it to be
+// on disk
+func (r *WritableRegion) Sync() error {
+	if _, err := r.f.WriteAt(r.data, 0); err != nil {
+		return err
+	}
+	return r.f.Sync()
+}
+
+// Close unmaps the memory without syncing it
+func (r *WritableRegion) Close() error {
+	r.data = nil
+	return r.f.Close()
+}
@@ -0,0 +1,67 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// WritableRegion is a writable shared memory mapping of a file whose bytes
+// are updated in place and written back to the file by Sync.
+type WritableRegion struct {
+	data []byte
+}
+
+// OpenWritableRegion maps the whole of the existing file `fn` for reading
+// and writing.
+func OpenWritableRegion(fn string) (*WritableRegion, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return &WritableRegion{}, nil
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &WritableRegion{data: data}, nil
+}
+
+// Bytes returns the mapped memory, which is only valid until Close
+func (r *WritableRegion) Bytes() []byte {
+	return r.data
+}
+
+// Sync writes the mapped memory back to the file and waits for it to be
+// on disk
+func (r *WritableRegion) Sync() error {
+	if len(r.data) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&r.data[0])), uintptr(len(r.data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Close unmaps the memory without syncing it
+func (r *WritableRegion) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	data := r.data
+	r.data = nil
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,104 @@
+package bitcask
+
+// Iterator iterates over the keys of the database, and their values, as of
+// a point in time snapshot taken when it was created (see
+// Bitcask.Iterator). An Iterator is not safe for concurrent use.
+//
+//	it := db.Iterator()
+//	defer it.Close()
+//	for it.Next() {
+//		value, err := it.Value()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	snapshot *snapshot
+	key      string
+	valid    bool // whether key is the current key
+	next     int
+	err      error
+}
+
+// Iterator returns an iterator over all keys of the database in
+// lexicographic order. The keys, and the location of their values, are
+// snapshotted when the iterator is created and no lock is held while
+// iterating, so the database may be written to (including from the loop
+// using the iterator) without the iterator seeing any of the writes. The
+// iterator must be closed with Close which releases the datafiles of the
+// snapshot (see Backup).
+func (b *Bitcask) Iterator() *Iterator {
+	return b.PrefixIterator("")
+}
+
+// PrefixIterator is like Iterator but only iterates over the keys with the
+// given prefix.
+func (b *Bitcask) PrefixIterator(prefix string) *Iterator {
+	if err := b.maybeRefresh(); err != nil {
+		return &Iterator{err: err}
+	}
+
+	snapshot, err := b.snapshot(prefix)
+	if err != nil {
+		return &Iterator{err: err}
+	}
+	return &Iterator{snapshot: snapshot}
+}
+
+// Next advances the iterator to the next key and returns true unless there
+// are no more keys or an error occurred (see Err).
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.snapshot == nil || it.next >= len(it.snapshot.keys) {
+		it.key, it.valid = "", false
+		return false
+	}
+	it.key, it.valid = it.snapshot.keys[it.next], true
+	it.next++
+	return true
+}
+
+// Key returns the current key
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value reads the value of the current key as of the snapshot. The value is
+// a copy owned by the caller as with Get.
+func (it *Iterator) Value() ([]byte, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if !it.valid {
+		return nil, ErrKeyNotFound
+	}
+
+	e, err := it.snapshot.entry(it.key)
+	if err != nil {
+		it.err = err
+		return nil, err
+	}
+	value, err := it.snapshot.config.value(e)
+	if err != nil {
+		it.err = err
+		return nil, err
+	}
+	return value, nil
+}
+
+// Err returns the first error that occurred creating the iterator or
+// reading a value, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the snapshot of the iterator. It is safe to call Close
+// more than once.
+func (it *Iterator) Close() error {
+	if it.snapshot != nil {
+		it.snapshot.close()
+		it.snapshot = nil
+	}
+	it.key, it.valid = "", false
+	return nil
+}
@@ -0,0 +1,347 @@
+package bitcask
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// lockRetryDelay is how often a merge waiting for the database's lock (see
+// WithMergeLockTimeout) retries taking it
+const lockRetryDelay = 10 * time.Millisecond
+
+// ErrDatabaseOpen is the error returned by Merge and MergeWithOptions for a
+// database that is open (for writing) in this process; the database must be
+// closed before it can be merged, or be merged with Bitcask.Merge instead.
+var ErrDatabaseOpen = errors.New("error: database is open")
+
+// errMergePending is the error returned when starting a merge while the
+// output of a committed merge that failed is yet to be moved into place,
+// which is done when the database is next opened
+var errMergePending = errors.New("error: merge pending recovery")
+
+// openDatabases are the absolute paths of the databases open for writing in
+// this process which standalone merges refuse to merge
+var openDatabases = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+func registerOpen(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	openDatabases.Lock()
+	defer openDatabases.Unlock()
+	openDatabases.paths[path] = true
+}
+
+func unregisterOpen(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	openDatabases.Lock()
+	defer openDatabases.Unlock()
+	delete(openDatabases.paths, path)
+}
+
+func isOpen(path string) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	openDatabases.Lock()
+	defer openDatabases.Unlock()
+	return openDatabases.paths[path]
+}
+
+// lockMerge takes the lock of the database at `path` for a standalone
+// merge, waiting up to `timeout` for another process to release it, and
+// returns the function releasing it.
+func lockMerge(path string, timeout time.Duration) (func(), error) {
+	if isOpen(path) {
+		return nil, ErrDatabaseOpen
+	}
+
+	lock := flock.New(filepath.Join(path, "lock"))
+
+	locked, err := lock.TryLock()
+	if err == nil && !locked && timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		locked, err = lock.TryLockContext(ctx, lockRetryDelay)
+		if err == context.DeadlineExceeded {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrDatabaseLocked
+	}
+
+	return func() {
+		lock.Unlock()
+		os.Remove(lock.Path())
+	}, nil
+}
+
+const (
+	// mergeDirname is the directory (inside the database directory) merges
+	// write their output to before it replaces the merged datafiles
+	mergeDirname = "merge"
+
+	// mergeMarker is the file (inside the database directory) that records
+	// the state of a merge in progress
+	mergeMarker = "merge.json"
+)
+
+// mergeState is the state of a merge in progress as recorded in the merge
+// marker. Until a merge is committed the merged datafiles are left untouched
+// and an interrupted merge is rolled back by discarding its output. Once
+// committed an interrupted merge is rolled forward by moving the rest of its
+// output into place.
+type mergeState struct {
+	// Committed is true once the merge output is complete
+	Committed bool `json:"committed"`
+
+	// Merged are the ids of the datafiles replaced by the merge output
+	Merged []int `json:"merged"`
+
+	// Output are the ids of the datafiles written by the merge
+	Output []int `json:"output"`
+}
+
+func datafilePath(path string, id int) string {
+	return filepath.Join(path, fmt.Sprintf(internal.DefaultDatafileFilename, id))
+}
+
+func hintPath(path string, id int) string {
+	return strings.TrimSuffix(datafilePath(path, id), ".data") + ".hint"
+}
+
+func writeMergeState(path string, state mergeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	fn := filepath.Join(path, mergeMarker)
+	if err := ioutil.WriteFile(fn+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// readMergeState returns the state recorded in the merge marker and whether
+// there is a merge marker.
+func readMergeState(path string) (mergeState, bool, error) {
+	var state mergeState
+
+	data, err := ioutil.ReadFile(filepath.Join(path, mergeMarker))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, false, nil
+		}
+		return state, false, err
+	}
+
+	// A marker that can't be decoded was being written by beginMerge
+	if err := json.Unmarshal(data, &state); err != nil {
+		return mergeState{}, true, nil
+	}
+	return state, true, nil
+}
+
+// beginMerge records the start of a merge and returns the (empty) directory
+// the merge must write its output to.
+func beginMerge(path string) (string, error) {
+	state, _, err := readMergeState(path)
+	if err != nil {
+		return "", err
+	}
+	if state.Committed {
+		return "", errMergePending
+	}
+
+	if err := writeMergeState(path, mergeState{}); err != nil {
+		return "", err
+	}
+
+	temp := filepath.Join(path, mergeDirname)
+	if err := os.RemoveAll(temp); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(temp, 0755); err != nil {
+		return "", err
+	}
+	return temp, nil
+}
+
+// abortMerge discards the output of the merge in progress, if any.
+func abortMerge(path string) error {
+	if err := os.RemoveAll(filepath.Join(path, mergeDirname)); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(path, mergeMarker))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// discardMerge discards the output of the merge in progress that failed
+// unless it was committed, in which case the merged datafiles may already
+// have been replaced and so the merge is left for recoverMerge to finish.
+func discardMerge(path string) error {
+	state, _, err := readMergeState(path)
+	if err != nil || state.Committed {
+		return err
+	}
+	return abortMerge(path)
+}
+
+// commitMerge commits the output of the merge in progress and moves it into
+// place replacing the datafiles with the given ids.
+func commitMerge(path string, merged []int) error {
+	fns, err := internal.GetDatafiles(filepath.Join(path, mergeDirname))
+	if err != nil {
+		return err
+	}
+
+	output, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+
+	state := mergeState{Committed: true, Merged: merged, Output: output}
+	if err := writeMergeState(path, state); err != nil {
+		return err
+	}
+
+	return finishMerge(path, state)
+}
+
+// finishMerge moves the output of a committed merge into place. It is safe
+// to call repeatedly should it be interrupted.
+func finishMerge(path string, state mergeState) error {
+	temp := filepath.Join(path, mergeDirname)
+
+	for _, id := range state.Merged {
+		err := os.Remove(hintPath(path, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	files, err := ioutil.ReadDir(temp)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		err := os.Rename(filepath.Join(temp, file.Name()), filepath.Join(path, file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	output := make(map[int]bool)
+	for _, id := range state.Output {
+		output[id] = true
+	}
+	for _, id := range state.Merged {
+		if output[id] {
+			continue
+		}
+		err := os.Remove(datafilePath(path, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return abortMerge(path)
+}
+
+// recoverMerge recovers from a merge that was interrupted (e.g: by a crash)
+// by either rolling it back or forward depending on whether it had been
+// committed.
+func recoverMerge(path string) error {
+	state, ok, err := readMergeState(path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return os.RemoveAll(filepath.Join(path, mergeDirname))
+	}
+	if !state.Committed {
+		return abortMerge(path)
+	}
+
+	return finishMerge(path, state)
+}
+
+// loadHint adds the keys of the hint file of the datafile with the given id
+// to the keydir, trie and recent keys. It returns false if the datafile has
+// no hint file or its hint file does not match the datafile (unless strict
+// in which case ErrHintMismatch is returned) and so the datafile must be
+// read instead.
+func loadHint(path string, id int, keydir *internal.Keydir, trie *internal.Trie, recent *internal.RecentKeys, strict bool) (bool, error) {
+	hint, err := internal.LoadHint(hintPath(path, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if strict {
+			return false, ErrHintMismatch
+		}
+		return false, nil
+	}
+
+	ok, err := hint.Matches(datafilePath(path, id))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		if strict {
+			return false, ErrHintMismatch
+		}
+		return false, nil
+	}
+
+	// The deletions are recorded with the highest sequence number of the
+	// datafile, as their own aren't in the hint file, so that they are
+	// exported (see ExportSince) rather than missed
+	keydir.UpdateSequence(hint.Sequence)
+	for _, key := range hint.Deleted {
+		if _, ok := keydir.Get(key); ok {
+			trie.Remove(key)
+			recent.Remove(key)
+		}
+		keydir.Remove(key, hint.Sequence)
+	}
+	for key, item := range hint.Items {
+		for _, version := range hint.Versions[key] {
+			keydir.Overwrite(key, version)
+		}
+		keydir.Overwrite(key, item)
+		trie.Add(key)
+		recent.Add(key)
+	}
+
+	return true, nil
+}
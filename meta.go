@@ -0,0 +1,134 @@
+package bitcask
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const metaFilename = "meta.json"
+
+// ErrOptionMismatch is the error returned by Open when an option is
+// incompatible with the options the database was created with (as recorded
+// in its meta file).
+var ErrOptionMismatch = errors.New("error: option mismatch")
+
+// meta records the options a database was created with so that later Opens
+// use the same options unless explicitly overridden in a compatible way.
+type meta struct {
+	MaxDatafileSize int `json:"max_datafile_size"`
+	MaxKeySize      int `json:"max_key_size"`
+	MaxValueSize    int `json:"max_value_size"`
+
+	// Compression is the name of the codec the values are compressed with
+	// (see WithCompression), if any
+	Compression string `json:"compression,omitempty"`
+}
+
+// loadMeta reads the meta file of the database, if any, adopting any
+// options recorded in it that `cfg` doesn't set explicitly and failing
+// with ErrOptionMismatch if `cfg` is incompatible with it, and returns the
+// meta read, which is nil for a new database. The meta file is only written
+// once the database is opened (see saveMeta).
+//
+// Lowering the maximum key or value size is incompatible as the database
+// may already contain larger keys or values, as is a codec other than the
+// one the values are compressed with (without WithCompression compressed
+// values are read with Gzip); the maximum datafile size can be changed
+// freely (see WithEnforceDatafileSizeOnOpen).
+func loadMeta(path string, cfg *config) (*meta, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, metaFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var m meta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", metaFilename)
+	}
+
+	if !cfg.maxDatafileSizeSet && m.MaxDatafileSize > 0 {
+		cfg.maxDatafileSize = m.MaxDatafileSize
+	}
+
+	if !cfg.maxKeySizeSet && m.MaxKeySize > 0 {
+		cfg.maxKeySize = m.MaxKeySize
+	} else if cfg.maxKeySize < m.MaxKeySize {
+		return nil, errors.Wrapf(
+			ErrOptionMismatch,
+			"max key size %d is smaller than the database's %d",
+			cfg.maxKeySize, m.MaxKeySize,
+		)
+	}
+
+	if !cfg.maxValueSizeSet && m.MaxValueSize > 0 {
+		cfg.maxValueSize = m.MaxValueSize
+	} else if cfg.maxValueSize < m.MaxValueSize {
+		return nil, errors.Wrapf(
+			ErrOptionMismatch,
+			"max value size %d is smaller than the database's %d",
+			cfg.maxValueSize, m.MaxValueSize,
+		)
+	}
+
+	codec := cfg.compression
+	if codec == nil {
+		codec = Gzip{}
+	}
+	if m.Compression != "" && codec.Name() != m.Compression {
+		return nil, errors.Wrapf(
+			ErrOptionMismatch,
+			"compression %s doesn't match the database's %s",
+			codec.Name(), m.Compression,
+		)
+	}
+
+	return &m, nil
+}
+
+// saveMeta writes the meta file of the database opened with `cfg` whose
+// meta file read by loadMeta was `stored`: a new database records the
+// options it was created with, which later Opens are compared against,
+// and an existing one only records the raised maximum key or value size
+// or the codec of the values compressed from now on, if any, as the
+// database may since contain larger keys or values or compressed ones.
+// The caller must not write the meta file of a read-only database.
+func saveMeta(path string, stored *meta, cfg *config) error {
+	m := meta{
+		MaxDatafileSize: cfg.maxDatafileSize,
+		MaxKeySize:      cfg.maxKeySize,
+		MaxValueSize:    cfg.maxValueSize,
+	}
+	if stored != nil {
+		m = *stored
+		if cfg.maxKeySize > m.MaxKeySize {
+			m.MaxKeySize = cfg.maxKeySize
+		}
+		if cfg.maxValueSize > m.MaxValueSize {
+			m.MaxValueSize = cfg.maxValueSize
+		}
+	}
+	if cfg.compression != nil {
+		m.Compression = cfg.compression.Name()
+	}
+	if stored != nil && m == *stored {
+		return nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	fn := filepath.Join(path, metaFilename)
+	if err := ioutil.WriteFile(fn+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
@@ -0,0 +1,82 @@
+package bitcask
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is implemented by the caller to instrument the database (see
+// WithMetrics), e.g: by updating Prometheus counters and histograms. Its
+// methods are called on the goroutine doing the operation but never while
+// the database holds any of its locks, so they may block (though that
+// slows the operation down) or call into the database.
+type Metrics interface {
+	// IncPut is called for every successful Put, PutWithFlags,
+	// PutWithTTL and PutGrouped.
+	IncPut()
+
+	// IncGet is called for every Get and GetView (and so GetInto) with
+	// whether the key was found. Gets that fail for another reason (e.g:
+	// an I/O error) aren't counted.
+	IncGet(hit bool)
+
+	// ObserveMergeDuration is called with the time taken by every
+	// successful Merge of the open database.
+	ObserveMergeDuration(d time.Duration)
+
+	// SetDiskBytes is called with the total size of the datafiles when
+	// the database is opened, after every Merge and whenever it is
+	// synced.
+	SetDiskBytes(n int64)
+
+	// IncCollision is called for every read by Get, GetView, GetMulti and
+	// GetReader of an entry that belongs to another key than the one it
+	// was read for, which is never returned (see Get).
+	IncCollision()
+}
+
+// nopMetrics is the default Metrics which does nothing
+type nopMetrics struct{}
+
+func (nopMetrics) IncPut()                            {}
+func (nopMetrics) IncGet(hit bool)                    {}
+func (nopMetrics) ObserveMergeDuration(time.Duration) {}
+func (nopMetrics) SetDiskBytes(int64)                 {}
+func (nopMetrics) IncCollision()                      {}
+
+// observeGet counts a Get that returned `err`
+func (b *Bitcask) observeGet(err error) {
+	b.observeCollisions()
+
+	switch err {
+	case nil:
+		b.config.metrics.IncGet(true)
+	case ErrKeyNotFound:
+		b.config.metrics.IncGet(false)
+	}
+}
+
+// observeCollisions reports the collisions counted (see collided) since
+// they were last reported; the caller must not hold any lock.
+func (b *Bitcask) observeCollisions() {
+	for n := atomic.SwapUint64(&b.collisions, 0); n > 0; n-- {
+		b.config.metrics.IncCollision()
+	}
+}
+
+// observeDiskBytes reports the total size of the datafiles; the caller must
+// not hold any lock.
+func (b *Bitcask) observeDiskBytes() {
+	if _, ok := b.config.metrics.(nopMetrics); ok {
+		return
+	}
+
+	b.mu.RLock()
+	n := b.curr.Size()
+	for _, df := range b.datafiles {
+		n += df.Size()
+	}
+	b.mu.RUnlock()
+
+	b.config.metrics.SetDiskBytes(n)
+}
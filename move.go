@@ -0,0 +1,100 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+// Move relocates the (closed) database at `src` to `dst` which must not
+// exist yet. The database is locked for the duration of the move so that
+// a database that is open (or being opened), including read-only, is
+// refused with ErrDatabaseLocked. The directory is renamed if possible,
+// otherwise (e.g: across filesystems) its files are copied and `src`
+// removed once the copy is complete. Either way the database is then
+// opened at `dst` and checked with SelfTest before Move returns.
+//
+// A database stores no absolute paths (datafiles, hints and meta are all
+// named relative to the database's directory) so a moved database needs no
+// further changes; Move exists so deployment scripts don't have to get the
+// locking and the copying fallback right themselves.
+func Move(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return errors.Errorf("error: destination %s already exists", dst)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+
+	lock := flock.New(filepath.Join(src, "lock"))
+	locked, err := lock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrDatabaseLocked
+	}
+	readLock, err := lockReaders(src)
+	if err != nil {
+		lock.Unlock()
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		err = copyDir(src, dst)
+		if err != nil {
+			readLock.Unlock()
+			lock.Unlock()
+			os.RemoveAll(dst)
+			return errors.Wrapf(err, "error copying %s to %s", src, dst)
+		}
+		readLock.Unlock()
+		lock.Unlock()
+		if err := os.RemoveAll(src); err != nil {
+			return err
+		}
+	} else {
+		readLock.Unlock()
+		lock.Unlock()
+	}
+	os.Remove(filepath.Join(dst, "lock"))
+	os.Remove(filepath.Join(dst, readLockFilename))
+
+	db, err := Open(dst, WithReadOnly())
+	if err != nil {
+		return errors.Wrapf(err, "error opening moved database %s", dst)
+	}
+	defer db.Close()
+
+	return db.SelfTest()
+}
+
+// copyDir copies the directory `src` and all of its contents to `dst`
+// (except for the lock file)
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case rel == "lock" || rel == readLockFilename:
+			return nil
+		default:
+			return copyFile(path, target)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package bitcask
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prologic/bitcask/internal"
+)
+
+// GetMulti retrieves the values of the given keys returning a map of the
+// keys found to their values; keys that aren't found are omitted rather
+// than failing the whole lookup (see GetMultiStrict). The values are read
+// in the order they are stored in the datafiles, rather than in the order
+// of `keys`, to avoid seeking back and forth, and as with Get are copies
+// owned by the caller. An I/O error or corrupted value fails the lookup.
+func (b *Bitcask) GetMulti(keys []string) (map[string][]byte, error) {
+	values, _, err := b.getMulti(keys)
+	return values, err
+}
+
+// GetMultiStrict is like GetMulti but fails with ErrKeyNotFound (see
+// errors.Cause) if any of the keys isn't found.
+func (b *Bitcask) GetMultiStrict(keys []string) (map[string][]byte, error) {
+	values, missing, err := b.getMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, errors.Wrapf(ErrKeyNotFound, "%d of %d keys not found (first %q)", len(missing), len(keys), missing[0])
+	}
+	return values, nil
+}
+
+// getMulti returns the values of the keys found and the keys not found in
+// the order they were given.
+func (b *Bitcask) getMulti(keys []string) (map[string][]byte, []string, error) {
+	if err := b.maybeRefresh(); err != nil {
+		return nil, nil, err
+	}
+
+	defer b.observeCollisions()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	type location struct {
+		key  string
+		item internal.Item
+	}
+
+	var (
+		missing   []string
+		locations []location
+	)
+	values := make(map[string][]byte, len(keys))
+	now := time.Now()
+
+	for _, key := range keys {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if n, ok := b.counters.get(key); ok {
+			values[key] = []byte(strconv.FormatInt(n, 10))
+			continue
+		}
+		if value, ok := b.getPending(key); ok {
+			values[key] = append([]byte(nil), value...)
+			continue
+		}
+
+		item, ok := b.keydir.Get(key)
+		if !ok || item.Expired(now) {
+			missing = append(missing, key)
+			continue
+		}
+		// Marks the key as found (and so seen) until it is read below
+		values[key] = nil
+		locations = append(locations, location{key, item})
+	}
+
+	sort.Slice(locations, func(i, j int) bool {
+		a, b := locations[i].item, locations[j].item
+		if a.FileID != b.FileID {
+			return a.FileID < b.FileID
+		}
+		return a.Offset < b.Offset
+	})
+
+	for _, l := range locations {
+		df, ok := b.datafile(l.item.FileID)
+		if !ok {
+			delete(values, l.key)
+			missing = append(missing, l.key)
+			continue
+		}
+
+		e, err := b.readAt(df, l.item.Offset, l.item.Size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if e.Key != l.key {
+			// The entry of another key, see read
+			b.collided()
+			e, _, err = b.readOlder(l.key)
+			if err == ErrKeyNotFound {
+				delete(values, l.key)
+				missing = append(missing, l.key)
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if !b.config.noChecksum && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+			return nil, nil, ErrChecksumFailed
+		}
+
+		value, err := b.config.value(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[l.key] = value
+		if b.keystats != nil {
+			b.keystats.Touch(l.key)
+		}
+	}
+
+	return values, missing, nil
+}
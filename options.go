@@ -1,5 +1,17 @@
 package bitcask
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 const (
 	// DefaultMaxDatafileSize is the default maximum datafile size in bytes
 	DefaultMaxDatafileSize = 1 << 20 // 1MB
@@ -9,6 +21,10 @@ const (
 
 	// DefaultMaxValueSize is the default value size in bytes
 	DefaultMaxValueSize = 1 << 16 // 65KB
+
+	// DefaultAutoMergeInterval is the default interval at which the
+	// reclaimable ratio is checked with WithAutoMerge
+	DefaultAutoMergeInterval = time.Minute
 )
 
 // Option is a function that takes a config struct and modifies it
@@ -18,6 +34,74 @@ type config struct {
 	maxDatafileSize int
 	maxKeySize      int
 	maxValueSize    int
+
+	// Whether the sizes above were set explicitly (rather than being the
+	// defaults) as those that weren't are adopted from the database's meta.
+	maxDatafileSizeSet bool
+	maxKeySizeSet      bool
+	maxValueSizeSet    bool
+
+	keyStats      bool
+	keyStatsDecay time.Duration
+
+	enforceDatafileSizeOnOpen bool
+	mergeSortKeys             bool
+
+	fencing      bool
+	fencingToken uint64
+
+	tombstoneHistory int
+
+	readOnly     bool
+	maxStaleness time.Duration
+
+	strictHints bool
+
+	compactOnRead int
+
+	groupCommit      bool
+	groupCommitDelay time.Duration
+	groupCommitBatch int
+
+	counterKeys       []string
+	counterCheckpoint time.Duration
+
+	eagerCloseDatafiles bool
+
+	mergeForce       bool
+	mergeLockTimeout time.Duration
+
+	faultInjector FaultInjector
+
+	compressHints bool
+
+	expiry time.Duration
+
+	autoMergeRatio    float64
+	autoMergeInterval time.Duration
+
+	noChecksum bool
+
+	syncWrites bool
+
+	maxVersions int
+
+	persistentIndex       bool
+	persistentIndexOnSync bool
+
+	metrics Metrics
+
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	subdir   string
+
+	strictRecovery bool
+
+	maxOpenFiles int
+
+	compression Codec
+
+	deleteReclaimRatio float64
 }
 
 func newDefaultConfig() *config {
@@ -25,6 +109,19 @@ func newDefaultConfig() *config {
 		maxDatafileSize: DefaultMaxDatafileSize,
 		maxKeySize:      DefaultMaxKeySize,
 		maxValueSize:    DefaultMaxValueSize,
+
+		autoMergeInterval: DefaultAutoMergeInterval,
+
+		maxVersions: 1,
+
+		metrics: nopMetrics{},
+	}
+}
+
+func withConfig(src *config) Option {
+	return func(cfg *config) error {
+		*cfg = *src
+		return nil
 	}
 }
 
@@ -32,6 +129,7 @@ func newDefaultConfig() *config {
 func WithMaxDatafileSize(size int) Option {
 	return func(cfg *config) error {
 		cfg.maxDatafileSize = size
+		cfg.maxDatafileSizeSet = true
 		return nil
 	}
 }
@@ -40,6 +138,7 @@ func WithMaxDatafileSize(size int) Option {
 func WithMaxKeySize(size int) Option {
 	return func(cfg *config) error {
 		cfg.maxKeySize = size
+		cfg.maxKeySizeSet = true
 		return nil
 	}
 }
@@ -48,6 +147,563 @@ func WithMaxKeySize(size int) Option {
 func WithMaxValueSize(size int) Option {
 	return func(cfg *config) error {
 		cfg.maxValueSize = size
+		cfg.maxValueSizeSet = true
+		return nil
+	}
+}
+
+// WithEnforceDatafileSizeOnOpen causes Open to rewrite the datafiles of a
+// database that were created with a larger maximum datafile size (see
+// WithMaxDatafileSize) so that no datafile exceeds the current limit.
+// Without this option oversized datafiles are left as they are; they remain
+// fully readable and only newly created datafiles respect the limit.
+func WithEnforceDatafileSizeOnOpen() Option {
+	return func(cfg *config) error {
+		cfg.enforceDatafileSizeOnOpen = true
+		return nil
+	}
+}
+
+// WithMergeSortKeys causes merges to write the surviving keys of each
+// datafile in sorted key order so that reading keys in order (such as with
+// Scan) reads the merged datafiles sequentially. Sorting requires holding
+// all keys of the datafile being merged in memory at once.
+func WithMergeSortKeys() Option {
+	return func(cfg *config) error {
+		cfg.mergeSortKeys = true
+		return nil
+	}
+}
+
+// WithFencingToken enables write fencing using the given epoch as this
+// writer's token. On Open the token is recorded as the database's epoch
+// (see Epoch) and every subsequent write fails with ErrFenced once the
+// on-disk epoch has advanced past it (see AdvanceEpoch), preventing a stale
+// writer from writing after a new one has taken over. Opening with a token
+// older than the current epoch fails with ErrFenced.
+//
+// Fencing is advisory: the epoch is checked before each write, so it only
+// protects against stale writers if the coordinator advances the epoch
+// before the new writer starts writing. It also adds a small file read to
+// every write.
+func WithFencingToken(epoch uint64) Option {
+	return func(cfg *config) error {
+		cfg.fencing = true
+		cfg.fencingToken = epoch
+		return nil
+	}
+}
+
+// WithTombstoneHistory keeps a history of the last `n` deleted keys which
+// is returned by RecentDeletes as a safety net for accidental deletes. The
+// history is saved on Close and survives reopening the database; the last
+// values of the deleted keys are only available until they are removed from
+// disk by a merge.
+func WithTombstoneHistory(n int) Option {
+	return func(cfg *config) error {
+		cfg.tombstoneHistory = n
+		return nil
+	}
+}
+
+// WithKeyStats enables tracking of approximate per-key access counts which
+// are reported by HotKeys. Counts are halved every `decay` interval so that
+// keys which are no longer accessed eventually drop out; a zero decay never
+// decays counts. Tracking uses a fixed amount of memory (a count-min sketch)
+// regardless of the number of keys, at the cost of a small overhead on every
+// Get and Put and of counts that may be over-estimated for rarely accessed
+// keys that collide with hot ones.
+func WithKeyStats(decay time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.keyStats = true
+		cfg.keyStatsDecay = decay
+		return nil
+	}
+}
+
+// WithReadOnly opens the database for reading only so that it can be read
+// while another process has it open for writing. Rather than the exclusive
+// lock of a database open for writing a read-only database takes a shared
+// lock, so any number of read-only databases and at most one database open
+// for writing can be open at the same time, while Move and ReplaceWith
+// refuse a database that is open read-only with ErrDatabaseLocked. A
+// read-only database is never merged on Open and fails all writes, as well
+// as Sync and Merge, with ErrReadOnly. Its index reflects the datafiles at
+// the time it was opened and is only updated by calling Refresh (see also
+// WithMaxStaleness).
+func WithReadOnly() Option {
+	return func(cfg *config) error {
+		cfg.readOnly = true
+		return nil
+	}
+}
+
+// WithMaxStaleness bounds how stale reads from a read-only database (see
+// WithReadOnly) can be: any read finding the index older than `d` first
+// refreshes it (see Refresh). Refreshing only reads the entries written
+// since the last refresh, however reads that trigger a refresh block other
+// reads until it completes, so a small `d` with a busy writer means many
+// reads pay the cost of a refresh and more frequent (if shorter) stalls.
+// The whole index is rebuilt if the writer has merged or replaced datafiles
+// in the meantime which is costly for large databases.
+func WithMaxStaleness(d time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.maxStaleness = d
+		return nil
+	}
+}
+
+// WithStrictHints causes Open to fail with ErrHintMismatch if the hint file
+// of a merged datafile does not match the datafile (e.g: because the hint
+// is stale or either file is corrupt). Without this option the mismatched
+// hint is ignored and the datafile read in full instead. Only the size and
+// final entries of the datafile are checked, so corruption of the datafile
+// before them is only detected by Verify.
+func WithStrictHints() Option {
+	return func(cfg *config) error {
+		cfg.strictHints = true
+		return nil
+	}
+}
+
+// WithCompactOnRead causes Get to rewrite the value of a key that has been
+// overwritten at least `threshold` times (since it was last compacted) to
+// the active datafile, consolidating the key in the most recent datafile so
+// that the older datafiles holding its stale versions no longer hold any of
+// its live data and are cheaper to merge. This is a side effect on reads:
+// a Get may write to the database (and rotate the active datafile) once per
+// threshold overwrites of the key. Disabled by default (a zero threshold).
+func WithCompactOnRead(threshold int) Option {
+	return func(cfg *config) error {
+		cfg.compactOnRead = threshold
+		return nil
+	}
+}
+
+// WithGroupCommit makes writes (Put and Delete) durable: they only return
+// once they have been synced to disk. Rather than syncing every write on
+// its own, the writes of concurrent writers are synced together, once
+// `maxBatch` writes are waiting or `maxDelay` after the first of them, so
+// that under load many writes share the cost of a single sync at the cost
+// of each write waiting up to `maxDelay` for its sync. Grouped writes (see
+// PutGrouped) and bulk loads (see BulkLoad) aren't synced until Sync or
+// Close is called.
+func WithGroupCommit(maxDelay time.Duration, maxBatch int) Option {
+	return func(cfg *config) error {
+		if maxBatch <= 0 {
+			return fmt.Errorf("error: invalid group commit batch size %d: must be greater than zero", maxBatch)
+		}
+		cfg.groupCommit = true
+		cfg.groupCommitDelay = maxDelay
+		cfg.groupCommitBatch = maxBatch
+		return nil
+	}
+}
+
+// WithCounterRegion registers the given keys as counters kept in the
+// counter region, a small memory mapped file of fixed size slots separate
+// from the datafiles, for hot counters incremented with Incr. Rather than
+// appending a new entry to the active datafile for every increment,
+// counters are incremented in memory and checkpointed every `checkpoint`
+// (and by Sync and Close) by overwriting their slots in place in the
+// mapping, which is then synced to disk. A crash loses the
+// increments made since the last checkpoint; a `checkpoint` of zero only
+// checkpoints on Sync and Close.
+//
+// Once registered a key remains a counter across reopens; an existing value
+// of the key is moved to the counter region when it is registered. Counters
+// can be read with Get and Has but can't be written with Put or Delete
+// (which return ErrCounterKey) and are not included in Keys, Scan, Fold or
+// Len.
+func WithCounterRegion(checkpoint time.Duration, keys ...string) Option {
+	return func(cfg *config) error {
+		if checkpoint < 0 {
+			return fmt.Errorf("error: invalid counter checkpoint interval %s: must not be negative", checkpoint)
+		}
+		cfg.counterKeys = append(cfg.counterKeys, keys...)
+		cfg.counterCheckpoint = checkpoint
+		return nil
+	}
+}
+
+// WithEagerCloseDatafiles keeps no file descriptors (or memory maps) open
+// for the datafiles other than the active datafile. By default every
+// datafile stays open from Open until Close; with this option reads from
+// older datafiles open the datafile, read the entry and close it again, so
+// only the active datafile's descriptors are open between operations. This
+// suits environments with tight limits on open files at the cost of an
+// open, mmap and close for every such read, which makes reads of keys not
+// in the active datafile considerably slower.
+func WithEagerCloseDatafiles() Option {
+	return func(cfg *config) error {
+		cfg.eagerCloseDatafiles = true
+		return nil
+	}
+}
+
+// WithMergeForce causes MergeWithOptions to merge datafiles that have
+// already been merged (see Merge's `force`)
+func WithMergeForce() Option {
+	return func(cfg *config) error {
+		cfg.mergeForce = true
+		return nil
+	}
+}
+
+// WithMergeLockTimeout causes MergeWithOptions to wait up to `d` for the
+// lock of a database locked by another process (which may be about to close
+// it) rather than failing with ErrDatabaseLocked right away. A database
+// open in this process is refused with ErrDatabaseOpen regardless.
+func WithMergeLockTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.mergeLockTimeout = d
+		return nil
+	}
+}
+
+// WithFaultInjector makes the database call the fault injector at the
+// points (see FaultPoint) where a crash or failed write is most likely to
+// leave it inconsistent, so that tests can make writes fail or tear part
+// way through Put, merges and rotations of the active datafile and verify
+// that the database recovers. The injector is also used by merges run by
+// Open and by Merge (when passed to it). A database that suffered an
+// injected fault should be treated like one that crashed: closed (or
+// abandoned) and reopened. Without an injector (the default) there is no
+// overhead.
+func WithFaultInjector(fi FaultInjector) Option {
+	return func(cfg *config) error {
+		cfg.faultInjector = fi
+		return nil
+	}
+}
+
+// WithCompressHints causes merges to gzip compress the hint files they
+// write, which for databases of many small keys makes the hint files much
+// smaller and may speed up Open where reading them is IO bound, at the cost
+// of decompressing them. Compressed and uncompressed hint files can be
+// mixed; both are read regardless of this option. A compressed hint file
+// whose checksum doesn't match is ignored (see WithStrictHints) and its
+// datafile read instead.
+func WithCompressHints() Option {
+	return func(cfg *config) error {
+		cfg.compressHints = true
+		return nil
+	}
+}
+
+// WithExpiry sets the default expiry of keys: keys put (other than with
+// PutWithTTL, which overrides it) expire after `ttl`, see PutWithTTL.
+// Counters (see WithCounterRegion) never expire.
+func WithExpiry(ttl time.Duration) Option {
+	return func(cfg *config) error {
+		if ttl <= 0 {
+			return ErrInvalidTTL
+		}
+		cfg.expiry = ttl
+		return nil
+	}
+}
+
+// WithAutoMerge merges the database in the background whenever the ratio of
+// reclaimable bytes to the total size of the datafiles (see Stats) exceeds
+// `triggerRatio`, which must be between 0 and 1, as checked every
+// DefaultAutoMergeInterval or the interval set with WithAutoMergeInterval.
+// The datafiles are merged while the database keeps serving reads and
+// writes, which are only blocked while the merged datafiles are swapped in.
+// Close waits for a merge in progress to finish. Failed merges are retried
+// at the next check. Auto merges are disabled for read-only databases.
+func WithAutoMerge(triggerRatio float64) Option {
+	return func(cfg *config) error {
+		if triggerRatio <= 0 || triggerRatio >= 1 {
+			return fmt.Errorf("error: invalid auto merge ratio %g: must be between 0 and 1", triggerRatio)
+		}
+		cfg.autoMergeRatio = triggerRatio
+		return nil
+	}
+}
+
+// WithAutoMergeInterval sets the interval at which the reclaimable ratio is
+// checked by WithAutoMerge.
+func WithAutoMergeInterval(interval time.Duration) Option {
+	return func(cfg *config) error {
+		if interval <= 0 {
+			return fmt.Errorf("error: invalid auto merge interval %s: must be greater than zero", interval)
+		}
+		cfg.autoMergeInterval = interval
+		return nil
+	}
+}
+
+// WithoutChecksum disables the verification of the CRC32 checksum of values
+// read by Get, GetView and GetInto which otherwise return ErrChecksumFailed
+// for a corrupted value. This saves hashing every value read at the risk of
+// returning corrupted values. Checksums are still written (so they can be
+// verified by Verify or by opening the database without this option).
+func WithoutChecksum() Option {
+	return func(cfg *config) error {
+		cfg.noChecksum = true
+		return nil
+	}
+}
+
+// WithSyncWrites, if enabled, syncs the active datafile to disk after every
+// Put and Delete (and Incr) before returning, so that a write that returned
+// without error survives a crash. By default writes are only synced by Sync
+// and Close and a crash may lose the writes made since. Syncing every write
+// makes writes many times slower, depending on the disk (see
+// BenchmarkSyncWrites); see
+// WithGroupCommit for sharing the cost of a sync between concurrent
+// writers.
+func WithSyncWrites(enabled bool) Option {
+	return func(cfg *config) error {
+		cfg.syncWrites = enabled
+		return nil
+	}
+}
+
+// WithMaxVersions keeps up to `n` versions of each key, the current value
+// and n-1 older values, which are returned by GetVersions. Rather than
+// dropping every overwritten value merges keep the `n` most recent versions
+// of each key (deleting a key drops all of its versions). A `n` of 1, the
+// default, only keeps the current value. Older versions are only kept by
+// merges and not by CompactDatafile and SplitDatafile.
+func WithMaxVersions(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return fmt.Errorf("error: invalid max versions %d: must be greater than zero", n)
+		}
+		cfg.maxVersions = n
+		return nil
+	}
+}
+
+// WithPersistentIndex saves the index to a file when the database is closed
+// (and by Sync if `onSync` is set) which Open then loads instead of reading
+// the hint files and datafiles, which is considerably faster for databases
+// with many keys. The index is only loaded if the datafiles have the same
+// size and modification time as when it was saved; otherwise (e.g: after a
+// crash, or after Open merged the datafiles rotated since) the index is
+// rebuilt from the datafiles as without this option.
+func WithPersistentIndex(onSync bool) Option {
+	return func(cfg *config) error {
+		cfg.persistentIndex = true
+		cfg.persistentIndexOnSync = onSync
+		return nil
+	}
+}
+
+// WithMetrics makes the database report metrics about its operations, such
+// as the number of puts and gets, to `m` (see Metrics) so that it can be
+// instrumented without depending on a metrics library. Without it (the
+// default) no metrics are reported.
+func WithMetrics(m Metrics) Option {
+	return func(cfg *config) error {
+		if m == nil {
+			m = nopMetrics{}
+		}
+		cfg.metrics = m
+		return nil
+	}
+}
+
+// WithFileMode sets the permissions of the datafiles and hint files,
+// including those written by merges, and of the lock file to `mode`
+// regardless of the umask. Without it the files are created with the
+// default permissions (as restricted by the umask).
+func WithFileMode(mode os.FileMode) Option {
+	return func(cfg *config) error {
+		cfg.fileMode = mode.Perm()
+		return nil
+	}
+}
+
+// WithDirMode sets the permissions of the database's directory, when Open
+// creates it, to `mode` regardless of the umask. Without it the directory
+// is created with the default permissions (as restricted by the umask).
+func WithDirMode(mode os.FileMode) Option {
+	return func(cfg *config) error {
+		cfg.dirMode = mode.Perm()
 		return nil
 	}
 }
+
+// WithSubdir stores the database in the subdirectory `name` of the path
+// given to Open (and Merge) so that several databases can share a parent
+// directory. The name must be a relative path within the parent directory.
+func WithSubdir(name string) Option {
+	return func(cfg *config) error {
+		clean := filepath.Clean(name)
+		if name == "" || filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("error: invalid subdir %q: must be a relative path within the parent directory", name)
+		}
+		cfg.subdir = clean
+		return nil
+	}
+}
+
+// WithStrictRecovery makes Open fail if the active datafile ends with a
+// corrupt or partially written entry or transaction, as left by a crash
+// during a write, rather than truncating it (see Bitcask.Recovered).
+func WithStrictRecovery() Option {
+	return func(cfg *config) error {
+		cfg.strictRecovery = true
+		return nil
+	}
+}
+
+// WithMaxOpenFiles keeps the file descriptors (and memory maps) of at most
+// `n` datafiles other than the active datafile open, which stays open, for
+// databases of too many datafiles to keep all of them open. Like with
+// WithEagerCloseDatafiles the datafiles are closed once loaded by Open but
+// reads from them go through a cache of up to `n` open datafiles, opening
+// the datafile if it isn't in the cache and closing the least recently
+// read datafile when the cache is full.
+func WithMaxOpenFiles(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 {
+			return fmt.Errorf("error: invalid max open files %d: must be greater than zero", n)
+		}
+		cfg.maxOpenFiles = n
+		cfg.eagerCloseDatafiles = true
+		return nil
+	}
+}
+
+// WithCompression compresses the values written to the database with the
+// codec `codec` (e.g: Gzip) and decompresses them when read. Values are
+// only stored compressed, which is recorded for each entry (see
+// FlagCompressed), if compressing them makes them smaller so databases may
+// mix compressed and uncompressed values: a database written without
+// compression can be opened with it, and vice versa as long as the values
+// were compressed with Gzip: the codec is recorded in the database's meta
+// file and opening a database with another codec than the one its values
+// were compressed with fails with ErrOptionMismatch. The maximum value size
+// applies to the values before they are compressed.
+func WithCompression(codec Codec) Option {
+	return func(cfg *config) error {
+		cfg.compression = codec
+		return nil
+	}
+}
+
+// WithDeleteReclaim merges the database in the background, as with
+// WithAutoMerge, as soon as deleting keys makes the ratio of reclaimable
+// bytes to the total size of the datafiles (see Stats) exceed `ratio`,
+// which must be between 0 and 1, so that the disk space taken up by the
+// deleted keys is reclaimed right away. Deletes only signal the background
+// merger, which checks the ratio and merges, so they don't wait for it.
+// Like auto merges it is disabled for read-only databases.
+func WithDeleteReclaim(ratio float64) Option {
+	return func(cfg *config) error {
+		if ratio <= 0 || ratio >= 1 {
+			return fmt.Errorf("error: invalid delete reclaim ratio %g: must be between 0 and 1", ratio)
+		}
+		cfg.deleteReclaimRatio = ratio
+		return nil
+	}
+}
+
+// fileConfig is the declarative form of the configuration options as read
+// by OptionsFromJSON and OptionsFromFile. Fields that are omitted keep their
+// default values.
+type fileConfig struct {
+	MaxDatafileSize *int `json:"max_datafile_size"`
+	MaxKeySize      *int `json:"max_key_size"`
+	MaxValueSize    *int `json:"max_value_size"`
+
+	// Sync is WithSyncWrites and Compression is the name of the codec
+	// of WithCompression, one of the built-in codecs ("gzip") or "none"
+	Sync        *bool   `json:"sync"`
+	Compression *string `json:"compression"`
+}
+
+// codecs are the built-in codecs by name (see fileConfig)
+var codecs = map[string]Codec{
+	Gzip{}.Name(): Gzip{},
+}
+
+func (fc fileConfig) validate() error {
+	sizes := []struct {
+		name  string
+		value *int
+	}{
+		{"max_datafile_size", fc.MaxDatafileSize},
+		{"max_key_size", fc.MaxKeySize},
+		{"max_value_size", fc.MaxValueSize},
+	}
+	for _, size := range sizes {
+		if size.value != nil && *size.value <= 0 {
+			return fmt.Errorf("error: invalid %s %d: must be greater than zero", size.name, *size.value)
+		}
+	}
+
+	if fc.Compression != nil && *fc.Compression != "none" {
+		if _, ok := codecs[*fc.Compression]; !ok {
+			return fmt.Errorf("error: invalid compression %q: must be gzip or none", *fc.Compression)
+		}
+	}
+	return nil
+}
+
+func (fc fileConfig) options() []Option {
+	var options []Option
+	if fc.MaxDatafileSize != nil {
+		options = append(options, WithMaxDatafileSize(*fc.MaxDatafileSize))
+	}
+	if fc.MaxKeySize != nil {
+		options = append(options, WithMaxKeySize(*fc.MaxKeySize))
+	}
+	if fc.MaxValueSize != nil {
+		options = append(options, WithMaxValueSize(*fc.MaxValueSize))
+	}
+	if fc.Sync != nil {
+		options = append(options, WithSyncWrites(*fc.Sync))
+	}
+	if fc.Compression != nil {
+		options = append(options, WithCompression(codecs[*fc.Compression]))
+	}
+	return options
+}
+
+// OptionsFromJSON parses a JSON configuration from the reader `r` and
+// returns the equivalent options suitable for passing to Open. Unknown
+// fields, invalid values and anything following the configuration are
+// reported as errors. For example:
+//
+//	{"max_datafile_size": 1048576, "max_key_size": 64, "max_value_size": 65536,
+//	 "sync": true, "compression": "gzip"}
+func OptionsFromJSON(r io.Reader) ([]Option, error) {
+	var fc fileConfig
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, errors.Wrap(err, "error parsing config")
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return nil, errors.New("error parsing config: unexpected data after the configuration")
+	}
+
+	if err := fc.validate(); err != nil {
+		return nil, err
+	}
+
+	return fc.options(), nil
+}
+
+// OptionsFromFile reads the JSON configuration file at the given path and
+// returns the equivalent options suitable for passing to Open.
+// See OptionsFromJSON for the format of the file.
+func OptionsFromFile(path string) ([]Option, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	options, err := OptionsFromJSON(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading config %s", path)
+	}
+	return options, nil
+}
@@ -0,0 +1,58 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// dir returns the directory of the database at `path`, which is the
+// subdirectory set by WithSubdir, if any
+func (cfg *config) dir(path string) string {
+	if cfg.subdir == "" {
+		return path
+	}
+	return filepath.Join(path, cfg.subdir)
+}
+
+// mkdirAll creates the database's directory `path`, if it doesn't exist,
+// with the permissions set by WithDirMode, if any.
+func (cfg *config) mkdirAll(path string) error {
+	if cfg.dirMode == 0 {
+		return os.MkdirAll(path, 0755)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(path, cfg.dirMode); err != nil {
+		return err
+	}
+	// The umask may have restricted the mode
+	return os.Chmod(path, cfg.dirMode)
+}
+
+// chmod sets the permissions of the file `fn` to those set by WithFileMode,
+// if any.
+func (cfg *config) chmod(fn string) error {
+	if cfg.fileMode == 0 {
+		return nil
+	}
+	return os.Chmod(fn, cfg.fileMode)
+}
+
+// openDatafile opens the datafile with the given id in the directory `path`
+// for writing, creating it if it doesn't exist, with the permissions set by
+// WithFileMode, if any.
+func (cfg *config) openDatafile(path string, id int) (*internal.Datafile, error) {
+	df, err := internal.NewDatafile(path, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.chmod(datafilePath(path, id)); err != nil {
+		df.Close()
+		return nil, err
+	}
+	return df, nil
+}
@@ -0,0 +1,105 @@
+package bitcask
+
+import (
+	"bytes"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// GetReader retrieves the value of the given key like Get but returns a
+// reader of it, which reads it lazily from its datafile, rather than reading
+// all of it into memory, which is meant for large values. The reader must be
+// closed when done with. The value is read as it was when GetReader was
+// called: neither writes of the key nor merges (which may remove the
+// datafile) affect an open reader. Its checksum is verified once all of the
+// value has been read, the final Read failing with ErrChecksumFailed rather
+// than io.EOF if it doesn't match. Compressed values (see WithCompression)
+// are read, and decompressed, in full. If the key is not found
+// ErrKeyNotFound is returned.
+func (b *Bitcask) GetReader(key string) (io.ReadCloser, error) {
+	if err := b.maybeRefresh(); err != nil {
+		return nil, err
+	}
+
+	if n, ok := b.counters.get(key); ok {
+		return ioutil.NopCloser(bytes.NewReader([]byte(strconv.FormatInt(n, 10)))), nil
+	}
+
+	defer b.observeCollisions()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if value, ok := b.getPending(key); ok {
+		value = append([]byte(nil), value...)
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+
+	item, ok := b.keydir.Get(key)
+	if !ok || item.Expired(time.Now()) {
+		return nil, ErrKeyNotFound
+	}
+
+	if item.Flags&FlagCompressed != 0 {
+		value, err := b.current(key)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+
+	df, ok := b.datafile(item.FileID)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	// The reader has its own handle of the datafile
+	k, n, r, err := df.OpenValue(item.Offset, item.Size)
+	if err != nil {
+		return nil, err
+	}
+	if k != key {
+		// The entry of another key, see read
+		r.Close()
+		value, err := b.current(key)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+
+	if b.keystats != nil {
+		b.keystats.Touch(key)
+	}
+
+	if b.config.noChecksum {
+		return r, nil
+	}
+	return &checksumReader{ReadCloser: r, hash: crc32.NewIEEE(), remaining: n, checksum: item.Checksum}, nil
+}
+
+// checksumReader verifies the checksum of the value read from its reader
+// once all of it has been read
+type checksumReader struct {
+	io.ReadCloser
+	hash      hash.Hash32
+	remaining int64
+	checksum  uint32
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining == 0 && r.hash.Sum32() != r.checksum {
+		return n, ErrChecksumFailed
+	}
+	if err == io.EOF && r.remaining > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
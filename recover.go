@@ -0,0 +1,88 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	pb "github.com/prologic/bitcask/internal/proto"
+)
+
+// errCorruptEntry is the error returned when reading an entry of the active
+// datafile that isn't an entry at all (e.g: part of a block of zeroes left
+// by a crash)
+var errCorruptEntry = errors.New("error: corrupt entry")
+
+// RecoveryError describes the corrupt tail of the active datafile, most
+// likely an entry that was being written when the process or machine
+// crashed, which Open truncated (see Bitcask.Recovered and
+// WithStrictRecovery).
+type RecoveryError struct {
+	// FileID is the id of the active datafile
+	FileID int
+
+	// Offset is the offset at which the corrupt tail started, and so the
+	// size of the active datafile after truncating it
+	Offset int64
+
+	// Truncated is the number of bytes truncated
+	Truncated int64
+
+	// Err is the error reading the corrupt tail
+	Err error
+}
+
+func (e *RecoveryError) Error() string {
+	return fmt.Sprintf("error: truncated %d corrupt bytes of datafile %d at offset %d: %v", e.Truncated, e.FileID, e.Offset, e.Err)
+}
+
+// Recovered returns the corrupt tail of the active datafile Open truncated,
+// if any, or nil. Only the entry being written when the database crashed
+// should have been lost; e.g: a Put that returned successfully with
+// WithSyncWrites enabled never is.
+func (b *Bitcask) Recovered() *RecoveryError {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.recovered
+}
+
+// verifyEntry checks that the entry `e` read from the active datafile is an
+// entry that was written by the database. Only what every entry is written
+// with, including those written by older versions, is checked; a block of
+// zeroes (e.g: left by a crash) decodes as an entry without a key.
+func verifyEntry(e pb.Entry) error {
+	if e.Key == "" {
+		return errCorruptEntry
+	}
+	return nil
+}
+
+// recoverable returns whether `err` reading the active datafile is due to
+// a corrupt (or partially written) entry rather than failing to read it.
+func recoverable(err error) bool {
+	if err == errCorruptEntry || truncated(err) {
+		return true
+	}
+	_, failed := errors.Cause(err).(*os.PathError)
+	return !failed
+}
+
+// truncateTail truncates the active datafile with the given id to `offset`
+// after failing to read it there with `err`
+func truncateTail(path string, id int, offset int64, err error) (*RecoveryError, error) {
+	fn := datafilePath(path, id)
+	stat, serr := os.Stat(fn)
+	if serr != nil {
+		return nil, serr
+	}
+	if terr := os.Truncate(fn, offset); terr != nil {
+		return nil, terr
+	}
+	return &RecoveryError{
+		FileID:    id,
+		Offset:    offset,
+		Truncated: stat.Size() - offset,
+		Err:       err,
+	}, nil
+}
@@ -0,0 +1,175 @@
+package bitcask
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// Refresh brings the index of a read-only database (see WithReadOnly) up to
+// date with the writes made by the writer since the database was opened or
+// last refreshed. Only the entries written since the last refresh are read,
+// unless the writer has merged or replaced datafiles in the meantime in
+// which case the whole index is rebuilt. Refresh does nothing for a database
+// opened for writing as its index is always up to date.
+func (b *Bitcask) Refresh() error {
+	if !b.config.readOnly {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.refresh()
+}
+
+// maybeRefresh refreshes the index of a read-only database if it is older
+// than the maximum staleness (see WithMaxStaleness).
+func (b *Bitcask) maybeRefresh() error {
+	if !b.config.readOnly || b.config.maxStaleness <= 0 {
+		return nil
+	}
+
+	b.mu.RLock()
+	stale := b.stale()
+	b.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Another reader may have refreshed the index in the meantime.
+	if !b.stale() {
+		return nil
+	}
+	return b.refresh()
+}
+
+func (b *Bitcask) stale() bool {
+	return time.Since(b.refreshed) > b.config.maxStaleness
+}
+
+// refresh indexes the entries appended to the active datafile since it was
+// last indexed and those of any newer datafiles; the caller must hold the
+// write lock.
+func (b *Bitcask) refresh() error {
+	if err := b.counters.load(); err != nil {
+		return err
+	}
+
+	fns, err := internal.GetDatafiles(b.path)
+	if err != nil {
+		return err
+	}
+
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+
+	var known, newer []int
+	for _, id := range ids {
+		if id > b.curr.FileID() {
+			newer = append(newer, id)
+		} else {
+			known = append(known, id)
+		}
+	}
+
+	// Datafiles we have indexed were removed by a merge.
+	if len(known) != len(b.datafiles)+1 {
+		return b.reload()
+	}
+	for _, id := range known {
+		if _, ok := b.datafile(id); !ok {
+			return b.reload()
+		}
+	}
+
+	stat, err := os.Stat(datafilePath(b.path, b.curr.FileID()))
+	if err != nil {
+		return err
+	}
+	fi, err := b.curr.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(stat, fi) || stat.Size() < b.tail {
+		return b.reload()
+	}
+
+	if stat.Size() > b.tail || len(newer) > 0 {
+		for _, id := range append([]int{b.curr.FileID()}, newer...) {
+			if err := b.refreshDatafile(id, id == ids[len(ids)-1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	b.refreshed = time.Now()
+
+	return nil
+}
+
+// refreshDatafile indexes the datafile with the given id from the offset
+// it was last indexed up to (if it is the active datafile) and makes it the
+// active datafile. A truncated trailing entry is only expected in the last
+// datafile where it may still be being written.
+func (b *Bitcask) refreshDatafile(id int, last bool) error {
+	df, err := internal.NewDatafile(b.path, id, true)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if id == b.curr.FileID() {
+		offset = b.tail
+		if err := df.SeekTo(offset); err != nil {
+			df.Close()
+			return err
+		}
+	}
+
+	n, err := index(df, b.keydir, b.trie, b.recent, false)
+	if err != nil && !(last && truncated(err)) {
+		df.Close()
+		return err
+	}
+
+	if id == b.curr.FileID() {
+		b.curr.Close()
+	} else {
+		b.addDatafile(b.curr)
+	}
+	b.curr = df
+	b.tail = offset + n
+
+	return nil
+}
+
+// reload rebuilds the index from scratch; the caller must hold the write
+// lock.
+func (b *Bitcask) reload() error {
+	curr, datafiles := b.curr, b.datafiles
+
+	if err := b.load(); err != nil {
+		return err
+	}
+
+	for _, df := range datafiles {
+		df.Close()
+	}
+	return curr.Close()
+}
+
+// truncated returns true if the error is the result of reading a partially
+// written entry.
+func truncated(err error) bool {
+	return errors.Cause(err) == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,211 @@
+package bitcask
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// ReplaceWith atomically replaces the entire contents of the database with
+// those of the (closed) database at `path`, typically one built in the
+// background with Open, Put and Close for a blue/green style refresh. The
+// datafiles of the other database are moved (or copied if they reside on a
+// different filesystem) into this database and the index reloaded while
+// holding the write lock, so concurrent readers see either the old or the
+// new dataset and never a mix of both. Should the process crash part way
+// Open completes the replacement. Should the replacement fail before it is
+// committed the datafiles are moved back to `path` and the database is left
+// as it was. A database at `path` that is open, even read-only, is refused
+// with ErrDatabaseLocked.
+func (b *Bitcask) ReplaceWith(path string) error {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+
+	lock := flock.New(filepath.Join(path, "lock"))
+	locked, err := lock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrDatabaseLocked
+	}
+	defer func() {
+		lock.Unlock()
+		os.Remove(lock.Path())
+	}()
+	readLock, err := lockReaders(path)
+	if err != nil {
+		return err
+	}
+	defer readLock.Unlock()
+
+	if err := recoverMerge(path); err != nil {
+		return err
+	}
+
+	src, err := internal.GetDatafiles(path)
+	if err != nil {
+		return err
+	}
+
+	b.merging.Lock()
+	defer b.merging.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.flushGroups(); err != nil {
+		return err
+	}
+
+	fns, err := internal.GetDatafiles(b.path)
+	if err != nil {
+		return err
+	}
+
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+
+	temp, err := beginMerge(b.path)
+	if err != nil {
+		return err
+	}
+
+	moved, err := moveFiles(src, temp)
+	if err != nil {
+		abortMerge(b.path)
+		return err
+	}
+
+	// The datafiles are kept open, and so readable, until the replacement
+	// is committed and moved into place
+	if err := commitMerge(b.path, ids); err != nil {
+		if state, _, serr := readMergeState(b.path); serr == nil && !state.Committed {
+			unmoveFiles(moved, temp)
+			abortMerge(b.path)
+		}
+		// Otherwise the replacement is completed by the next Open
+		return err
+	}
+
+	// The datafiles have been replaced
+	b.closeDatafiles()
+
+	return b.load()
+}
+
+// Swap atomically replaces the entire contents of the database with the
+// given key/value pairs. See ReplaceWith.
+func (b *Bitcask) Swap(data map[string][]byte) error {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+
+	temp, err := ioutil.TempDir(b.path, "swap")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(temp)
+
+	cfg := *b.config
+	cfg.fencing = false
+	cfg.tombstoneHistory = 0
+	cfg.groupCommit = false
+
+	db, err := Open(temp, withConfig(&cfg))
+	if err != nil {
+		return err
+	}
+
+	for key, value := range data {
+		if err := db.Put(key, value); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	return b.ReplaceWith(temp)
+}
+
+// closeDatafiles closes all open datafiles; the caller must hold the write
+// lock.
+func (b *Bitcask) closeDatafiles() error {
+	for _, df := range b.datafiles {
+		df.Close()
+	}
+	return b.curr.Close()
+}
+
+// moveFiles moves the files `fns` into the directory `dir` returning the
+// files moved. Should moving one of them fail those already moved are moved
+// back.
+func moveFiles(fns []string, dir string) ([]string, error) {
+	var moved []string
+	for _, fn := range fns {
+		if err := moveFile(fn, filepath.Join(dir, filepath.Base(fn))); err != nil {
+			unmoveFiles(moved, dir)
+			return nil, err
+		}
+		moved = append(moved, fn)
+	}
+	return moved, nil
+}
+
+// unmoveFiles moves the files `fns` moved by moveFiles into the directory
+// `dir` back to where they were.
+func unmoveFiles(fns []string, dir string) {
+	for _, fn := range fns {
+		moveFile(filepath.Join(dir, filepath.Base(fn)), fn)
+	}
+}
+
+// moveFile moves the file `src` to `dst` falling back to copying it if it
+// cannot be renamed (e.g: across filesystems).
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copies the file `src` to `dst` syncing the copy to disk
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,176 @@
+package bitcask
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prologic/bitcask/internal"
+)
+
+// ErrInconsistent is the error returned by SelfTest when the index of the
+// database is inconsistent with itself or with the datafiles
+var ErrInconsistent = errors.New("error: database is inconsistent")
+
+// SelfTest verifies the invariants of the index of the database: that Len
+// and the number of keys yielded by Keys are equal, as are the number of
+// keys in the keydir and prefix index, and that every key in the keydir
+// refers to a readable entry of the key with a valid checksum. It is meant
+// as a guard against bugs in the maintenance of the index (e.g: after
+// merges or deletes) and reads every live entry so can be slow for large
+// databases. The inconsistencies found, if any, are listed in the returned
+// error whose cause is ErrInconsistent.
+func (b *Bitcask) SelfTest() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// As Len and Keys, which skip the expired keys
+	now := time.Now()
+	var live int
+	for range b.keydir.LiveKeys(now) {
+		live++
+	}
+	if n := b.keydir.LiveLen(now); live != n {
+		fail("Keys yields %d keys but Len is %d", live, n)
+	}
+
+	keys := make(map[string]bool)
+	for key := range b.keydir.Keys() {
+		keys[key] = true
+	}
+
+	var n int
+	b.trie.Walk("", func(key string) bool {
+		n++
+		if !keys[key] {
+			fail("key %q is in the prefix index but not the keydir", key)
+		}
+		return true
+	})
+
+	if n != b.trie.Len() {
+		fail("the prefix index has %d keys but counts %d", n, b.trie.Len())
+	}
+	if n != b.keydir.Len() {
+		fail("the prefix index has %d keys but the keydir has %d", n, b.keydir.Len())
+	}
+
+	items := b.keydir.Snapshot()
+	sorted := make([]string, 0, len(items))
+	for key := range items {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		item := items[key]
+
+		df, ok := b.datafile(item.FileID)
+		if !ok {
+			fail("key %q refers to missing datafile %d", key, item.FileID)
+			continue
+		}
+
+		e, err := b.readAt(df, item.Offset, item.Size)
+		if err != nil {
+			fail("key %q refers to an unreadable entry at %d:%d: %s", key, item.FileID, item.Offset, err)
+			continue
+		}
+
+		switch {
+		case e.Key != key:
+			fail("key %q refers to the entry of key %q at %d:%d", key, e.Key, item.FileID, item.Offset)
+		case len(e.Value) == 0:
+			fail("key %q refers to a tombstone at %d:%d", key, item.FileID, item.Offset)
+		case crc32.ChecksumIEEE(e.Value) != e.Checksum:
+			fail("key %q refers to an entry with an invalid checksum at %d:%d", key, item.FileID, item.Offset)
+		case item.Checksum != e.Checksum:
+			fail("key %q has checksum %d in the keydir but %d on disk", key, item.Checksum, e.Checksum)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Wrapf(ErrInconsistent, "%d problems found: %s", len(problems), strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Verify reads every entry of every datafile, including those of
+// overwritten and deleted keys, and returns an error for the first entry
+// that is unreadable or whose value doesn't match its checksum (in which
+// case its cause is ErrChecksumFailed), or for a datafile whose hint file
+// is used by Open but doesn't match it (ErrHintMismatch). It is meant as a
+// periodic health check of the disk; unlike SelfTest it doesn't check the
+// index. The database's lock isn't held while reading so writes continue
+// meanwhile, though only the entries written before Verify was called are
+// verified, but merges of the open database wait for Verify to finish.
+func (b *Bitcask) Verify() error {
+	if err := b.maybeRefresh(); err != nil {
+		return err
+	}
+
+	b.merging.Lock()
+	defer b.merging.Unlock()
+
+	for _, stat := range b.DatafileStats() {
+		if err := verifyDatafile(b.path, stat.FileID, stat.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyDatafile verifies the entries of the first `size` bytes of the
+// datafile with the given id; a datafile removed since (e.g: by a merge) is
+// skipped.
+func verifyDatafile(path string, id int, size int64) error {
+	fn := datafilePath(path, id)
+	it, err := OpenDatafile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer it.Close()
+
+	// Open and merges only check the size and final entries of the
+	// datafile of a hint file before trusting it
+	if hint, err := internal.LoadHint(hintPath(path, id)); err == nil {
+		ok, err := hint.Matches(fn)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if ok, err = hint.Verify(fn); err != nil {
+				return err
+			} else if !ok {
+				return errors.Wrapf(ErrHintMismatch, "hint file of datafile %d", id)
+			}
+		}
+	}
+
+	for it.Offset() < size && it.Next() {
+		e := it.Entry()
+		if !e.Valid {
+			return errors.Wrapf(ErrChecksumFailed, "entry of key %q at %d:%d", e.Key, id, e.Offset)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if it.Offset() < size {
+		return errors.Errorf("error: unreadable entry at %d:%d", id, it.Offset())
+	}
+	return nil
+}
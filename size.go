@@ -0,0 +1,87 @@
+package bitcask
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// Size returns the size in bytes of the value of the given key without
+// reading it, e.g: to decide whether to read it with Get or GetReader. For
+// compressed values (see WithCompression) it is the size of the value as
+// returned by Get, which is recorded when it is written. If the key is not
+// found ErrKeyNotFound is returned.
+func (b *Bitcask) Size(key string) (int64, error) {
+	if err := b.maybeRefresh(); err != nil {
+		return 0, err
+	}
+
+	if n, ok := b.counters.get(key); ok {
+		return int64(len(strconv.FormatInt(n, 10))), nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if value, ok := b.getPending(key); ok {
+		return int64(len(value)), nil
+	}
+
+	item, err := b.item(key)
+	if err != nil {
+		return 0, err
+	}
+	return item.ValueSize, nil
+}
+
+// ModTime returns the time the value of the given key was written without
+// reading it. If the key is not found ErrKeyNotFound is returned and for
+// keys of the counter region (see WithCounterRegion), whose writes aren't
+// timestamped, ErrCounterKey.
+func (b *Bitcask) ModTime(key string) (time.Time, error) {
+	if err := b.maybeRefresh(); err != nil {
+		return time.Time{}, err
+	}
+
+	if b.counters.has(key) {
+		return time.Time{}, ErrCounterKey
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if t, ok := b.pendingTime(key); ok {
+		// The entry is timestamped with the time of the write when its
+		// group is written out
+		return time.Unix(0, t), nil
+	}
+
+	item, err := b.item(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, item.Timestamp), nil
+}
+
+// item returns the keydir item of the given key with its value size and
+// timestamp; the caller must hold the read lock.
+func (b *Bitcask) item(key string) (internal.Item, error) {
+	item, ok := b.keydir.Get(key)
+	if !ok || item.Expired(time.Now()) {
+		return internal.Item{}, ErrKeyNotFound
+	}
+	if item.Timestamp != 0 {
+		return item, nil
+	}
+
+	// Items loaded from older hint files don't record them so the entry
+	// must be read
+	e, _, err := b.read(key)
+	if err != nil {
+		return internal.Item{}, err
+	}
+	item.ValueSize = internal.ValueSize(e)
+	item.Timestamp = e.Timestamp
+	return item, nil
+}
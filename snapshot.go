@@ -0,0 +1,286 @@
+package bitcask
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	pb "github.com/prologic/bitcask/internal/proto"
+)
+
+// snapshot is a point in time snapshot of (some of) the keys of the
+// database and their values, as used by Backup and Iterator
+type snapshot struct {
+	// keys are the keys of the snapshot in lexicographic order
+	keys []string
+
+	// items are the keydir items of the keys stored in the datafiles
+	items map[string]internal.Item
+
+	// values are the values of the keys held in memory (pending grouped
+	// writes and counters)
+	values map[string][]byte
+
+	// deleted are the sequence numbers of the deletions of the deleted
+	// keys of the snapshot, if any (see ExportSince)
+	deleted map[string]uint64
+
+	// datafiles are the datafiles the items refer to, opened separately
+	// from those of the database so they remain readable if removed
+	datafiles map[int]*internal.Datafile
+
+	// dir is the directory of the hard links to the immutable datafiles
+	// the items refer to (see linked), if any
+	dir string
+
+	// linked are the ids of the immutable datafiles the items refer to of
+	// databases opened with WithEagerCloseDatafiles (or WithMaxOpenFiles),
+	// which aren't held open but pinned by hard links in `dir` so they
+	// remain readable if removed, and are opened (or read through the
+	// cache of open handles) as they are read, as by Get
+	linked map[int]bool
+
+	// handles is the cache of open handles of the database, if any
+	handles *handleCache
+
+	// path is the path of the database
+	path string
+
+	// config is the configuration of the database, e.g: to decompress
+	// the values (see WithCompression)
+	config *config
+}
+
+// snapshotDirPrefix is the prefix of the directories of the hard links to
+// the datafiles pinned by snapshots, which are left behind by a crash and
+// removed by the next Open
+const snapshotDirPrefix = "snapshot-"
+
+// newSnapshot returns an empty snapshot of the database, which must be
+// closed
+func (b *Bitcask) newSnapshot() *snapshot {
+	return &snapshot{
+		items:     make(map[string]internal.Item),
+		values:    make(map[string][]byte),
+		datafiles: make(map[int]*internal.Datafile),
+		linked:    make(map[int]bool),
+		handles:   b.handles,
+		path:      b.path,
+		config:    b.config,
+	}
+}
+
+// snapshot takes a snapshot of the keys with the given prefix, which
+// must be closed
+func (b *Bitcask) snapshot(prefix string) (*snapshot, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	s := b.newSnapshot()
+
+	for key := range b.pending {
+		if strings.HasPrefix(key, prefix) {
+			value, _ := b.getPending(key)
+			s.values[key] = value
+		}
+	}
+	for _, key := range b.counters.list() {
+		if strings.HasPrefix(key, prefix) {
+			n, _ := b.counters.get(key)
+			s.values[key] = []byte(strconv.FormatInt(n, 10))
+		}
+	}
+
+	now := time.Now()
+	for _, key := range b.trie.PrefixSearch(prefix) {
+		if _, ok := s.values[key]; ok {
+			continue
+		}
+		item, ok := b.keydir.Get(key)
+		if !ok || item.Expired(now) {
+			continue
+		}
+		if err := s.add(b, key, item); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+
+	for key := range s.values {
+		s.keys = append(s.keys, key)
+	}
+	if len(s.values) > 0 {
+		sort.Strings(s.keys)
+	}
+
+	return s, nil
+}
+
+// add adds the key stored in the datafiles of the database `b` as `item`
+// to the snapshot; the caller must hold the read lock.
+func (s *snapshot) add(b *Bitcask, key string, item internal.Item) error {
+	s.keys = append(s.keys, key)
+	s.items[key] = item
+
+	if _, ok := s.datafiles[item.FileID]; ok {
+		return nil
+	}
+	if s.linked[item.FileID] {
+		return nil
+	}
+
+	_, immutable := b.datafiles[item.FileID]
+	if immutable && b.config.eagerCloseDatafiles && !b.config.readOnly {
+		if err := s.link(item.FileID); err == nil {
+			return nil
+		}
+		// Otherwise (e.g: the filesystem doesn't support hard links)
+		// the datafile is held open instead
+	}
+
+	df, err := internal.NewDatafile(s.path, item.FileID, true)
+	if err != nil {
+		return err
+	}
+	s.datafiles[item.FileID] = df
+	return nil
+}
+
+// link pins the datafile with the given id by a hard link to it
+func (s *snapshot) link(id int) error {
+	if s.dir == "" {
+		dir, err := ioutil.TempDir(s.path, snapshotDirPrefix)
+		if err != nil {
+			return err
+		}
+		s.dir = dir
+	}
+
+	if err := os.Link(datafilePath(s.path, id), datafilePath(s.dir, id)); err != nil {
+		return err
+	}
+	s.linked[id] = true
+	return nil
+}
+
+// readAt reads the entry of the item as of the snapshot
+func (s *snapshot) readAt(item internal.Item) (pb.Entry, error) {
+	if df, ok := s.datafiles[item.FileID]; ok {
+		return df.ReadAt(item.Offset, item.Size)
+	}
+
+	open := func() (*internal.Datafile, error) {
+		return internal.NewDatafile(s.dir, item.FileID, true)
+	}
+	if s.handles != nil {
+		df, release, err := s.handles.get(datafilePath(s.dir, item.FileID), open)
+		if err != nil {
+			return pb.Entry{}, err
+		}
+		defer release()
+
+		return df.ReadAt(item.Offset, item.Size)
+	}
+
+	df, err := open()
+	if err != nil {
+		return pb.Entry{}, err
+	}
+	defer df.Close()
+
+	return df.ReadAt(item.Offset, item.Size)
+}
+
+// entry returns the entry of the key as of the snapshot
+func (s *snapshot) entry(key string) (pb.Entry, error) {
+	if value, ok := s.values[key]; ok {
+		return internal.NewEntry(key, append([]byte(nil), value...)), nil
+	}
+	if seq, ok := s.deleted[key]; ok {
+		e := internal.NewEntry(key, []byte{})
+		e.Flags = uint32(FlagTombstone)
+		e.Sequence = seq
+		return e, nil
+	}
+
+	item, ok := s.items[key]
+	if !ok {
+		return pb.Entry{}, ErrKeyNotFound
+	}
+
+	e, err := s.readAt(item)
+	if err != nil {
+		return pb.Entry{}, err
+	}
+	if e.Key != key {
+		return pb.Entry{}, ErrKeyNotFound
+	}
+	if !s.config.noChecksum && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+		return pb.Entry{}, ErrChecksumFailed
+	}
+	return e, nil
+}
+
+// checksum returns the checksum of the value of the key as of the snapshot
+// reading (and decompressing) it only if it is stored compressed
+func (s *snapshot) checksum(key string) (uint32, error) {
+	if value, ok := s.values[key]; ok {
+		return crc32.ChecksumIEEE(value), nil
+	}
+
+	item, ok := s.items[key]
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	if item.Flags&FlagCompressed == 0 {
+		return item.Checksum, nil
+	}
+
+	e, err := s.entry(key)
+	if err != nil {
+		return 0, err
+	}
+	value, err := s.config.value(e)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(value), nil
+}
+
+func (s *snapshot) close() {
+	for _, df := range s.datafiles {
+		df.Close()
+	}
+
+	if s.dir == "" {
+		return
+	}
+	if s.handles != nil {
+		for id := range s.linked {
+			s.handles.drop(datafilePath(s.dir, id))
+		}
+	}
+	os.RemoveAll(s.dir)
+}
+
+// removeSnapshots removes the hard links to the datafiles pinned by the
+// snapshots of the database at `path` left behind by a crash; the caller
+// must hold the database's lock.
+func removeSnapshots(path string) error {
+	dirs, err := filepath.Glob(filepath.Join(path, snapshotDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
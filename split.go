@@ -0,0 +1,308 @@
+package bitcask
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/prologic/bitcask/internal"
+	pb "github.com/prologic/bitcask/internal/proto"
+)
+
+var (
+	// ErrDatafileNotFound is the error returned for a datafile id that
+	// doesn't exist in the database
+	ErrDatafileNotFound = errors.New("error: datafile not found")
+
+	// ErrActiveDatafile is the error returned when trying to rewrite the
+	// active datafile which is still being written to
+	ErrActiveDatafile = errors.New("error: datafile is active")
+)
+
+// DatafileStat describes a datafile of the database.
+type DatafileStat struct {
+	FileID int
+	Size   int64
+	Active bool
+}
+
+// DatafileStats returns the ids and sizes of the datafiles of the database
+// in the order they were written, the last being the active datafile.
+// Datafiles larger than the maximum datafile size (e.g: created before
+// WithMaxDatafileSize was lowered) can be split with SplitDatafile.
+func (b *Bitcask) DatafileStats() []DatafileStat {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := make([]DatafileStat, 0, len(b.datafiles)+1)
+	for id, df := range b.datafiles {
+		stats = append(stats, DatafileStat{FileID: id, Size: df.Size()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].FileID < stats[j].FileID })
+
+	return append(stats, DatafileStat{
+		FileID: b.curr.FileID(),
+		Size:   b.curr.Size(),
+		Active: true,
+	})
+}
+
+// SplitDatafile rewrites the (immutable) datafile with the given id into as
+// many new datafiles as needed to respect the maximum datafile size, which
+// is much cheaper than a merge of the whole database (see Merge and
+// WithEnforceDatafileSizeOnOpen) if only a few datafiles are oversized.
+// Overwritten and deleted keys are dropped in the process. The new
+// datafiles are written after the active datafile which is rotated so that
+// subsequent writes are written after them. Datafiles within the limit are
+// left as they are and the active datafile cannot be split.
+func (b *Bitcask) SplitDatafile(fileID int) (err error) {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+
+	b.merging.Lock()
+	defer b.merging.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if fileID == b.curr.FileID() {
+		return ErrActiveDatafile
+	}
+	df, ok := b.datafiles[fileID]
+	if !ok {
+		return ErrDatafileNotFound
+	}
+	if df.Size() <= int64(b.config.maxDatafileSize) {
+		return nil
+	}
+
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return err
+		}
+	}
+
+	// Tombstones must be kept as they may delete keys in older datafiles,
+	// unless there are no older datafiles.
+	var oldest = true
+	for id := range b.datafiles {
+		if id < fileID {
+			oldest = false
+		}
+	}
+
+	src, err := internal.NewDatafile(b.path, fileID, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	temp, err := beginMerge(b.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			discardMerge(b.path)
+		}
+	}()
+
+	var (
+		id    = b.curr.FileID() + 1
+		ids   = []int{id}
+		keys  []string
+		items []internal.Item
+	)
+
+	curr, err := b.config.openDatafile(temp, id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		curr.Close()
+	}()
+
+	for {
+		var e pb.Entry
+		e, _, err = src.Read()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return err
+		}
+
+		item, live := b.keydir.Get(e.Key)
+		if len(e.Value) == 0 {
+			if live || oldest {
+				continue
+			}
+		} else if !live || item.FileID != fileID || item.Offset != e.Offset {
+			continue
+		}
+
+		size := curr.Size()
+		if size > 0 && size+curr.EncodedSize(e) > int64(b.config.maxDatafileSize) {
+			if err = curr.Close(); err != nil {
+				return err
+			}
+			id++
+			ids = append(ids, id)
+			curr, err = b.config.openDatafile(temp, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		offset, n, err := curr.Write(copied(e))
+		if err != nil {
+			return err
+		}
+		e.Offset = offset
+
+		if len(e.Value) > 0 {
+			keys = append(keys, e.Key)
+			items = append(items, internal.NewItem(id, e, n))
+		}
+	}
+
+	if err = curr.Close(); err != nil {
+		return err
+	}
+
+	if err = commitMerge(b.path, []int{fileID}); err != nil {
+		return err
+	}
+
+	// The merge is committed and the new datafiles in place; from here on
+	// errors no longer discard them.
+	return b.splitDatafile(fileID, ids, keys, items)
+}
+
+// splitDatafile replaces the split datafile with the new datafiles with the
+// given ids and rotates the active datafile to follow them; the caller must
+// hold the write lock.
+func (b *Bitcask) splitDatafile(fileID int, ids []int, keys []string, items []internal.Item) error {
+	for _, id := range ids {
+		df, err := internal.NewDatafile(b.path, id, true)
+		if err != nil {
+			return err
+		}
+		b.addDatafile(df)
+	}
+
+	for i, key := range keys {
+		b.keydir.Add(key, items[i])
+	}
+
+	b.datafiles[fileID].Close()
+	delete(b.datafiles, fileID)
+
+	if err := b.curr.Close(); err != nil {
+		return err
+	}
+
+	df, err := internal.NewDatafile(b.path, b.curr.FileID(), true)
+	if err != nil {
+		return err
+	}
+	b.addDatafile(df)
+
+	curr, err := b.config.openDatafile(b.path, ids[len(ids)-1]+1)
+	if err != nil {
+		return err
+	}
+	b.config.injectWrites(curr, FaultWrite)
+	b.curr = curr
+
+	return nil
+}
+
+// CompactDatafile reclaims the space of the overwritten and deleted keys of
+// the (immutable) datafile with the given id without touching the other
+// datafiles, as a cheaper, incremental alternative to a merge of the whole
+// database. The live entries of the datafile (and the tombstones of keys
+// that may still exist in older datafiles) are copied to the active
+// datafile, which is synced, and the datafile and its hint file are then
+// removed. The active datafile cannot be compacted.
+func (b *Bitcask) CompactDatafile(fileID int) error {
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+
+	b.merging.Lock()
+	defer b.merging.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if fileID == b.curr.FileID() {
+		return ErrActiveDatafile
+	}
+	df, ok := b.datafiles[fileID]
+	if !ok {
+		return ErrDatafileNotFound
+	}
+
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return err
+		}
+	}
+
+	var oldest = true
+	for id := range b.datafiles {
+		if id < fileID {
+			oldest = false
+		}
+	}
+
+	src, err := internal.NewDatafile(b.path, fileID, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	for {
+		e, _, err := src.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		item, live := b.keydir.Get(e.Key)
+		if len(e.Value) == 0 {
+			if live || oldest {
+				continue
+			}
+		} else if !live || item.FileID != fileID || item.Offset != e.Offset {
+			continue
+		}
+
+		item, err = b.write(copied(e))
+		if err != nil {
+			return err
+		}
+		if len(e.Value) > 0 {
+			b.keydir.Add(e.Key, item)
+		}
+	}
+
+	// The copies must be on disk before the datafile is removed
+	if err := b.curr.Sync(); err != nil {
+		return err
+	}
+
+	df.Close()
+	delete(b.datafiles, fileID)
+
+	if err := os.Remove(hintPath(b.path, fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(datafilePath(b.path, fileID))
+}
@@ -0,0 +1,73 @@
+package bitcask
+
+// Stats describes the state of the database as returned by Stats.
+type Stats struct {
+	// Keys is the number of keys in the database (see Len)
+	Keys int
+
+	// Datafiles is the number of datafiles, including the active datafile
+	Datafiles int
+
+	// Size is the total size of the datafiles in bytes
+	Size int64
+
+	// Reclaimable is the number of bytes of the datafiles taken up by
+	// overwritten values and deleted keys which a merge would reclaim
+	Reclaimable int64
+
+	// ActiveSize is the size of the active datafile in bytes
+	ActiveSize int64
+}
+
+// Stats returns statistics about the database, e.g: to decide when to merge
+// it based on the number of reclaimable bytes. The statistics are kept up
+// to date as keys are written and deleted so are cheap to get. Tombstones
+// of deleted keys count as reclaimable although a merge keeps those that
+// may still delete keys in older datafiles.
+func (b *Bitcask) Stats() (Stats, error) {
+	if err := b.maybeRefresh(); err != nil {
+		return Stats{}, err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := Stats{
+		Keys:       b.keydir.Len(),
+		Datafiles:  len(b.datafiles) + 1,
+		ActiveSize: b.curr.Size(),
+	}
+	stats.Size = stats.ActiveSize
+	for _, df := range b.datafiles {
+		stats.Size += df.Size()
+	}
+	stats.Reclaimable = stats.Size - b.keydir.Size()
+
+	return stats, nil
+}
+
+// PrefixStats returns the number of keys with the given prefix and the
+// number of bytes of the datafiles taken up by their current values (as
+// with Stats and Len, expired keys are counted until they are removed by a
+// merge). It only walks the index and doesn't read the values. The empty
+// prefix returns the totals for the whole database: the keys match Len and
+// the bytes Stats' Size less the Reclaimable bytes (without WithMaxVersions
+// as older versions aren't counted).
+func (b *Bitcask) PrefixStats(prefix string) (keys int, bytes int64, err error) {
+	if err := b.maybeRefresh(); err != nil {
+		return 0, 0, err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	b.trie.Walk(prefix, func(key string) bool {
+		if item, ok := b.keydir.Get(key); ok {
+			keys++
+			bytes += item.Size
+		}
+		return true
+	})
+
+	return keys, bytes, nil
+}
@@ -0,0 +1,159 @@
+package bitcask
+
+import (
+	"strings"
+	"sync"
+)
+
+// subscriberBuffer is the number of events buffered for each subscriber;
+// events for a subscriber whose buffer is full are dropped.
+const subscriberBuffer = 64
+
+// EventType is the type of change to a key reported by an Event
+type EventType int
+
+const (
+	// EventPut is the event type of a key being written
+	EventPut EventType = iota + 1
+
+	// EventDelete is the event type of a key being deleted
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a change to a key delivered to subscribers (see SubscribeKey,
+// SubscribePrefix and Watch). The Value is the new value of the key for
+// EventPut and nil for EventDelete.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte
+
+	// Missed is the number of events that were dropped for the subscriber
+	// since the previous event it was delivered because it fell behind
+	Missed int
+}
+
+type subscriber struct {
+	key    string
+	prefix bool
+	ch     chan Event
+	missed int
+}
+
+func (s *subscriber) matches(key string) bool {
+	if s.prefix {
+		return strings.HasPrefix(key, s.key)
+	}
+	return key == s.key
+}
+
+type subscribers struct {
+	sync.Mutex
+	subs map[<-chan Event]*subscriber
+}
+
+// SubscribeKey returns a channel on which an Event is delivered every time
+// the given key is written or deleted. Events are delivered once the change
+// is visible to readers, in the order the changes were made. Events are
+// buffered but never block writers: if the subscriber falls behind by more
+// than a small number of events further events are dropped until it catches
+// up, the next event delivered recording how many were dropped (see
+// Event.Missed). Replacing the whole database (see ReplaceWith) delivers
+// no events.
+//
+// Call Unsubscribe with the channel to stop the delivery and release it; the
+// channels of all subscribers are closed when the database is closed.
+func (b *Bitcask) SubscribeKey(key string) <-chan Event {
+	return b.subscribe(&subscriber{key: key})
+}
+
+// SubscribePrefix is like SubscribeKey but delivers events for all keys
+// with the given prefix.
+func (b *Bitcask) SubscribePrefix(prefix string) <-chan Event {
+	return b.subscribe(&subscriber{key: prefix, prefix: true})
+}
+
+// Watch is like SubscribePrefix with the empty prefix, delivering events for
+// all keys, but returns the function unsubscribing the channel (and closing
+// it) rather than requiring Unsubscribe to be called. The function may be
+// called more than once and after the database is closed.
+func (b *Bitcask) Watch() (<-chan Event, func()) {
+	ch := b.SubscribePrefix("")
+	return ch, func() { b.Unsubscribe(ch) }
+}
+
+// Unsubscribe stops the delivery of events to a channel returned by
+// SubscribeKey, SubscribePrefix or Watch and closes it.
+func (b *Bitcask) Unsubscribe(ch <-chan Event) {
+	b.subscribers.Lock()
+	defer b.subscribers.Unlock()
+
+	if s, ok := b.subscribers.subs[ch]; ok {
+		delete(b.subscribers.subs, ch)
+		close(s.ch)
+	}
+}
+
+func (b *Bitcask) subscribe(s *subscriber) <-chan Event {
+	b.subscribers.Lock()
+	defer b.subscribers.Unlock()
+
+	s.ch = make(chan Event, subscriberBuffer)
+	if b.subscribers.subs == nil {
+		b.subscribers.subs = make(map[<-chan Event]*subscriber)
+	}
+	b.subscribers.subs[s.ch] = s
+
+	return s.ch
+}
+
+// unsubscribeAll closes the channels of all subscribers.
+func (b *Bitcask) unsubscribeAll() {
+	b.subscribers.Lock()
+	defer b.subscribers.Unlock()
+
+	for ch, s := range b.subscribers.subs {
+		delete(b.subscribers.subs, ch)
+		close(s.ch)
+	}
+}
+
+// notify delivers the event to the matching subscribers without blocking.
+func (b *Bitcask) notify(t EventType, key string, value []byte) {
+	b.subscribers.Lock()
+	defer b.subscribers.Unlock()
+
+	if len(b.subscribers.subs) == 0 {
+		return
+	}
+
+	e := Event{Type: t, Key: key}
+	if value != nil {
+		// The caller may reuse the value once the write returns.
+		e.Value = append([]byte(nil), value...)
+	}
+
+	for _, s := range b.subscribers.subs {
+		if !s.matches(key) {
+			continue
+		}
+		e.Missed = s.missed
+		select {
+		case s.ch <- e:
+			s.missed = 0
+		default:
+			s.missed++
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package bitcask
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+const tombstonesFilename = "tombstones.json"
+
+// DeletedKey is a recently deleted key as returned by RecentDeletes
+type DeletedKey struct {
+	// Key is the deleted key
+	Key string
+
+	// Value is the last value of the key before it was deleted or nil if
+	// it is no longer on disk
+	Value []byte
+
+	// Time is the time the key was deleted
+	Time time.Time
+}
+
+// tombstone records a deleted key and the location of its last value
+type tombstone struct {
+	Key  string        `json:"key"`
+	Item internal.Item `json:"item"`
+	Time time.Time     `json:"time"`
+}
+
+// RecentDeletes returns the most recently deleted keys, newest first, as
+// configured with WithTombstoneHistory together with their last value if it
+// is still on disk. Values are only guaranteed to be available until the
+// next merge which removes them from disk; the deleted keys themselves are
+// retained (across reopens) until they are pushed out by newer deletes.
+// Without WithTombstoneHistory no keys are returned.
+func (b *Bitcask) RecentDeletes() []DeletedKey {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	deletes := make([]DeletedKey, 0, len(b.tombstones))
+	for i := len(b.tombstones) - 1; i >= 0; i-- {
+		t := b.tombstones[i]
+		deletes = append(deletes, DeletedKey{
+			Key:   t.Key,
+			Value: b.readTombstone(t),
+			Time:  t.Time,
+		})
+	}
+	return deletes
+}
+
+// readTombstone returns the last value of a deleted key if it is still on
+// disk; the caller must hold the read lock.
+func (b *Bitcask) readTombstone(t tombstone) []byte {
+	df, ok := b.datafile(t.Item.FileID)
+	if !ok {
+		return nil
+	}
+
+	// The datafile may have since been rewritten by a merge
+	e, err := b.readAt(df, t.Item.Offset, t.Item.Size)
+	if err != nil || e.Key != t.Key || crc32.ChecksumIEEE(e.Value) != e.Checksum {
+		return nil
+	}
+	value, err := b.config.value(e)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// addTombstone records the deletion of the key whose last value is at
+// `item`; the caller must hold the write lock.
+func (b *Bitcask) addTombstone(key string, item internal.Item) {
+	b.tombstones = append(b.tombstones, tombstone{
+		Key:  key,
+		Item: item,
+		Time: time.Now(),
+	})
+	if n := len(b.tombstones) - b.config.tombstoneHistory; n > 0 {
+		b.tombstones = b.tombstones[n:]
+	}
+}
+
+func loadTombstones(path string) ([]tombstone, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, tombstonesFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var tombstones []tombstone
+	if err := json.Unmarshal(data, &tombstones); err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+func saveTombstones(path string, tombstones []tombstone) error {
+	data, err := json.Marshal(tombstones)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, tombstonesFilename), data, 0644)
+}
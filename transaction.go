@@ -0,0 +1,226 @@
+package bitcask
+
+import (
+	"errors"
+
+	"github.com/prologic/bitcask/internal"
+	pb "github.com/prologic/bitcask/internal/proto"
+)
+
+// ErrTransactionClosed is the error returned when using a transaction that
+// has already been committed or rolled back
+var ErrTransactionClosed = errors.New("error: transaction closed")
+
+// errIncompleteTransaction is the error returned when reading the active
+// datafile that ends with the entries of a transaction whose last entry was
+// never written (e.g: because of a crash during Commit)
+var errIncompleteTransaction = errors.New("error: incomplete transaction")
+
+// flagTransaction is set on every entry of a transaction but the last so
+// that the entries read before the last one are known to be incomplete. It
+// is above the flags kept in the index and is cleared from entries copied
+// elsewhere (see copied).
+const flagTransaction uint32 = 1 << 8
+
+// copied returns the entry `e` read from a datafile to be written again on
+// its own (e.g: by a merge) rather than as part of its transaction, if any.
+func copied(e pb.Entry) pb.Entry {
+	e.Flags &^= flagTransaction
+	return e
+}
+
+// Transaction buffers puts and deletes of several keys to be written
+// together by Commit (see Bitcask.Transaction). A transaction is not safe
+// for concurrent use.
+type Transaction struct {
+	db     *Bitcask
+	keys   []string
+	values map[string][]byte // nil for deletes
+	closed bool
+}
+
+// Transaction starts a transaction: its puts and deletes are buffered
+// (invisible to the database, including Get and Has) until Commit writes
+// them as a contiguous run to the active datafile, syncs it and only then
+// updates the index, so that either all or none of them are visible.
+// Nothing is written until Commit, so a process that crashes before then
+// leaves the database as it was before the transaction started. Writes made
+// by others in the meantime are not isolated; the transaction's writes to
+// the same keys simply win when it commits.
+func (b *Bitcask) Transaction() *Transaction {
+	return &Transaction{
+		db:     b,
+		values: make(map[string][]byte),
+	}
+}
+
+// Put stores the key and value as part of the transaction
+func (tx *Transaction) Put(key string, value []byte) error {
+	if tx.closed {
+		return ErrTransactionClosed
+	}
+	if err := tx.db.checkPut(key, value); err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+
+	tx.set(key, value)
+	return nil
+}
+
+// Delete deletes the key as part of the transaction
+func (tx *Transaction) Delete(key string) error {
+	if tx.closed {
+		return ErrTransactionClosed
+	}
+	if tx.db.counters.has(key) {
+		return ErrCounterKey
+	}
+
+	tx.set(key, nil)
+	return nil
+}
+
+func (tx *Transaction) set(key string, value []byte) {
+	if _, ok := tx.values[key]; !ok {
+		tx.keys = append(tx.keys, key)
+	}
+	tx.values[key] = value
+}
+
+// Rollback discards the puts and deletes of the transaction
+func (tx *Transaction) Rollback() error {
+	if tx.closed {
+		return ErrTransactionClosed
+	}
+	tx.closed = true
+	tx.keys = nil
+	tx.values = nil
+	return nil
+}
+
+// Commit writes the puts and deletes of the transaction to the database.
+// The index (and so what Get, Has, etc return) is only updated once they
+// have all been written and synced to disk. Every entry but the last is
+// marked as part of the transaction so that a crash in the middle of the
+// writes, which leaves only some of them on disk, is detected when the
+// database is next opened and the writes of the transaction discarded (see
+// Bitcask.Recovered). The transaction is closed whether or not the commit
+// succeeds.
+func (tx *Transaction) Commit() error {
+	if tx.closed {
+		return ErrTransactionClosed
+	}
+	tx.closed = true
+
+	b := tx.db
+	if b.config.readOnly {
+		return ErrReadOnly
+	}
+	if len(tx.keys) == 0 {
+		return nil
+	}
+
+	puts, err := tx.commit()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < puts; i++ {
+		b.config.metrics.IncPut()
+	}
+	if puts < len(tx.keys) {
+		b.deleted()
+	}
+	return nil
+}
+
+// commit writes the transaction and returns the number of puts written
+func (tx *Transaction) commit() (int, error) {
+	b := tx.db
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.fencing {
+		if err := b.checkFence(); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, key := range tx.keys {
+		if err := b.flushPending(key); err != nil {
+			return 0, err
+		}
+	}
+
+	var size int64
+	entries := make([]pb.Entry, len(tx.keys))
+	for i, key := range tx.keys {
+		if value := tx.values[key]; value != nil {
+			entries[i] = b.entry(key, value)
+		} else {
+			entries[i] = b.entry(key, []byte{})
+			entries[i].Flags = uint32(FlagTombstone)
+		}
+		if i < len(tx.keys)-1 {
+			entries[i].Flags |= flagTransaction
+		}
+		if err := b.checkEntrySize(entries[i]); err != nil {
+			return 0, err
+		}
+		size += b.curr.EncodedSize(entries[i])
+	}
+
+	if err := b.maybeRotate(size); err != nil {
+		return 0, err
+	}
+
+	// The run of entries fits into the active datafile and so isn't split
+	// by a rotation. Should writing it fail what was written is discarded
+	// so that it isn't completed by the entries written next.
+	start := b.curr.Size()
+	items := make([]internal.Item, len(entries))
+	for i, e := range entries {
+		item, err := b.write(e)
+		if err != nil {
+			b.curr.Truncate(start)
+			return 0, err
+		}
+		items[i] = item
+	}
+
+	if err := b.curr.Sync(); err != nil {
+		b.curr.Truncate(start)
+		return 0, err
+	}
+
+	var puts int
+	for i, key := range tx.keys {
+		value := tx.values[key]
+		if value == nil {
+			if b.config.tombstoneHistory > 0 {
+				if item, ok := b.keydir.Get(key); ok {
+					b.addTombstone(key, item)
+				}
+			}
+			b.keydir.Remove(key, items[i].Sequence)
+			b.trie.Remove(key)
+			b.recent.Remove(key)
+			b.notify(EventDelete, key, nil)
+			continue
+		}
+
+		b.keydir.Overwrite(key, items[i])
+		b.trie.Add(key)
+		b.recent.Add(key)
+		if b.keystats != nil {
+			b.keystats.Touch(key)
+		}
+		b.notify(EventPut, key, value)
+		puts++
+	}
+
+	return puts, nil
+}
@@ -0,0 +1,80 @@
+package bitcask
+
+import (
+	"hash/crc32"
+	"strconv"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// GetVersions returns up to the maximum number of versions configured with
+// WithMaxVersions of the values of the given key, newest first, the first
+// being the current value as returned by Get. Older versions that are no
+// longer on disk (e.g: because their datafile was rewritten by
+// CompactDatafile) are skipped. The values are copies owned by the caller.
+// If the key is not found ErrKeyNotFound is returned.
+func (b *Bitcask) GetVersions(key string) ([][]byte, error) {
+	if err := b.maybeRefresh(); err != nil {
+		return nil, err
+	}
+
+	if n, ok := b.counters.get(key); ok {
+		return [][]byte{[]byte(strconv.FormatInt(n, 10))}, nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, item, err := b.read(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := b.config.value(e)
+	if err != nil {
+		return nil, err
+	}
+	values := [][]byte{value}
+
+	versions := b.keydir.Versions(key)
+	if item == (internal.Item{}) {
+		// A pending grouped write is yet to overwrite the current item
+		if item, ok := b.keydir.Get(key); ok {
+			versions = append(versions, item)
+		}
+	}
+
+	for i := len(versions) - 1; i >= 0 && len(values) < b.config.maxVersions; i-- {
+		if item != (internal.Item{}) && versions[i].Sequence >= item.Sequence {
+			// The current value was read from an older version (see read)
+			continue
+		}
+		if value, ok := b.readVersion(key, versions[i]); ok {
+			values = append(values, value)
+		}
+	}
+
+	return values, nil
+}
+
+// readVersion reads the older version of the key at `item` if it is still
+// on disk; the caller must hold the read lock.
+func (b *Bitcask) readVersion(key string, item internal.Item) ([]byte, bool) {
+	df, ok := b.datafile(item.FileID)
+	if !ok {
+		return nil, false
+	}
+
+	// The datafile may have since been rewritten
+	e, err := b.readAt(df, item.Offset, item.Size)
+	if err != nil || e.Key != key || e.Sequence != item.Sequence || e.Checksum != item.Checksum {
+		return nil, false
+	}
+	if !b.config.noChecksum && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+		return nil, false
+	}
+	value, err := b.config.value(e)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}